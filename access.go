@@ -0,0 +1,242 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReadAccess is what one visitor may read. Pages are private when their
+// namespace is listed in privateNamespaces or they are in a category listed
+// in privateCategories, or in any of its subcategories
+type ReadAccess struct {
+	hiddenNamespaces map[int]bool
+	hiddenPages      map[string]bool
+	hiddenCategories map[string]bool // the private categories and their subcategories
+	files            map[string]bool // canReadFile answers so far
+	denyAll          bool            // the private pages couldn't be looked up
+}
+
+// allowedToRead reports whether group meets one of the groups a private
+// namespace or category is open to
+func allowedToRead(group string, allowed []string) bool {
+	for _, level := range allowed {
+		if meetsLevel(group, level) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrivateConfig warns about private namespaces that aren't registered
+func checkPrivateConfig() {
+	for name := range config.PrivateNamespaces {
+		if _, ok := namespaceByName(name); !ok && name != "Main" {
+			log.Warnf("privateNamespaces: unknown namespace %q", name)
+		}
+	}
+}
+
+// readAccessFor works out what the visitor behind r may read, without
+// touching the database when nothing is private
+func readAccessFor(r *http.Request) *ReadAccess {
+	group := userGroup(currentUserID(r))
+	a := &ReadAccess{
+		hiddenNamespaces: make(map[int]bool),
+		hiddenPages:      make(map[string]bool),
+		hiddenCategories: make(map[string]bool),
+		files:            make(map[string]bool),
+	}
+	for name, allowed := range config.PrivateNamespaces {
+		if allowedToRead(group, allowed) {
+			continue
+		}
+		if name == "Main" {
+			a.hiddenNamespaces[NamespaceMain] = true
+		} else if ns, ok := namespaceByName(name); ok {
+			a.hiddenNamespaces[ns.ID] = true
+		}
+	}
+
+	var hiddenCategories []interface{}
+	for name, allowed := range config.PrivateCategories {
+		if !allowedToRead(group, allowed) {
+			hiddenCategories = append(hiddenCategories, canonicalizeTitle(name))
+		}
+	}
+	if len(hiddenCategories) == 0 {
+		return a
+	}
+
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		log.Error("Database Error:", err)
+		a.denyAll = true
+		return a
+	}
+	defer dbConn.Close()
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(hiddenCategories)), ",")
+	private := `WITH RECURSIVE private(id) AS (
+			SELECT id FROM Categories WHERE title IN (` + placeholders + `)
+			UNION SELECT SubCategoryPages.subcategory_id FROM SubCategoryPages JOIN private ON SubCategoryPages.category_id = private.id
+		)`
+	for _, q := range []struct {
+		query  string
+		hidden map[string]bool
+	}{
+		{private + ` SELECT title FROM Categories WHERE id IN (SELECT id FROM private)`, a.hiddenCategories},
+		{private + ` SELECT DISTINCT Pages.title FROM CategoryPages
+			JOIN Pages ON Pages.id = CategoryPages.page_id
+			WHERE CategoryPages.category_id IN (SELECT id FROM private)`, a.hiddenPages},
+	} {
+		if err := collectTitles(dbConn, q.query, hiddenCategories, q.hidden); err != nil {
+			log.Error("Database Error:", err)
+			a.denyAll = true
+			return a
+		}
+	}
+	return a
+}
+
+func collectTitles(dbConn *sql.DB, query string, args []interface{}, into map[string]bool) error {
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return err
+		}
+		into[title] = true
+	}
+	return rows.Err()
+}
+
+// hidesAnything is false when the visitor may read everything, so callers
+// can skip per-title checks
+func (a *ReadAccess) hidesAnything() bool {
+	return a.denyAll || len(a.hiddenNamespaces) > 0 || len(a.hiddenPages) > 0 || len(a.hiddenCategories) > 0
+}
+
+// canRead reports whether the visitor may read title, a talk page is only
+// readable along with the page it discusses
+func (a *ReadAccess) canRead(title string) bool {
+	if a.denyAll {
+		return false
+	}
+	ns, name := splitTitle(title)
+	if a.hiddenNamespaces[ns.ID] || a.hiddenPages[title] {
+		return false
+	}
+	if ns.ID == NamespaceCategory && a.hiddenCategories[name] {
+		return false
+	}
+	if ns.ID == NamespaceFile && name != "" {
+		return a.canReadFile(name)
+	}
+	if ns.ID == NamespaceTalk && name != "" {
+		return a.canRead(name)
+	}
+	return true
+}
+
+// canReadCategory is false for a private category, or one inside it
+func (a *ReadAccess) canReadCategory(title string) bool {
+	return !a.denyAll && !a.hiddenCategories[title]
+}
+
+// canReadFile is false for a file that is only used on pages the visitor
+// can't read. Files nobody uses yet are public
+func (a *ReadAccess) canReadFile(name string) bool {
+	if !a.hidesAnything() {
+		return true
+	}
+	if readable, ok := a.files[name]; ok {
+		return readable
+	}
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		log.Error("Database Error:", err)
+		return false
+	}
+	defer dbConn.Close()
+
+	usedOn := make(map[string]bool)
+	if err := collectTitles(dbConn, `SELECT DISTINCT Pages.title FROM FileUsage
+		JOIN Pages ON Pages.id = FileUsage.page_id WHERE FileUsage.file_name = ?`, []interface{}{name}, usedOn); err != nil {
+		log.Error("Database Error:", err)
+		return false
+	}
+	readable := len(usedOn) == 0
+	for title := range usedOn {
+		readable = readable || a.canRead(title)
+	}
+	a.files[name] = readable
+	return readable
+}
+
+// canReadNamespace is false for a namespace that is hidden as a whole
+func (a *ReadAccess) canReadNamespace(id int) bool {
+	return !a.denyAll && !a.hiddenNamespaces[id]
+}
+
+// filter drops the titles the visitor may not read
+func (a *ReadAccess) filter(titles []string) []string {
+	var readable []string
+	for _, title := range titles {
+		if a.canRead(title) {
+			readable = append(readable, title)
+		}
+	}
+	return readable
+}
+
+// requireReadable answers with the login page or a 403 when the visitor may
+// not read title, and reports whether the caller should go on
+func requireReadable(w http.ResponseWriter, r *http.Request, title string) bool {
+	if readAccessFor(r).canRead(title) {
+		return true
+	}
+	if currentUserID(r) == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return false
+	}
+	log.Warnf("Read of private %s denied to %s", title, currentUsername(r))
+	w.WriteHeader(http.StatusForbidden)
+	renderTemplate(w, "title", newSpecialPage("Private page", `<div class="alert alert-warning"><i class="ri-lock-line"></i> This page is private to some groups, and yours isn't one of them.</div>`, getUserAgent(r)))
+	return false
+}
+
+// filterMembers is filter for category listings
+func (a *ReadAccess) filterMembers(members []CategoryMember) []CategoryMember {
+	readable := []CategoryMember{}
+	for _, m := range members {
+		if a.canRead(m.Title) {
+			readable = append(readable, m)
+		}
+	}
+	return readable
+}
@@ -0,0 +1,110 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// privateStaff makes Category:Staff042 private to moderators, with a page in
+// it that uses a file
+func privateStaff(t *testing.T) {
+	t.Helper()
+	saved := config.PrivateCategories
+	config.PrivateCategories = map[string][]string{"Staff042": {"moderator"}}
+	t.Cleanup(func() { config.PrivateCategories = saved })
+
+	addCategory(t, "Staff042", "")
+	insertFile(t, "Secret042.png", 10, 0)
+	savePage(t, "Roster042", "[Category:Staff042] [File:Secret042.png]", 0)
+	t.Cleanup(func() { authDB.Exec("DELETE FROM FileUsage WHERE file_name = 'Secret042.png'") })
+}
+
+func TestPrivateCategoryListings(t *testing.T) {
+	privateStaff(t)
+	testUser(t, "Ed042", "ed-pass-042", "editor", "")
+	testUser(t, "Admin042", "admin-pass-042", "admin", "")
+
+	ts, editor := newTestServer(t)
+	login(t, ts, editor, "Ed042", "ed-pass-042")
+	_, admin := newTestServer(t)
+	login(t, ts, admin, "Admin042", "admin-pass-042")
+
+	for _, page := range []string{"/title/Special:Categories", "/admin/category"} {
+		if _, body := get(t, editor, ts.URL+page); strings.Contains(body, "Staff042") {
+			t.Errorf("%s lists a private category to an editor", page)
+		}
+	}
+	if _, body := get(t, admin, ts.URL+"/title/Special:Categories"); !strings.Contains(body, "Staff042") {
+		t.Error("Special:Categories hides a category from a group that can read it")
+	}
+
+	if _, body := get(t, editor, ts.URL+"/title/Special:ListFiles"); strings.Contains(body, "Secret042.png") {
+		t.Error("Special:ListFiles lists a file only used on a private page")
+	}
+	if _, body := get(t, admin, ts.URL+"/title/Special:ListFiles"); !strings.Contains(body, "Secret042.png") {
+		t.Error("Special:ListFiles hides a file from a group that can read it")
+	}
+}
+
+func TestPrivateCategoryEdits(t *testing.T) {
+	privateStaff(t)
+	testUser(t, "Ed042b", "ed-pass-042b", "editor", "")
+
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Ed042b", "ed-pass-042b")
+	if status, body := get(t, client, ts.URL+"/edit/Category:Staff042"); status != http.StatusForbidden || strings.Contains(body, `name="body"`) {
+		t.Errorf("editing a private category: status %d, want 403 without the editor", status)
+	}
+
+	// the edit form of a public page supplies the csrf token
+	status, _ := submit(t, client, ts.URL+"/edit/Public042", ts.URL+"/savecat/Staff042", url.Values{"body": {"overwritten"}})
+	if status != http.StatusForbidden {
+		t.Errorf("saving a private category: status %d, want 403", status)
+	}
+	var body string
+	authDB.QueryRow("SELECT body FROM Categories WHERE title = 'Staff042'").Scan(&body)
+	if body == "overwritten" {
+		t.Error("an editor overwrote a private category")
+	}
+}
+
+func TestFilesDirectoryIsNotListed(t *testing.T) {
+	insertFile(t, "Listed042.png", 10, 0)
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir, "Listed042.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(filepath.Join(uploadDir, "Listed042.png")) })
+	ts, client := newTestServer(t)
+	if status, _ := get(t, client, ts.URL+"/files/Listed042.png"); status != http.StatusOK {
+		t.Fatalf("GET /files/Listed042.png: status %d", status)
+	}
+	for _, path := range []string{"/files/", "/files/sub/"} {
+		if status, body := get(t, client, ts.URL+path); status != http.StatusNotFound || strings.Contains(body, "<a href") {
+			t.Errorf("GET %s: status %d, want 404 without a listing", path, status)
+		}
+	}
+}
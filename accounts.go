@@ -0,0 +1,501 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Account is a row of /admin/users
+type Account struct {
+	ID        int
+	Username  string
+	Group     string
+	Email     string
+	Disabled  bool
+	Pending   bool // requested from /register, waiting for approval
+	TwoFactor bool
+	Sessions  int // logged-in sessions that haven't expired
+	CreatedAt sql.NullTime
+}
+
+func loadAccounts() ([]Account, error) {
+	rows, err := authDB.Query(`SELECT id, username, COALESCE(user_group, CASE WHEN is_admin = 1 THEN 'admin' END, ?), COALESCE(email, ''), disabled, pending, totp_secret IS NOT NULL,
+		(SELECT COUNT(*) FROM Sessions WHERE Sessions.user_id = Users.id AND Sessions.expires_at > datetime('now')), created_at
+		FROM Users ORDER BY username COLLATE NOCASE`, defaultUserGroup)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var a Account
+		if err := rows.Scan(&a.ID, &a.Username, &a.Group, &a.Email, &a.Disabled, &a.Pending, &a.TwoFactor, &a.Sessions, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// validUsername keeps out names that can't be a User: page title
+func validUsername(name string) error {
+	switch {
+	case name == "":
+		return errors.New("the username is empty")
+	case len(name) > 64:
+		return errors.New("the username is longer than 64 characters")
+	case strings.ContainsAny(name, "/:#?[]|{}<>%"):
+		return errors.New("the username can't contain / : # ? [ ] | { } < > or %")
+	}
+	return nil
+}
+
+// deleteAccount removes the account if it still matches where, along with its
+// recovery codes and sessions. Foreign keys are off so nothing cascades
+func deleteAccount(id int, where string) error {
+	tx, err := authDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM Users WHERE id = ? AND "+where, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	for _, table := range []string{"RecoveryCodes", "Sessions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// managersLeft counts the enabled accounts that could still manage users
+// once change has been applied to a copy of the accounts
+func managersLeft(accounts []Account, change func(*Account)) int {
+	count := 0
+	for _, a := range accounts {
+		change(&a)
+		if !a.Disabled && !a.Pending && groups[a.Group][PermManageUsers] {
+			count++
+		}
+	}
+	return count
+}
+
+// usersHandler is /admin/users, GET lists the accounts and a POST with an
+// action field creates, disables, enables or deletes one, resets its
+// password or 2FA, unlocks it after failed logins or moves it to another
+// group. It also approves or rejects requested accounts and creates and
+// revokes invites
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		renderUsers(w, r, "", http.StatusOK)
+		return
+	}
+
+	accounts, err := loadAccounts()
+	if err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+
+	action := r.FormValue("action")
+	switch action {
+	case "create":
+		message, status := createAccount(r)
+		renderUsers(w, r, message, status)
+		return
+	case "invite":
+		message, status := inviteAccount(r)
+		renderUsers(w, r, message, status)
+		return
+	case "revoke-invite":
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		res, err := authDB.Exec("DELETE FROM Invites WHERE id = ? AND used_at IS NULL", id)
+		if err != nil {
+			log.Error("Database Error:", err)
+			http.Error(w, "Internal DB error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			renderUsers(w, r, "There is no such invite.", http.StatusNotFound)
+			return
+		}
+		writeLog(r, "user", "revoke-invite", currentUsername(r), "", "", "")
+		renderUsers(w, r, "The invite has been revoked.", http.StatusOK)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	var target *Account
+	for i := range accounts {
+		if accounts[i].ID == id {
+			target = &accounts[i]
+		}
+	}
+	if target == nil {
+		renderUsers(w, r, "There is no such user.", http.StatusNotFound)
+		return
+	}
+	self := id == currentUserID(r)
+
+	if target.Pending != (action == "approve" || action == "reject") {
+		renderUsers(w, r, fmt.Sprintf("Can't %s %s.", action, target.Username), http.StatusConflict)
+		return
+	}
+
+	var message string
+	switch action {
+	case "approve":
+		group := r.FormValue("group")
+		if _, ok := groups[group]; !ok || group == anonymousGroup {
+			renderUsers(w, r, fmt.Sprintf("There is no group called %q.", group), http.StatusBadRequest)
+			return
+		}
+		_, err = authDB.Exec("UPDATE Users SET pending = 0, user_group = ?, is_admin = ? WHERE id = ?", group, boolToInt(group == "admin"), id)
+		if err == nil {
+			writeLog(r, "user", "approve", currentUsername(r), target.Username, "", "group="+group)
+			message = fmt.Sprintf("%s has been approved into the %s group.", target.Username, group)
+		}
+
+	case "reject":
+		err = deleteAccount(id, "pending = 1")
+		if err == nil {
+			writeLog(r, "user", "reject", currentUsername(r), target.Username, "", "")
+			message = fmt.Sprintf("The request from %s has been rejected.", target.Username)
+		}
+
+	case "group":
+		group := r.FormValue("group")
+		if _, ok := groups[group]; !ok || group == anonymousGroup {
+			renderUsers(w, r, fmt.Sprintf("There is no group called %q.", group), http.StatusBadRequest)
+			return
+		}
+		if managersLeft(accounts, func(a *Account) {
+			if a.ID == id {
+				a.Group = group
+			}
+		}) == 0 {
+			renderUsers(w, r, "That would leave nobody able to manage users.", http.StatusConflict)
+			return
+		}
+		_, err = authDB.Exec("UPDATE Users SET user_group = ?, is_admin = ? WHERE id = ?", group, boolToInt(group == "admin"), id)
+		if err == nil {
+			writeLog(r, "rights", "group", currentUsername(r), target.Username, "", fmt.Sprintf("%s → %s", target.Group, group))
+			message = fmt.Sprintf("%s is now in the %s group.", target.Username, group)
+		}
+
+	case "disable", "enable":
+		disable := action == "disable"
+		if self && disable {
+			renderUsers(w, r, "You can't disable your own account.", http.StatusConflict)
+			return
+		}
+		if disable && managersLeft(accounts, func(a *Account) {
+			if a.ID == id {
+				a.Disabled = true
+			}
+		}) == 0 {
+			renderUsers(w, r, "That would leave nobody able to manage users.", http.StatusConflict)
+			return
+		}
+		_, err = authDB.Exec("UPDATE Users SET disabled = ? WHERE id = ?", boolToInt(disable), id)
+		if err == nil && disable {
+			_, err = revokeUserSessions(id, "")
+		}
+		if err == nil {
+			writeLog(r, "user", action, currentUsername(r), target.Username, "", "")
+			message = fmt.Sprintf("%s has been %sd.", target.Username, action)
+		}
+
+	case "password":
+		password := r.FormValue("password")
+		if err := checkPassword(password); err != nil {
+			renderUsers(w, r, "Can't reset the password: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+		// someone else knows it now, so it's only good for the next login
+		if err = setPassword(id, password, !self); err == nil {
+			keep := ""
+			if self {
+				keep = currentSessionID(r)
+			}
+			_, err = revokeUserSessions(id, keep)
+		}
+		if err == nil {
+			writeLog(r, "user", "password-reset", currentUsername(r), target.Username, "", "")
+			message = fmt.Sprintf("The password of %s has been reset.", target.Username)
+			if !self {
+				message += " They will have to change it when they next log in."
+			}
+		}
+
+	case "sign-out":
+		// for a lost laptop or a stolen cookie, the password stays as it is
+		keep := ""
+		if self {
+			keep = currentSessionID(r)
+		}
+		var n int64
+		if n, err = revokeUserSessions(id, keep); err == nil {
+			writeLog(r, "user", "force-logout", currentUsername(r), target.Username, "", fmt.Sprintf("%d session(s)", n))
+			message = fmt.Sprintf("%s has been signed out of %d session(s).", target.Username, n)
+		}
+
+	case "unlock":
+		logins.reset(accountKey(target.Username))
+		writeLog(r, "user", "unlock", currentUsername(r), target.Username, "", "")
+		message = fmt.Sprintf("%s can try to log in again.", target.Username)
+
+	case "2fa-reset":
+		// for someone who lost their authenticator and recovery codes
+		if err = disableTwoFactor(id); err == nil {
+			writeLog(r, "user", "2fa-reset", currentUsername(r), target.Username, "", "")
+			message = fmt.Sprintf("%s can log in with just a password now.", target.Username)
+			if twoFactorRequired(target.Group) {
+				message += " They will have to set up 2FA again."
+			}
+		}
+
+	case "delete":
+		if self {
+			renderUsers(w, r, "You can't delete your own account.", http.StatusConflict)
+			return
+		}
+		if managersLeft(accounts, func(a *Account) {
+			if a.ID == id {
+				a.Disabled = true // as good as deleted
+			}
+		}) == 0 {
+			renderUsers(w, r, "That would leave nobody able to manage users.", http.StatusConflict)
+			return
+		}
+		// pages, revisions and uploads keep the id and show as by an unknown user
+		err = deleteAccount(id, "1")
+		if err == nil {
+			writeLog(r, "user", "delete", currentUsername(r), target.Username, "", "")
+			message = fmt.Sprintf("%s has been deleted.", target.Username)
+		}
+
+	default:
+		renderUsers(w, r, fmt.Sprintf("Unknown action %q.", action), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+	renderUsers(w, r, message, http.StatusOK)
+}
+
+// createAccount handles the new user form, returning what to tell the admin
+func createAccount(r *http.Request) (string, int) {
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	group := r.FormValue("group")
+	if err := validUsername(username); err != nil {
+		return "Can't create the user: " + err.Error() + ".", http.StatusBadRequest
+	}
+	if err := checkPassword(password); err != nil {
+		return "Can't create the user: " + err.Error() + ".", http.StatusBadRequest
+	}
+	if _, ok := groups[group]; !ok || group == anonymousGroup {
+		return fmt.Sprintf("There is no group called %q.", group), http.StatusBadRequest
+	}
+	if findUsername(username) != "" {
+		return fmt.Sprintf("Can't create the user: %s.", errUserExists), http.StatusConflict
+	}
+
+	if _, err := addUser(username, password, group, "", false); errors.Is(err, errUserExists) {
+		return fmt.Sprintf("Can't create the user: %s.", err), http.StatusConflict
+	} else if err != nil {
+		log.Error("Database Error:", err)
+		return "Can't create the user, see the server log.", http.StatusInternalServerError
+	}
+	writeLog(r, "user", "create", currentUsername(r), username, "", "group="+group)
+	return fmt.Sprintf("Created %s in the %s group.", username, group), http.StatusOK
+}
+
+// inviteAccount handles the new invite form, the link is only ever shown here
+func inviteAccount(r *http.Request) (string, int) {
+	group := r.FormValue("group")
+	note := strings.TrimSpace(r.FormValue("note"))
+	if _, ok := groups[group]; !ok || group == anonymousGroup {
+		return fmt.Sprintf("There is no group called %q.", group), http.StatusBadRequest
+	}
+	token, err := createInvite(group, note, currentUserID(r))
+	if err != nil {
+		log.Error("Database Error:", err)
+		return "Can't create the invite, see the server log.", http.StatusInternalServerError
+	}
+	writeLog(r, "user", "invite", currentUsername(r), "", "", strings.TrimSpace("group="+group+" "+note))
+	link := siteURL("/register?invite=" + token)
+	if config.BaseURL == "" {
+		link += " (on this wiki, set baseURL in config.json to get a full link)"
+	}
+	return "Send this link to whoever you are inviting, it works once and won't be shown again: " + link, http.StatusOK
+}
+
+func groupSelect(name string, current string) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`<select class="form-select form-select-sm" name="%s">`, name))
+	for _, group := range groupNames() {
+		selected := ""
+		if group == current {
+			selected = " selected"
+		}
+		b.WriteString(fmt.Sprintf(`<option value="%s"%s>%s</option>`, html.EscapeString(group), selected, html.EscapeString(group)))
+	}
+	b.WriteString(`</select>`)
+	return b.String()
+}
+
+func renderUsers(w http.ResponseWriter, r *http.Request, message string, status int) {
+	accounts, err := loadAccounts()
+	var invites []Invite
+	if err == nil {
+		invites, err = loadInvites()
+	}
+	if err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	if message != "" {
+		class := "alert-success"
+		if status != http.StatusOK {
+			class = "alert-danger"
+		}
+		b.WriteString(fmt.Sprintf(`<div class="alert %s">%s</div>`, class, html.EscapeString(message)))
+	}
+
+	form := func(id int, action string, inner string) string {
+		return fmt.Sprintf(`<form action="/admin/users" method="POST" class="d-flex gap-1">%s<input type="hidden" name="id" value="%d"><input type="hidden" name="action" value="%s">%s</form>`, csrfInput(r), id, action, inner)
+	}
+	joined := func(a Account) string {
+		if a.CreatedAt.Valid {
+			return a.CreatedAt.Time.Format("2 January 2006")
+		}
+		return ""
+	}
+
+	var pending strings.Builder
+	for _, a := range accounts {
+		if !a.Pending {
+			continue
+		}
+		pending.WriteString(fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+			html.EscapeString(a.Username), html.EscapeString(a.Email), joined(a),
+			form(a.ID, "approve", groupSelect("group", defaultUserGroup)+`<button class="btn btn-sm btn-outline-secondary" type="submit">Approve</button>`),
+			form(a.ID, "reject", `<button class="btn btn-sm btn-outline-danger" type="submit">Reject</button>`),
+		))
+	}
+	if pending.Len() > 0 {
+		b.WriteString(`<h2 class="wikih2">Account requests</h2><table class="table table-sm align-middle">
+        <tr><th>User</th><th>Email</th><th>Requested</th><th>Group</th><th></th></tr>`)
+		b.WriteString(pending.String())
+		b.WriteString(`</table>`)
+	}
+
+	b.WriteString(fmt.Sprintf(`<h2 class="wikih2">Add a user</h2>
+    <form action="/admin/users" method="POST" class="row g-2 mb-4">
+        %s
+        <input type="hidden" name="action" value="create">
+        <div class="col-auto"><input class="form-control form-control-sm" type="text" name="username" placeholder="Username" required></div>
+        <div class="col-auto"><input class="form-control form-control-sm" type="password" name="password" placeholder="Password" autocomplete="new-password" required></div>
+        <div class="col-auto">%s</div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">Create</button></div>
+    </form>`, csrfInput(r), groupSelect("group", defaultUserGroup)))
+
+	b.WriteString(fmt.Sprintf(`<h2 class="wikih2">Invites</h2>
+    <form action="/admin/users" method="POST" class="row g-2 mb-2">
+        %s
+        <input type="hidden" name="action" value="invite">
+        <div class="col-auto"><input class="form-control form-control-sm" type="text" name="note" placeholder="Who it's for"></div>
+        <div class="col-auto">%s</div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">Create invite link</button></div>
+    </form>`, csrfInput(r), groupSelect("group", defaultUserGroup)))
+	if len(invites) > 0 {
+		b.WriteString(`<table class="table table-sm align-middle mb-4"><tr><th>For</th><th>Group</th><th>By</th><th>Expires</th><th></th></tr>`)
+		for _, i := range invites {
+			b.WriteString(fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+				html.EscapeString(i.Note), html.EscapeString(i.Group), html.EscapeString(i.CreatedBy), i.ExpiresAt.Format("2 January 2006 15:04"),
+				form(i.ID, "revoke-invite", `<button class="btn btn-sm btn-outline-danger" type="submit">Revoke</button>`),
+			))
+		}
+		b.WriteString(`</table>`)
+	}
+
+	b.WriteString(`<h2 class="wikih2">Users</h2><table class="table table-sm align-middle">
+        <tr><th>User</th><th>Joined</th><th>Group</th><th>Status</th><th>Sessions</th><th>2FA</th><th>Password</th><th></th></tr>`)
+	for _, a := range accounts {
+		if a.Pending {
+			continue
+		}
+		status, toggle := "Active", "disable"
+		if a.Disabled {
+			status, toggle = `<span class="text-danger">Disabled</span>`, "enable"
+		} else if until := logins.lockedUntil(accountKey(a.Username)); !until.IsZero() {
+			status = form(a.ID, "unlock", fmt.Sprintf(`<span class="text-danger">Locked until %s</span> <button class="btn btn-sm btn-outline-secondary" type="submit">Unlock</button>`, until.Format("15:04")))
+		}
+		sessions := "0"
+		if a.Sessions > 0 {
+			sessions = form(a.ID, "sign-out", fmt.Sprintf(`%d <button class="btn btn-sm btn-outline-secondary" type="submit">Sign out</button>`, a.Sessions))
+		}
+		twoFactor := "Off"
+		if a.TwoFactor {
+			twoFactor = form(a.ID, "2fa-reset", `On <button class="btn btn-sm btn-outline-secondary" type="submit">Reset</button>`)
+		} else if twoFactorRequired(a.Group) {
+			twoFactor = `<span class="text-danger">Not set up</span>`
+		}
+		b.WriteString(fmt.Sprintf(`<tr><td><a href="/title/User:%s">%s</a> <a class="text-muted small" href="/title/Special:Contributions/%s">contribs</a></td><td>%s</td><td>%s</td><td>%s %s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+			url.PathEscape(a.Username), html.EscapeString(a.Username), url.PathEscape(a.Username), joined(a),
+			form(a.ID, "group", groupSelect("group", a.Group)+`<button class="btn btn-sm btn-outline-secondary" type="submit">Change</button>`),
+			status,
+			form(a.ID, toggle, fmt.Sprintf(`<button class="btn btn-sm btn-outline-secondary" type="submit">%s</button>`, strings.ToUpper(toggle[:1])+toggle[1:])),
+			sessions,
+			twoFactor,
+			form(a.ID, "password", `<input class="form-control form-control-sm" type="password" name="password" placeholder="New password" autocomplete="new-password" required><button class="btn btn-sm btn-outline-secondary" type="submit">Reset</button>`),
+			form(a.ID, "delete", fmt.Sprintf(`<button class="btn btn-sm btn-outline-danger" type="submit" onclick="return confirm('Delete %s? Their edits are kept.')">Delete</button>`, html.EscapeString(strings.ReplaceAll(a.Username, "'", "")))),
+		))
+	}
+	b.WriteString(`</table>`)
+
+	w.WriteHeader(status)
+	renderTemplate(w, "title", newSpecialPage("User management", b.String(), getUserAgent(r)))
+}
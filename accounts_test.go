@@ -0,0 +1,56 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDeleteAccountCleansUp(t *testing.T) {
+	id := testUser(t, "Gone043", "gone-pass-043", "editor", "")
+	if _, err := newRecoveryCodes(id); err != nil {
+		t.Fatal(err)
+	}
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Gone043", "gone-pass-043")
+
+	count := func(table string) int {
+		var n int
+		if err := authDB.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE user_id = ?", id).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if count("RecoveryCodes") == 0 || count("Sessions") == 0 {
+		t.Fatal("the account has no recovery codes or sessions to clean up")
+	}
+
+	if err := deleteAccount(id, "1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"RecoveryCodes", "Sessions"} {
+		if n := count(table); n != 0 {
+			t.Errorf("%d %s rows left after deleting the account", n, table)
+		}
+	}
+	if status, body := get(t, client, ts.URL+"/account"); status == http.StatusOK && strings.Contains(body, `href="/logout"`) {
+		t.Error("the deleted account is still logged in")
+	}
+}
@@ -18,9 +18,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"html"
 	"html/template"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/ArcWiki/ArcWiki/db"
@@ -32,11 +37,11 @@ func adminHandler(w http.ResponseWriter, r *http.Request, title string, userAgen
 
 	switch title {
 	case "page":
-		managePages(userAgent, baseURL, w)
+		managePages(r, userAgent, baseURL, w)
 		return
 
 	case "category":
-		manageCategory(userAgent, baseURL, w)
+		manageCategory(r, userAgent, baseURL, w)
 		return
 
 	default:
@@ -68,7 +73,7 @@ func adminHandler(w http.ResponseWriter, r *http.Request, title string, userAgen
 	}
 }
 
-func manageCategory(userAgent string, baseURL string, w http.ResponseWriter) {
+func manageCategory(r *http.Request, userAgent string, baseURL string, w http.ResponseWriter) {
 	size := ""
 	if userAgent == Desktop {
 		size = "<div class=\"col-11 d-none d-sm-block\">"
@@ -93,6 +98,7 @@ func manageCategory(userAgent string, baseURL string, w http.ResponseWriter) {
 	}
 	defer rows.Close()
 
+	access := readAccessFor(r)
 	var pageLinks []string
 	for rows.Next() {
 		var title string
@@ -103,6 +109,9 @@ func manageCategory(userAgent string, baseURL string, w http.ResponseWriter) {
 			return
 
 		}
+		if !access.canReadCategory(title) {
+			continue
+		}
 		pageLinks = append(pageLinks, fmt.Sprintf("<li><a href=\"%s%s\">%s</a> <a href=\"%s\"> Edit Category</a> <a href=\"%s\"> Delete Category</a></li>", baseURL, "Category:"+title, title, "/edit/Category:"+title, "/delete/category/"+title))
 	}
 
@@ -120,7 +129,7 @@ func manageCategory(userAgent string, baseURL string, w http.ResponseWriter) {
 	renderTemplate(w, "title", &p)
 }
 
-func managePages(userAgent string, baseURL string, w http.ResponseWriter) {
+func managePages(r *http.Request, userAgent string, baseURL string, w http.ResponseWriter) {
 	size := ""
 	if userAgent == Desktop {
 		size = "<div class=\"col-11 d-none d-sm-block\">"
@@ -144,6 +153,7 @@ func managePages(userAgent string, baseURL string, w http.ResponseWriter) {
 	}
 	defer rows.Close()
 
+	access := readAccessFor(r)
 	var pageLinks []string
 	for rows.Next() {
 		var title string
@@ -153,6 +163,9 @@ func managePages(userAgent string, baseURL string, w http.ResponseWriter) {
 			return
 
 		}
+		if !access.canRead(title) {
+			continue
+		}
 		pageLinks = append(pageLinks, fmt.Sprintf("<li><a href=\"%s%s\">%s</a> <a href=\"%s\"> Edit Page</a> <a href=\"%s\"> Delete Page</a></li>", baseURL, title, title, "/edit/"+title, "/delete/page/"+title))
 	}
 
@@ -169,3 +182,112 @@ func managePages(userAgent string, baseURL string, w http.ResponseWriter) {
 
 	renderTemplate(w, "title", &p)
 }
+
+// configHandler is /admin/config, where config.json can be edited. The new
+// file is checked and written, and takes effect when ArcWiki is restarted
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	current, err := os.ReadFile(configPath)
+	if err != nil {
+		log.Error("Error reading "+configPath+":", err)
+		http.Error(w, "Can't read "+configPath, http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodPost {
+		renderConfigForm(w, r, string(current), "", http.StatusOK)
+		return
+	}
+
+	edited := strings.ReplaceAll(r.FormValue("config"), "\r\n", "\n")
+	if err := checkConfig([]byte(edited)); err != nil {
+		renderConfigForm(w, r, edited, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if edited == string(current) {
+		renderConfigForm(w, r, edited, "Nothing has changed.", http.StatusOK)
+		return
+	}
+	if err := writeConfig([]byte(edited)); err != nil {
+		log.Error("Error writing "+configPath+":", err)
+		renderConfigForm(w, r, edited, "The configuration couldn't be saved: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logConfigChange(r, []byte(edited))
+	log.Infof("%s changed %s", currentUsername(r), configPath)
+	renderConfigForm(w, r, edited, "The configuration has been saved. Restart ArcWiki for it to take effect.", http.StatusOK)
+}
+
+// checkConfig refuses a config.json the server couldn't start with, one with
+// keys or permissions it doesn't know, and one that leaves no group able to
+// change it back
+func checkConfig(configBytes []byte) error {
+	var c Config
+	dec := json.NewDecoder(bytes.NewReader(configBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if len(c.Groups) == 0 {
+		return nil
+	}
+	known := make(map[string]bool, len(allPermissions))
+	for _, perm := range allPermissions {
+		known[perm] = true
+	}
+	editable := false
+	for group, perms := range c.Groups {
+		for _, perm := range perms {
+			if !known[perm] {
+				return fmt.Errorf("group %q has unknown permission %q", group, perm)
+			}
+			if perm == PermEditConfig && group != anonymousGroup {
+				editable = true
+			}
+		}
+	}
+	if !editable {
+		return fmt.Errorf("no group would have the %s permission, so the configuration couldn't be changed again", PermEditConfig)
+	}
+	return nil
+}
+
+// writeConfig replaces config.json through a rename so a failed write
+// leaves the old file in place
+func writeConfig(configBytes []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(configBytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
+
+// renderConfigForm shows the editor, with message as a success when status is 200
+func renderConfigForm(w http.ResponseWriter, r *http.Request, configText string, message string, status int) {
+	var b strings.Builder
+	if message != "" {
+		class := "alert-success"
+		if status != http.StatusOK {
+			class = "alert-danger"
+		}
+		b.WriteString(alert(class, message))
+	}
+	b.WriteString(fmt.Sprintf(`<p>This is <code>%s</code>. Changes are checked before they are saved and take effect when ArcWiki is restarted. The <code>COLOR</code>, <code>SITENAME</code> and <code>BASE_URL</code> environment variables override what is set here.</p>
+    <form action="/admin/config" method="POST">
+        %s
+        <textarea class="form-control font-monospace mb-2" name="config" rows="30" spellcheck="false">%s</textarea>
+        <button class="btn btn-outline-secondary" type="submit">Save</button>
+    </form>`, configPath, csrfInput(r), html.EscapeString(configText)))
+
+	w.WriteHeader(status)
+	renderTemplate(w, "title", newSpecialPage("Configuration", b.String(), getUserAgent(r)))
+}
@@ -0,0 +1,333 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// ArchiveEntry is a deleted page or category waiting in the trash
+type ArchiveEntry struct {
+	ID         int
+	Kind       string
+	OriginalID int
+	Title      string
+	Body       string
+	DeletedAt  time.Time
+	DeletedBy  string
+	Revisions  int
+}
+
+func loadArchiveEntries(dbConn *sql.DB, where string, args ...interface{}) ([]ArchiveEntry, error) {
+	rows, err := dbConn.Query(`SELECT id, kind, original_id, title, COALESCE(body, ''), deleted_at,
+		COALESCE((SELECT username FROM Users WHERE Users.id = Archive.deleted_by), ''),
+		(SELECT COUNT(*) FROM Revisions WHERE Archive.kind = 'page' AND Revisions.page_id = Archive.original_id)
+		FROM Archive `+where+` ORDER BY deleted_at DESC, id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []ArchiveEntry
+	for rows.Next() {
+		var e ArchiveEntry
+		if err := rows.Scan(&e.ID, &e.Kind, &e.OriginalID, &e.Title, &e.Body, &e.DeletedAt, &e.DeletedBy, &e.Revisions); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func loadArchiveLinks(dbConn *sql.DB, archiveID int) (map[string][]string, error) {
+	rows, err := dbConn.Query("SELECT link_type, title FROM ArchiveLinks WHERE archive_id = ? ORDER BY title", archiveID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make(map[string][]string)
+	for rows.Next() {
+		var linkType, title string
+		if err := rows.Scan(&linkType, &title); err != nil {
+			return nil, err
+		}
+		links[linkType] = append(links[linkType], title)
+	}
+	return links, rows.Err()
+}
+
+// Special:Undelete lists the trash, ?id=N previews a single entry
+func loadUndelete(r *http.Request, userAgent string) (*Page, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	var bodyHTML strings.Builder
+
+	if id, err := strconv.Atoi(r.URL.Query().Get("id")); err == nil {
+		entries, err := loadArchiveEntries(dbConn, "WHERE id = ?", id)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("archive entry %d not found", id)
+		}
+		e := entries[0]
+		links, err := loadArchiveLinks(dbConn, e.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		bodyHTML.WriteString(fmt.Sprintf(`<h2 class="wikih2">Deleted %s: %s</h2>`, e.Kind, html.EscapeString(removeUnderscores(e.Title))))
+		bodyHTML.WriteString(fmt.Sprintf(`<p>Deleted on %s`, formatDateTime(e.DeletedAt)))
+		if e.DeletedBy != "" {
+			bodyHTML.WriteString(fmt.Sprintf(` by <a href="/title/User:%s">%s</a>`, url.PathEscape(e.DeletedBy), html.EscapeString(e.DeletedBy)))
+		}
+		bodyHTML.WriteString(`.`)
+		if e.Kind == "page" {
+			bodyHTML.WriteString(fmt.Sprintf(` %d revisions will be restored with it.`, e.Revisions))
+		}
+		bodyHTML.WriteString(`</p>`)
+		for _, section := range []struct{ linkType, label string }{
+			{"category", "Categories"},
+			{"parent", "Parent categories"},
+			{"child", "Subcategories"},
+			{"member", "Pages in category"},
+		} {
+			linkType := section.linkType
+			if len(links[linkType]) == 0 {
+				continue
+			}
+			bodyHTML.WriteString(fmt.Sprintf(`<h3>%s</h3><ul>`, section.label))
+			for _, title := range links[linkType] {
+				bodyHTML.WriteString("<li>" + html.EscapeString(title) + "</li>")
+			}
+			bodyHTML.WriteString(`</ul>`)
+		}
+		bodyHTML.WriteString(`<pre class="border rounded p-2 bg-light">` + html.EscapeString(e.Body) + `</pre>`)
+		bodyHTML.WriteString(undeleteForm(r, e.ID))
+		bodyHTML.WriteString(`<p><a href="/title/Special:Undelete">Back to the trash</a></p>`)
+		return newSpecialPage("Special:Undelete", bodyHTML.String(), userAgent), nil
+	}
+
+	entries, err := loadArchiveEntries(dbConn, "")
+	if err != nil {
+		return nil, err
+	}
+
+	bodyHTML.WriteString(`<h2 class="wikih2">Trash</h2>`)
+	if config.TrashPurgeDays > 0 {
+		bodyHTML.WriteString(fmt.Sprintf(`<p>Deleted pages and categories are purged permanently after %d days.</p>`, config.TrashPurgeDays))
+	}
+	if len(entries) == 0 {
+		bodyHTML.WriteString(`<p>The trash is empty.</p>`)
+	} else {
+		bodyHTML.WriteString(`<table class="table table-sm"><tr><th>Deleted</th><th>By</th><th>Type</th><th>Title</th><th>Revisions</th><th></th></tr>`)
+		for _, e := range entries {
+			revisions := ""
+			if e.Kind == "page" {
+				revisions = strconv.Itoa(e.Revisions)
+			}
+			bodyHTML.WriteString(fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td><td><a href="/title/Special:Undelete?id=%d">%s</a></td><td>%s</td><td>%s</td></tr>`,
+				formatDateTime(e.DeletedAt), html.EscapeString(e.DeletedBy), e.Kind, e.ID, html.EscapeString(e.Title), revisions, undeleteForm(r, e.ID)))
+		}
+		bodyHTML.WriteString(`</table>`)
+	}
+
+	return newSpecialPage("Special:Undelete", bodyHTML.String(), userAgent), nil
+}
+
+func undeleteForm(r *http.Request, archiveID int) string {
+	return fmt.Sprintf(`<form action="/undelete/%d" method="POST" style="display:inline">
+        %s
+        <button class="btn btn-sm btn-outline-secondary" type="submit">Restore</button>
+    </form>`, archiveID, csrfInput(r))
+}
+
+func undeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/title/Special:Undelete", http.StatusSeeOther)
+		return
+	}
+	archiveID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/undelete/"))
+	if err != nil {
+		http.Error(w, "Invalid URL format", http.StatusBadRequest)
+		return
+	}
+
+	target, err := restoreArchive(archiveID, currentUserID(r))
+	if err != nil {
+		log.Error("Error restoring archive entry:", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	restored, _ := url.PathUnescape(strings.TrimPrefix(target, "/title/"))
+	writeLog(r, "delete", "restore", currentUsername(r), restored, "", "")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// restoreArchive puts a page or category back under its original id, so the
+// revisions that still point at it line up again, and returns where it lives.
+// restoredBy is the author of any category its tags create
+func restoreArchive(archiveID int, restoredBy int) (string, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return "", err
+	}
+	defer dbConn.Close()
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var kind, title string
+	var originalID int
+	var body sql.NullString
+	var userID sql.NullInt64
+	var createdAt, updatedAt sql.NullTime
+	err = tx.QueryRow("SELECT kind, original_id, title, body, user_id, created_at, updated_at FROM Archive WHERE id = ?", archiveID).
+		Scan(&kind, &originalID, &title, &body, &userID, &createdAt, &updatedAt)
+	if err != nil {
+		return "", err
+	}
+
+	var target string
+	switch kind {
+	case "page":
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM Pages WHERE title = ?)", title).Scan(&exists); err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("a page titled %s already exists", title)
+		}
+		ns, _ := splitTitle(title)
+		_, err = tx.Exec("INSERT INTO Pages (id, title, namespace, body, user_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			originalID, title, ns.ID, body, userID, createdAt, updatedAt)
+		if err != nil {
+			return "", err
+		}
+		if err = linkPageCategories(tx, originalID, body.String, restoredBy); err != nil {
+			return "", err
+		}
+		if err = updateFileUsage(tx, originalID, body.String); err != nil {
+			return "", err
+		}
+		target = "/title/" + url.PathEscape(title)
+
+	case "category":
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM Categories WHERE title = ?)", title).Scan(&exists); err != nil {
+			return "", err
+		}
+		if exists {
+			return "", fmt.Errorf("a category titled %s already exists", title)
+		}
+		_, err = tx.Exec("INSERT INTO Categories (id, title, body, user_id, created_at) VALUES (?, ?, ?, ?, ?)",
+			originalID, title, body, userID, createdAt)
+		if err != nil {
+			return "", err
+		}
+		// members and subcategories that still carry the tag have been waiting
+		// in PendingCategoryLinks with their sort keys. ArchiveLinks only say
+		// what was linked at deletion and may be stale, so they aren't replayed
+		if err = attachPendingLinks(tx, originalID, title); err != nil {
+			return "", err
+		}
+		// parents come from the restored wikitext, as on a save
+		if err = checkCategoryCycle(tx, originalID, title, body.String); err != nil {
+			return "", err
+		}
+		if err = linkSubCategories(tx, originalID, body.String, restoredBy); err != nil {
+			return "", err
+		}
+		target = "/title/Category:" + url.PathEscape(title)
+
+	default:
+		return "", fmt.Errorf("unknown archive kind %q", kind)
+	}
+
+	if _, err = tx.Exec("DELETE FROM ArchiveLinks WHERE archive_id = ?", archiveID); err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec("DELETE FROM Archive WHERE id = ?", archiveID); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	log.Infof("Restored %s %s from archive", kind, title)
+	return target, nil
+}
+
+// purgeArchive permanently removes anything that has been in the trash longer than days
+func purgeArchive(days int) error {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cutoff := fmt.Sprintf("-%d days", days)
+	expired := `SELECT id FROM Archive WHERE deleted_at < datetime('now', ?)`
+	stmts := []string{
+		`DELETE FROM Revisions WHERE page_id IN (SELECT original_id FROM Archive WHERE kind = 'page' AND deleted_at < datetime('now', ?))`,
+		`DELETE FROM TalkComments WHERE page_id IN (SELECT original_id FROM Archive WHERE kind = 'page' AND deleted_at < datetime('now', ?))`,
+		`DELETE FROM ArchiveLinks WHERE archive_id IN (` + expired + `)`,
+		`DELETE FROM Archive WHERE id IN (` + expired + `)`,
+	}
+	var purged int64
+	for _, stmt := range stmts {
+		res, err := tx.Exec(stmt, cutoff)
+		if err != nil {
+			return err
+		}
+		purged, _ = res.RowsAffected()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if purged > 0 {
+		log.Infof("Purged %d entries from the archive", purged)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDeletedRevisionsHidden(t *testing.T) {
+	editorID := testUser(t, "Editor027", "editor-pass-027", "editor", "")
+	testUser(t, "Mod027", "mod-pass-027", "moderator", "")
+	savePage(t, "Trashed027", "secret words 027", editorID)
+
+	var revID int
+	if err := authDB.QueryRow("SELECT id FROM Revisions WHERE title = 'Trashed027'").Scan(&revID); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Page{Title: "Trashed027"}).deletePage(editorID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Archive WHERE title = 'Trashed027'")
+		authDB.Exec("DELETE FROM Revisions WHERE title = 'Trashed027'")
+	})
+
+	ts, editor := newTestServer(t)
+	login(t, ts, editor, "Editor027", "editor-pass-027")
+	if status, _ := get(t, editor, fmt.Sprintf("%s/diff/%d", ts.URL, revID)); status != http.StatusNotFound {
+		t.Errorf("editor diff of a deleted page: status %d, want 404", status)
+	}
+	_, body := get(t, editor, ts.URL+"/title/Special:Contributions?user=Editor027")
+	if strings.Contains(body, "Trashed027") {
+		t.Error("editor's contributions list a deleted page")
+	}
+
+	_, mod := newTestServer(t)
+	login(t, ts, mod, "Mod027", "mod-pass-027")
+	status, body := get(t, mod, fmt.Sprintf("%s/diff/%d", ts.URL, revID))
+	if status != http.StatusOK || !strings.Contains(body, "secret words 027") {
+		t.Errorf("moderator diff of a deleted page: status %d", status)
+	}
+	_, body = get(t, mod, ts.URL+"/title/Special:Contributions?user=Editor027")
+	if !strings.Contains(body, "Trashed027") || !strings.Contains(body, "(deleted)") {
+		t.Error("moderator's contributions don't show the deleted page")
+	}
+}
+
+func TestUndeleteRoundTrip(t *testing.T) {
+	userID := testUser(t, "Editor027b", "editor-pass-027", "editor", "")
+	savePage(t, "Restored027", "first", userID)
+	savePage(t, "Restored027", "second", userID)
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Pages WHERE title = 'Restored027'")
+		authDB.Exec("DELETE FROM Revisions WHERE title = 'Restored027'")
+	})
+
+	if err := (&Page{Title: "Restored027"}).deletePage(userID); err != nil {
+		t.Fatal(err)
+	}
+	var pages int
+	authDB.QueryRow("SELECT COUNT(*) FROM Pages WHERE title = 'Restored027'").Scan(&pages)
+	if pages != 0 {
+		t.Fatal("the page is still there after deleting it")
+	}
+
+	var archiveID int
+	if err := authDB.QueryRow("SELECT id FROM Archive WHERE kind = 'page' AND title = 'Restored027'").Scan(&archiveID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreArchive(archiveID, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	var body string
+	if err := authDB.QueryRow("SELECT body FROM Pages WHERE title = 'Restored027'").Scan(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body != "second" {
+		t.Errorf("restored body %q, want the latest revision", body)
+	}
+	var revisions int
+	authDB.QueryRow("SELECT COUNT(*) FROM Revisions r JOIN Pages p ON p.id = r.page_id WHERE p.title = 'Restored027'").Scan(&revisions)
+	if revisions != 2 {
+		t.Errorf("%d revisions after restoring, want 2", revisions)
+	}
+	var archived int
+	authDB.QueryRow("SELECT COUNT(*) FROM Archive WHERE id = ?", archiveID).Scan(&archived)
+	if archived != 0 {
+		t.Error("the archive entry is still there after restoring")
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"html"
 	"html/template"
 	"io/ioutil"
 	"net/http"
@@ -26,11 +28,14 @@ import (
 const envFile = ".env"
 
 // session store
-var store *sessions.CookieStore
+var store *dbStore
 
 // database handle for auth
 var authDB *sql.DB
 
+// tokenKey signs password reset links, it is the session key
+var tokenKey []byte
+
 func init() {
 	// Ensure .env with SESSION_KEY
 	if _, err := os.Stat(envFile); os.IsNotExist(err) {
@@ -56,7 +61,8 @@ func init() {
 	}
 
 	// Initialize Gorilla session store
-	store = sessions.NewCookieStore(key)
+	tokenKey = key
+	store = newDBStore(key)
 	store.Options = &sessions.Options{
 		Path:     "/",
 		MaxAge:   86400 * 7,
@@ -76,18 +82,29 @@ func InitAuthDB(path string) error {
 	}
 	return authDB.Ping()
 }
-func requireLogin(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		session, _ := store.Get(r, "cookie-name")
-		auth, ok := session.Values["authenticated"].(bool)
 
-		if !ok || !auth {
-			http.Redirect(w, r, "/login", http.StatusFound)
-			return
-		}
+// currentUsername returns the name stored in the session at login, or "" for anonymous visitors
+func currentUsername(r *http.Request) string {
+	session, _ := store.Get(r, "cookie-name")
+	if auth, _ := session.Values["authenticated"].(bool); !auth {
+		return ""
+	}
+	username, _ := session.Values["username"].(string)
+	return username
+}
 
-		next(w, r)
+// currentUserID returns the Users.id stored in the session at login, or 0 for
+// anonymous visitors. Sessions from before the id was stored fall back to the username
+func currentUserID(r *http.Request) int {
+	session, _ := store.Get(r, "cookie-name")
+	if auth, _ := session.Values["authenticated"].(bool); !auth {
+		return 0
+	}
+	if id, ok := session.Values["user_id"].(int); ok {
+		return id
 	}
+	username, _ := session.Values["username"].(string)
+	return userIDByName(username)
 }
 
 // getUserAgent helper
@@ -99,15 +116,38 @@ func getUserAgent(r *http.Request) string {
 	return Desktop
 }
 
+// errUserExists is returned by addUser when the username is taken
+var errUserExists = errors.New("a user with that name already exists")
+
+// errAccountDisabled is returned by Authenticate for a correct password on a disabled account
+var errAccountDisabled = errors.New("account disabled")
+
+// errAccountPending is returned by Authenticate for a requested account that hasn't been approved
+var errAccountPending = errors.New("awaiting approval")
+
+func hashPassword(plainPassword string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plainPassword), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
 // CreateUser inserts a bcrypt-hashed user; no-op if username exists.
+// The password has to meet the password policy
 func CreateUser(username, plainPassword string, isAdmin bool) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plainPassword), bcrypt.DefaultCost)
+	if err := checkPassword(plainPassword); err != nil {
+		return err
+	}
+	return insertUser(username, plainPassword, isAdmin)
+}
+
+// insertUser is CreateUser without the password policy, for the default admin
+func insertUser(username, plainPassword string, isAdmin bool) error {
+	hash, err := hashPassword(plainPassword)
 	if err != nil {
 		return err
 	}
 	_, err = authDB.Exec(
-		"INSERT INTO users(username,password,is_admin) VALUES(?,?,?)",
-		username, string(hash), boolToInt(isAdmin),
+		"INSERT INTO users(username,password,is_admin,created_at) VALUES(?,?,?,CURRENT_TIMESTAMP)",
+		username, hash, boolToInt(isAdmin),
 	)
 	if err != nil && !isUniqueConstraintError(err) {
 		return err
@@ -115,23 +155,57 @@ func CreateUser(username, plainPassword string, isAdmin bool) error {
 	return nil
 }
 
-// Authenticate verifies credentials and returns (ok, isAdmin, error).
-func Authenticate(username, plainPassword string) (bool, bool, error) {
+// addUser is CreateUser for new accounts, it puts the user in a group and
+// reports a taken username. A pending account can't log in until approved.
+// Returns the new id
+func addUser(username, plainPassword string, group string, email string, pending bool) (int, error) {
+	if err := checkPassword(plainPassword); err != nil {
+		return 0, err
+	}
+	hash, err := hashPassword(plainPassword)
+	if err != nil {
+		return 0, err
+	}
+	res, err := authDB.Exec(
+		"INSERT INTO users(username,password,email,is_admin,user_group,pending,created_at) VALUES(?,?,?,?,?,?,CURRENT_TIMESTAMP)",
+		username, hash, sql.NullString{String: email, Valid: email != ""}, boolToInt(group == "admin"), group, boolToInt(pending),
+	)
+	if err != nil {
+		if isUniqueConstraintError(err) {
+			return 0, errUserExists
+		}
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	return int(id), nil
+}
+
+// Authenticate returns the id of the account, 0 if the username or password
+// is wrong, and errAccountDisabled or errAccountPending if it can't be used
+func Authenticate(username, plainPassword string) (int, bool, error) {
+	var userID int
 	var storedHash string
 	var isAdminInt int
+	var disabled, pending bool
 	err := authDB.QueryRow(
-		"SELECT password,is_admin FROM users WHERE username = ?", username,
-	).Scan(&storedHash, &isAdminInt)
+		"SELECT id,password,is_admin,disabled,pending FROM users WHERE username = ?", username,
+	).Scan(&userID, &storedHash, &isAdminInt, &disabled, &pending)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return false, false, nil
+			return 0, false, nil
 		}
-		return false, false, err
+		return 0, false, err
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(plainPassword)); err != nil {
-		return false, false, nil
+		return 0, false, nil
+	}
+	if disabled {
+		return 0, false, errAccountDisabled
+	}
+	if pending {
+		return 0, false, errAccountPending
 	}
-	return true, isAdminInt == 1, nil
+	return userID, isAdminInt == 1, nil
 }
 
 func boolToInt(b bool) int {
@@ -153,6 +227,7 @@ func loginFormHandler(w http.ResponseWriter, r *http.Request, title string, user
 		size = `<div class="col-12 d-block d-sm-none">`
 	}
 	bodyMark := `<form action="/loginPost" method="post">
+        ` + csrfInput(r) + `
         <div class="form-group">
           <label for="username">Username:</label>
           <input class="form-control" type="text" id="username" name="username">
@@ -163,6 +238,15 @@ func loginFormHandler(w http.ResponseWriter, r *http.Request, title string, user
         </div>
         <button class="bg-dark hover:bg-gray-100 text-white font-semibold py-2 px-4 border border-gray-400 rounded shadow" type="submit">Login</button>
     </form>`
+	if oidcEnabled() {
+		bodyMark += fmt.Sprintf(`<p class="mt-3"><a class="btn btn-outline-secondary" href="/login/oidc">Log in with %s</a></p>`, html.EscapeString(oidcName()))
+	}
+	if mailEnabled() {
+		bodyMark += `<p class="mt-3"><a href="/reset">Forgot your password?</a></p>`
+	}
+	if config.Registration.Open {
+		bodyMark += `<p class="mt-3">No account? <a href="/register">Request one</a></p>`
+	}
 
 	parsedText := addHeadingIDs(bodyMark)
 	happyhtml := createHeadingList(parsedText)
@@ -191,9 +275,21 @@ func loginFormHandler(w http.ResponseWriter, r *http.Request, title string, user
 	renderTemplate(w, "login", &p)
 }
 
+// logout asks first on a GET, so only a form from this site can log anyone out
 func logout(w http.ResponseWriter, r *http.Request, title string, userAgent string) {
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "title", newSpecialPage("Log out", `<form action="/logout" method="POST">`+csrfInput(r)+`
+        <button class="btn btn-outline-secondary" type="submit">Log out</button>
+    </form>`, userAgent))
+		return
+	}
+	if username := currentUsername(r); username != "" {
+		writeLog(r, "auth", "logout", username, "", "", "")
+	}
+	// the server side of the session goes too, so a copied cookie stops working
 	session, _ := store.Get(r, "cookie-name")
 	session.Values["authenticated"] = false
+	delete(session.Values, "user_id")
 	session.Save(r, w)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -205,23 +301,60 @@ func loginHandler(w http.ResponseWriter, r *http.Request, title string, userAgen
 	}
 	user := r.FormValue("username")
 	pass := r.FormValue("password")
+	if throttled(w, r, user) {
+		return
+	}
 
-	ok, isAdmin, err := Authenticate(user, pass)
+	userID, _, err := Authenticate(user, pass)
+	if errors.Is(err, errAccountDisabled) || errors.Is(err, errAccountPending) {
+		writeLog(r, "auth", "login-failure", user, "", "", err.Error())
+		http.Redirect(w, r, "/error", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		log.Errorf("auth error: %v", err)
 		http.Redirect(w, r, "/error", http.StatusSeeOther)
 		return
 	}
-	if !ok {
+	if userID == 0 {
+		loginFailed(r, user, "")
 		http.Redirect(w, r, "/error", http.StatusSeeOther)
 		return
 	}
 
+	// covers admin/admin from before it had to be changed, and older weak passwords
+	if err := checkPassword(pass); err != nil {
+		if _, err := authDB.Exec("UPDATE Users SET must_change_password = 1 WHERE id = ?", userID); err != nil {
+			log.Error("Database Error:", err)
+		}
+	}
+
+	if accountState(userID).TwoFactor {
+		startTwoFactorLogin(w, r, userID, user)
+		return
+	}
 	session, _ := store.Get(r, "cookie-name")
+	completeLogin(w, r, session, userID, user)
+}
+
+// completeLogin marks the session logged in once every check has passed
+func completeLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, userID int, username string) {
+	account := accountState(userID)
+	// a token or session id seen before login is no use afterwards
+	renewSession(session)
+	session.Values[csrfField] = newCSRFToken()
 	session.Values["authenticated"] = true
-	session.Values["is_admin"] = isAdmin
+	session.Values["is_admin"] = account.Group == "admin"
+	session.Values["username"] = username
+	session.Values["user_id"] = userID
 	session.Save(r, w)
 
-	log.Infof("Logged in: %s (admin=%v)", user, isAdmin)
+	logins.reset(accountKey(username))
+	writeLog(r, "auth", "login", username, "", "", "")
+	log.Infof("Logged in: %s (group=%s)", username, account.Group)
+	if page := account.setupPage(); page != "" {
+		http.Redirect(w, r, page, http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
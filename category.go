@@ -20,11 +20,15 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"html"
 	"html/template"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -41,53 +45,331 @@ type Category struct {
 	ID   int
 }
 
-func (p *Category) deleteCategory() error {
+// deleteCategory moves the category into the Archive along with its member
+// pages and subcategory links so it can be restored from Special:Undelete
+func (p *Category) deleteCategory(deletedBy int) error {
 	db, err := db.LoadDatabase()
-
 	if err != nil {
-
 		log.Error("Database Error", err)
-
+		return err
 	}
 	defer db.Close()
 
-	stmt, err := db.Prepare("DELETE FROM Categories WHERE title = ?")
+	tx, err := db.Begin()
 	if err != nil {
 		log.Error("Database Error", err)
+		return err
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	result, err := stmt.Exec(p.Title)
-	if err != nil {
+	var categoryID int
+	var body sql.NullString
+	var userID sql.NullInt64
+	var createdAt time.Time
+	err = tx.QueryRow("SELECT id, body, user_id, created_at FROM Categories WHERE title = ?", p.Title).
+		Scan(&categoryID, &body, &userID, &createdAt)
+	if err == sql.ErrNoRows {
+		log.Info("No category found with title:", p.Title)
+		return nil
+	} else if err != nil {
 		log.Error("Database Error", err)
+		return err
 	}
 
-	rowsDeleted, err := result.RowsAffected()
+	res, err := tx.Exec(
+		"INSERT INTO Archive (kind, original_id, title, body, user_id, created_at, deleted_at, deleted_by) VALUES ('category', ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)",
+		categoryID, p.Title, body, userID, createdAt, nullUserID(deletedBy),
+	)
 	if err != nil {
 		log.Error("Database Error", err)
+		return err
+	}
+	archiveID, _ := res.LastInsertId()
+
+	links := []string{
+		`INSERT INTO ArchiveLinks (archive_id, link_type, title)
+			SELECT ?, 'member', Pages.title FROM CategoryPages
+			JOIN Pages ON Pages.id = CategoryPages.page_id WHERE CategoryPages.category_id = ?`,
+		`INSERT INTO ArchiveLinks (archive_id, link_type, title)
+			SELECT ?, 'parent', Categories.title FROM SubCategoryPages
+			JOIN Categories ON Categories.id = SubCategoryPages.category_id WHERE SubCategoryPages.subcategory_id = ?`,
+		`INSERT INTO ArchiveLinks (archive_id, link_type, title)
+			SELECT ?, 'child', Categories.title FROM SubCategoryPages
+			JOIN Categories ON Categories.id = SubCategoryPages.subcategory_id WHERE SubCategoryPages.category_id = ?`,
+	}
+	for _, stmt := range links {
+		if _, err := tx.Exec(stmt, archiveID, categoryID); err != nil {
+			log.Error("Database Error", err)
+			return err
+		}
 	}
 
-	if rowsDeleted > 0 {
+	// pages and categories still carrying the tag wait for it to come back
+	for _, stmt := range []string{
+		`INSERT INTO PendingCategoryLinks (title, page_id, sort_key) SELECT ?, page_id, sort_key FROM CategoryPages WHERE category_id = ?`,
+		`INSERT INTO PendingCategoryLinks (title, subcategory_id) SELECT ?, subcategory_id FROM SubCategoryPages WHERE category_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, p.Title, categoryID); err != nil {
+			log.Error("Database Error", err)
+			return err
+		}
+	}
 
-		log.Info("Deleted", rowsDeleted, "category with title:", p.Title)
-	} else {
-		log.Info("No category found with title:", p.Title)
+	for _, stmt := range []string{
+		"DELETE FROM CategoryPages WHERE category_id = ?1",
+		"DELETE FROM SubCategoryPages WHERE subcategory_id = ?1 OR category_id = ?1",
+		"DELETE FROM PendingCategoryLinks WHERE subcategory_id = ?1",
+		"DELETE FROM Categories WHERE id = ?1",
+	} {
+		if _, err := tx.Exec(stmt, categoryID); err != nil {
+			log.Error("Database Error", err)
+			return err
+		}
 	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error("Database Error", err)
+		return err
+	}
+
+	log.Info("Moved category to archive: ", p.Title)
 	return nil
 }
-func (p *Page) saveCat() error {
 
-	log.Info("titlehere.." + p.Title + ".. " + string(p.Body))
+// saveCat updates the category body and, in the same transaction, its links
+// to every parent category tagged in it
+func (p *Page) saveCat(userID int) error {
+	db, err := db.LoadDatabase()
+	if err != nil {
+		log.Error("Database Error", err)
+		return err
+	}
+	defer db.Close()
 
-	err := dbsql("UPDATE Categories SET body = ? WHERE title = ?", string(p.Body), p.Title)
+	tx, err := db.Begin()
 	if err != nil {
 		log.Error("Database Error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var categoryID int
+	err = tx.QueryRow("SELECT id FROM Categories WHERE title = ?", p.Title).Scan(&categoryID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("category %s does not exist", p.Title)
+	} else if err != nil {
+		log.Error("Database Error", err)
+		return err
+	}
+
+	if err := checkCategoryCycle(tx, categoryID, p.Title, string(p.Body)); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE Categories SET body = ? WHERE id = ?", string(p.Body), categoryID); err != nil {
+		log.Error("Database Error", err)
+		return err
+	}
+	if err := linkSubCategories(tx, categoryID, string(p.Body), userID); err != nil {
+		log.Error("Database Error", err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error("Database Error", err)
+		return err
+	}
+	log.Info("Saved category: ", p.Title)
+	return nil
+}
+
+// CategoryCycleError is returned by saveCat when a tagged parent already sits
+// below the category, Path runs from the category down to that parent
+type CategoryCycleError struct {
+	Category string
+	Path     []string
+}
+
+func (e *CategoryCycleError) Error() string {
+	parent := e.Path[len(e.Path)-1]
+	return fmt.Sprintf("Category:%s cannot be placed in Category:%s, it would become its own ancestor (%s)",
+		removeUnderscores(e.Category), removeUnderscores(parent), removeUnderscores(strings.Join(append(e.Path, e.Category), " › ")))
+}
+
+// checkCategoryCycle walks down from the category and fails if any category
+// tagged as a parent in body is already one of its descendants
+func checkCategoryCycle(tx *sql.Tx, categoryID int, title string, body string) error {
+	parents := make(map[int]bool)
+	for _, name := range findAllCategoryLinks(body) {
+		var parentID int
+		if err := tx.QueryRow("SELECT id FROM Categories WHERE title = ?", name).Scan(&parentID); err == nil {
+			parents[parentID] = true
+		}
+	}
+	if parents[categoryID] {
+		return &CategoryCycleError{Category: title, Path: []string{title}}
+	}
+
+	titles := map[int]string{categoryID: title}
+	prev := map[int]int{categoryID: 0}
+	queue := []int{categoryID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		rows, err := tx.Query(`SELECT Categories.id, Categories.title FROM SubCategoryPages
+			JOIN Categories ON Categories.id = SubCategoryPages.subcategory_id
+			WHERE SubCategoryPages.category_id = ?`, id)
+		if err != nil {
+			return err
+		}
+		var children []int
+		for rows.Next() {
+			var childID int
+			var childTitle string
+			if err := rows.Scan(&childID, &childTitle); err != nil {
+				rows.Close()
+				return err
+			}
+			titles[childID] = childTitle
+			children = append(children, childID)
+		}
+		rows.Close()
+
+		for _, child := range children {
+			if _, seen := prev[child]; seen {
+				continue
+			}
+			prev[child] = id
+			if parents[child] {
+				var path []string
+				for n := child; n != categoryID; n = prev[n] {
+					path = append([]string{titles[n]}, path...)
+				}
+				return &CategoryCycleError{Category: title, Path: append([]string{title}, path...)}
+			}
+			queue = append(queue, child)
+		}
+	}
+	return nil
+}
+
+// linkPageCategories replaces a page's CategoryPages rows with one per [Category:X] tag in its body,
+// userID is the author of any category created along the way
+func linkPageCategories(tx *sql.Tx, pageID int, body string, userID int) error {
+	for _, stmt := range []string{
+		"DELETE FROM CategoryPages WHERE page_id = ?",
+		"DELETE FROM PendingCategoryLinks WHERE page_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, pageID); err != nil {
+			return err
+		}
+	}
+	sortKeys := findCategorySortKeys(body)
+	for _, name := range uniqueStrings(findAllCategoryLinks(body)) {
+		categoryID, err := resolveCategoryTag(tx, name, userID)
+		if err != nil {
+			return err
+		}
+		if categoryID == 0 {
+			if _, err := tx.Exec("INSERT INTO PendingCategoryLinks (title, page_id, sort_key) VALUES (?, ?, ?)", name, pageID, sortKeys[name]); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO CategoryPages (page_id, category_id, sort_key) VALUES (?, ?, ?)", pageID, categoryID, sortKeys[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkSubCategories makes a category a subcategory of every category tagged in its body
+func linkSubCategories(tx *sql.Tx, categoryID int, body string, userID int) error {
+	for _, stmt := range []string{
+		"DELETE FROM SubCategoryPages WHERE subcategory_id = ?",
+		"DELETE FROM PendingCategoryLinks WHERE subcategory_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, categoryID); err != nil {
+			return err
+		}
+	}
+	for _, name := range uniqueStrings(findAllCategoryLinks(body)) {
+		parentID, err := resolveCategoryTag(tx, name, userID)
+		if err != nil {
+			return err
+		}
+		if parentID == 0 {
+			if _, err := tx.Exec("INSERT INTO PendingCategoryLinks (title, subcategory_id) VALUES (?, ?)", name, categoryID); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO SubCategoryPages (subcategory_id, category_id) VALUES (?, ?)", categoryID, parentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveCategoryTag returns the id of a tagged category, creating it when
+// autoCreateCategories is on, or 0 when it doesn't exist
+func resolveCategoryTag(tx *sql.Tx, name string, userID int) (int, error) {
+	var categoryID int
+	err := tx.QueryRow("SELECT id FROM Categories WHERE title = ?", name).Scan(&categoryID)
+	if err == nil {
+		return categoryID, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+	if !config.AutoCreateCategories || name == "" {
+		log.Infof("Wanted category: %s", name)
+		return 0, nil
+	}
 
+	res, err := tx.Exec("INSERT INTO Categories (title, body, user_id) VALUES (?, ?, ?)", name, "", nullUserID(userID))
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	if err := attachPendingLinks(tx, int(id), name); err != nil {
+		return 0, err
 	}
+	log.Info("Created category from tag: ", name)
+	return int(id), nil
+}
 
+// attachPendingLinks links the pages and categories that were tagged with a
+// category before it existed
+func attachPendingLinks(tx *sql.Tx, categoryID int, title string) error {
+	for _, stmt := range []string{
+		`INSERT INTO CategoryPages (page_id, category_id, sort_key)
+			SELECT page_id, ?1, MAX(sort_key) FROM PendingCategoryLinks WHERE title = ?2 AND page_id IS NOT NULL
+			AND page_id NOT IN (SELECT page_id FROM CategoryPages WHERE category_id = ?1) GROUP BY page_id`,
+		`INSERT INTO SubCategoryPages (subcategory_id, category_id)
+			SELECT DISTINCT subcategory_id, ?1 FROM PendingCategoryLinks WHERE title = ?2 AND subcategory_id IS NOT NULL
+			AND subcategory_id NOT IN (SELECT subcategory_id FROM SubCategoryPages WHERE category_id = ?1)`,
+		`DELETE FROM PendingCategoryLinks WHERE title = ?2`,
+	} {
+		if _, err := tx.Exec(stmt, categoryID, title); err != nil {
+			return err
+		}
+	}
 	return nil
+}
 
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
 }
+
 func getCategoryIDByName(categoryName string) (int, error) {
 	//new
 	db, err := db.LoadDatabase()
@@ -119,39 +401,47 @@ func getCategoryIDByName(categoryName string) (int, error) {
 }
 
 func addCat(w http.ResponseWriter, r *http.Request) {
-	//new
-	categoryName := r.URL.Path[len("/category/"):]
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	categoryName := canonicalizeTitle(r.URL.Path[len("/category/"):])
 	db, err := db.LoadDatabase()
 	if err != nil {
 		log.Error("Database Error", err)
-
+		return
 	}
 	defer db.Close()
 
-	stmt, err := db.Prepare("INSERT INTO Categories (title, body, user_id) VALUES (?, ?, ?)")
+	tx, err := db.Begin()
 	if err != nil {
 		log.Error("Database Error", err)
-
+		return
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	res, err := stmt.Exec(canonicalizeTitle(categoryName), "", 1)
+	res, err := tx.Exec("INSERT INTO Categories (title, body, user_id) VALUES (?, ?, ?)", categoryName, "", nullUserID(currentUserID(r)))
 	if err != nil {
 		log.Error("Database Error", err)
-
+		http.Redirect(w, r, "/title/Category:"+categoryName, http.StatusFound)
+		return
 	}
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		// Handle error
-	} else if rowsAffected != 1 {
-		log.Error("Unexpected number of rows affected:", rowsAffected)
-	} else {
-		log.Info("Category inserted successfully!")
-		http.Redirect(w, r, "/title/Special:Categories", http.StatusFound)
+	categoryID, _ := res.LastInsertId()
+	if err := attachPendingLinks(tx, int(categoryID), categoryName); err != nil {
+		log.Error("Database Error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Database Error", err)
+		return
 	}
-	log.Debug("Category Name", categoryName)
 
+	log.Info("Category inserted successfully!")
+	writeLog(r, "category", "create", currentUsername(r), "Category:"+categoryName, "", "")
+	http.Redirect(w, r, "/title/Special:Categories", http.StatusFound)
+	log.Debug("Category Name", categoryName)
 }
+
 func checkCategoryExistence(categoryName string) bool {
 
 	db, err := db.LoadDatabase()
@@ -180,7 +470,12 @@ func checkCategoryExistence(categoryName string) bool {
 }
 
 // displays categories and sub-categories on the Category:somename page
-func loadPageCategory(categoryName string, userAgent string) (*Page, error) {
+// loadPageCategory renders a category, ?depth=N also lists the pages of its
+// subcategories that many levels down and ?page=N pages through large ones
+func loadPageCategory(r *http.Request, categoryName string, userAgent string) (*Page, error) {
+	depth := categoryDepth(r)
+	pageNumber, _ := strconv.Atoi(r.URL.Query().Get("page"))
+
 	// Determine layout size
 	size := ""
 	if userAgent == Desktop {
@@ -196,17 +491,35 @@ func loadPageCategory(categoryName string, userAgent string) (*Page, error) {
 	}
 
 	// Find matching pages and subcategories
-	matchingPages := findPagesInCategory(categoryName)
+	access := readAccessFor(r)
+	matchingPages := access.filter(findPagesInCategory(categoryName))
 	matchingSubCatPages := loadLinksFromSubCategoryFile(categoryName)
 	log.Infof("Subcategories for '%s': %+v", categoryName, matchingSubCatPages)
 
-	// Format lists
+	// Format lists, subcategories are shown as an expandable tree when the graph loads
 	categories := formatPageList(matchingPages)
-	subcategories := formatSubCatList(matchingSubCatPages)
+	subcategories := ""
+	parents := ""
+	if graph, err := loadCategoryGraph(access); err == nil {
+		subcategories = graph.renderSubtree(categoryName)
+		parents = graph.renderParents(categoryName)
+		if subcategories != "" {
+			parents += renderDepthLinks(categoryName, depth)
+		}
+		if members, err := graph.members(categoryName, depth); err == nil {
+			categories = paginateMembers(access.filterMembers(members), categoryName, depth, pageNumber)
+		} else if graph.ids[categoryName] != 0 {
+			log.Error("Error listing category members:", err)
+		}
+	} else {
+		log.Error("Error loading category tree:", err)
+		subcategories = formatSubCatList(matchingSubCatPages)
+	}
 
 	// Assemble body content
 	var bodyHTML strings.Builder
 	if checkCategoryExistence(categoryName) {
+		bodyHTML.WriteString(parents)
 		if subcategories != "" {
 			bodyHTML.WriteString(`<h2 class="wikih2">Subcategories</h2>`)
 			bodyHTML.WriteString(subcategories)
@@ -220,7 +533,7 @@ func loadPageCategory(categoryName string, userAgent string) (*Page, error) {
 	} else {
 		// Offer to create category if it doesn't exist
 		bodyHTML.WriteString(fmt.Sprintf(
-			`<a style="color:red" href="/category/%s">Add This Category</a>`, categoryName))
+			`<form action="/category/%s" method="POST">%s<button class="btn btn-link p-0" style="color:red" type="submit">Add This Category</button></form>`, url.PathEscape(categoryName), csrfInput(r)))
 	}
 
 	// Build final page
@@ -232,10 +545,11 @@ func loadPageCategory(categoryName string, userAgent string) (*Page, error) {
 		Body:       template.HTML(bodyHTML.String()),
 		Size:       template.HTML(size),
 		Menu:       safeMenu,
+		Protection: protectionSummary("Category:" + categoryName),
 	}, nil
 }
 
-// looks for a file using the same name as the current category loaded prefixed with sub-category name it then generates the the Subcategory pages for this
+// returns the titles of the categories whose body tags them as a child of categoryName
 func loadLinksFromSubCategoryFile(categoryName string) []string {
 	db, err := db.LoadDatabase()
 	if err != nil {
@@ -252,7 +566,7 @@ func loadLinksFromSubCategoryFile(categoryName string) []string {
 	//fmt.Println(categoryID)
 
 	// Retrieve page paths from CategoryPages
-	rows, err := db.Query("SELECT Categories.title FROM SubCategoryPages JOIN Categories ON Categories.id = SubCategoryPages.category_id WHERE SubCategoryPages.subcategory_id = ?", categoryID)
+	rows, err := db.Query("SELECT Categories.title FROM SubCategoryPages JOIN Categories ON Categories.id = SubCategoryPages.subcategory_id WHERE SubCategoryPages.category_id = ?", categoryID)
 
 	if err != nil {
 		return nil
@@ -316,10 +630,6 @@ func formatPageList(pages []string) string {
 		linkTitleWithoutExt := strings.TrimSuffix(linkTitle, ".txt")
 		firstLetter, _ := utf8.DecodeRuneInString(linkTitleWithoutExt)
 		firstLetter = unicode.ToUpper(firstLetter)
-		// Help title changed to Help:somepage
-		if strings.HasPrefix(linkTitleWithoutExt, "Help-") {
-			linkTitleWithoutExt = "Help:" + linkTitleWithoutExt[5:]
-		}
 		//fmt.Println(linkTitle)
 		linksByLetter[firstLetter] = append(linksByLetter[firstLetter], fmt.Sprintf("<li><a href=\"%s%s\">%s</a></li>", baseURL, linkTitleWithoutExt, linkTitleWithoutExt))
 
@@ -354,9 +664,6 @@ func formatSubCatList(pages []string) string {
 		linkTitleWithoutExt := strings.TrimSuffix(linkTitle, ".txt")
 		firstLetter, _ := utf8.DecodeRuneInString(linkTitleWithoutExt)
 		firstLetter = unicode.ToUpper(firstLetter)
-		if strings.HasPrefix(linkTitleWithoutExt, "help-") {
-			linkTitleWithoutExt = "Help:" + linkTitleWithoutExt[5:]
-		}
 		linksByLetter[firstLetter] = append(linksByLetter[firstLetter], fmt.Sprintf("<li><a href=\"%sCategory:%s\">%s</a></li>", baseURL, linkTitleWithoutExt, linkTitleWithoutExt))
 	}
 	keys := make([]string, 0, len(linksByLetter))
@@ -409,3 +716,61 @@ func loadCategoryNoHtml(title string, userAgent string) (*EditPage, error) {
 
 	return &EditPage{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: removeUnderscores(title), Title: title, Body: template.HTML(body), Menu: template.HTML(safeMenu), Size: template.HTML(size)}, nil
 }
+
+// Special:WantedCategories lists categories that are tagged but don't exist yet
+func loadWantedCategories(r *http.Request, userAgent string) (*Page, error) {
+	access := readAccessFor(r)
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	rows, err := dbConn.Query(`SELECT PendingCategoryLinks.title, COALESCE(Pages.title, ''), COALESCE(Categories.title, '')
+		FROM PendingCategoryLinks
+		LEFT JOIN Pages ON Pages.id = PendingCategoryLinks.page_id
+		LEFT JOIN Categories ON Categories.id = PendingCategoryLinks.subcategory_id
+		ORDER BY PendingCategoryLinks.title`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wanted []string
+	taggedBy := make(map[string][]string)
+	for rows.Next() {
+		var title, page, category string
+		if err := rows.Scan(&title, &page, &category); err != nil {
+			return nil, err
+		}
+		if _, ok := taggedBy[title]; !ok {
+			wanted = append(wanted, title)
+		}
+		if page != "" && !access.canRead(page) {
+			continue
+		} else if page != "" {
+			taggedBy[title] = append(taggedBy[title], fmt.Sprintf(`<a href="/title/%s">%s</a>`, url.PathEscape(page), html.EscapeString(removeUnderscores(page))))
+		} else if category != "" {
+			taggedBy[title] = append(taggedBy[title], fmt.Sprintf(`<a href="/title/Category:%s">Category:%s</a>`, url.PathEscape(category), html.EscapeString(removeUnderscores(category))))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(`<h2 class="wikih2">Wanted Categories</h2>`)
+	if len(wanted) == 0 {
+		bodyHTML.WriteString(`<p>Every tagged category exists.</p>`)
+		return newSpecialPage("Special:WantedCategories", bodyHTML.String(), userAgent), nil
+	}
+	bodyHTML.WriteString(`<p>These categories are used in category tags but haven't been created. Pages are added to them as soon as they are.</p><ul>`)
+	for _, title := range wanted {
+		bodyHTML.WriteString(fmt.Sprintf(`<li><a style="color:red" href="/title/Category:%s">%s</a> (%d %s): %s</li>`,
+			url.PathEscape(title), html.EscapeString(removeUnderscores(title)),
+			len(taggedBy[title]), pluralize(len(taggedBy[title]), "link", "links"), strings.Join(taggedBy[title], ", ")))
+	}
+	bodyHTML.WriteString(`</ul>`)
+
+	return newSpecialPage("Special:WantedCategories", bodyHTML.String(), userAgent), nil
+}
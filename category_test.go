@@ -0,0 +1,252 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// parentsOf lists the categories a category is linked into, by title
+func parentsOf(t *testing.T, categoryID int) []string {
+	t.Helper()
+	rows, err := authDB.Query(`SELECT Categories.title FROM SubCategoryPages
+		JOIN Categories ON Categories.id = SubCategoryPages.category_id
+		WHERE SubCategoryPages.subcategory_id = ? ORDER BY Categories.title`, categoryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var titles []string
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			t.Fatal(err)
+		}
+		titles = append(titles, title)
+	}
+	return titles
+}
+
+// categoriesOf lists the categories a page is in, by title
+func categoriesOf(t *testing.T, pageTitle string) []string {
+	t.Helper()
+	rows, err := authDB.Query(`SELECT Categories.title FROM CategoryPages
+		JOIN Categories ON Categories.id = CategoryPages.category_id
+		JOIN Pages ON Pages.id = CategoryPages.page_id
+		WHERE Pages.title = ? ORDER BY Categories.title`, pageTitle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var titles []string
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			t.Fatal(err)
+		}
+		titles = append(titles, title)
+	}
+	return titles
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSaveCatLinksEveryTag(t *testing.T) {
+	addCategory(t, "Alpha031", "")
+	addCategory(t, "Beta031", "")
+	addCategory(t, "Gamma031", "")
+	child := addCategory(t, "Child031", "[Category:Alpha031] text [Category:Beta031]")
+
+	if got := parentsOf(t, child); !equalStrings(got, []string{"Alpha031", "Beta031"}) {
+		t.Errorf("parents %v, want both tags", got)
+	}
+
+	// saving again replaces the links rather than adding to them
+	if err := (&Page{Title: "Child031", Body: template.HTML("[Category:Gamma031]")}).saveCat(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := parentsOf(t, child); !equalStrings(got, []string{"Gamma031"}) {
+		t.Errorf("parents after retagging %v, want [Gamma031]", got)
+	}
+
+	savePage(t, "Tagged031", "[Category:Alpha031] [Category:Gamma031] [Category:Alpha031]", 0)
+	if got := categoriesOf(t, "Tagged031"); !equalStrings(got, []string{"Alpha031", "Gamma031"}) {
+		t.Errorf("page categories %v, want each tag once", got)
+	}
+}
+
+func TestReindexRepairsLinks(t *testing.T) {
+	addCategory(t, "Parent031", "")
+	child := addCategory(t, "Sub031", "[Category:Parent031]")
+	savePage(t, "Member031", "[Category:Sub031]", 0)
+
+	authDB.Exec("DELETE FROM SubCategoryPages WHERE subcategory_id = ?", child)
+	authDB.Exec("DELETE FROM CategoryPages WHERE category_id = ?", child)
+
+	if err := reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if got := parentsOf(t, child); !equalStrings(got, []string{"Parent031"}) {
+		t.Errorf("parents after reindex %v", got)
+	}
+	if got := categoriesOf(t, "Member031"); !equalStrings(got, []string{"Sub031"}) {
+		t.Errorf("page categories after reindex %v", got)
+	}
+}
+
+func TestCategoryCycleRejected(t *testing.T) {
+	top := addCategory(t, "Top032", "")
+	addCategory(t, "Middle032", "[Category:Top032]")
+	addCategory(t, "Bottom032", "[Category:Middle032]")
+
+	err := (&Page{Title: "Top032", Body: template.HTML("[Category:Bottom032]")}).saveCat(0)
+	var cycleErr *CategoryCycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("closing the loop: got %v, want a CategoryCycleError", err)
+	}
+	if want := []string{"Top032", "Middle032", "Bottom032"}; !equalStrings(cycleErr.Path, want) {
+		t.Errorf("cycle path %v, want %v", cycleErr.Path, want)
+	}
+	if got := parentsOf(t, top); len(got) != 0 {
+		t.Errorf("the refused save still linked Top032 into %v", got)
+	}
+
+	if err := (&Page{Title: "Top032", Body: template.HTML("[Category:Top032]")}).saveCat(0); !errors.As(err, &cycleErr) {
+		t.Errorf("tagging a category with itself: got %v", err)
+	}
+
+	testUser(t, "Editor032", "editor-pass-032", "editor", "")
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Editor032", "editor-pass-032")
+	status, body := submit(t, client, ts.URL+"/edit/Category:Top032", ts.URL+"/savecat/Top032", url.Values{"body": {"[Category:Bottom032]"}})
+	if status != http.StatusConflict || !strings.Contains(body, "its own ancestor") {
+		t.Errorf("saving a loop from the form: status %d", status)
+	}
+}
+
+func TestCategoryMultipleParents(t *testing.T) {
+	addCategory(t, "Root032", "")
+	addCategory(t, "Left032", "[Category:Root032]")
+	addCategory(t, "Right032", "[Category:Root032]")
+	// two paths down to the same category is a diamond, not a loop
+	shared := addCategory(t, "Shared032", "[Category:Left032] [Category:Right032]")
+	if got := parentsOf(t, shared); !equalStrings(got, []string{"Left032", "Right032"}) {
+		t.Errorf("parents %v, want both", got)
+	}
+
+	g, err := loadCategoryGraph(readAccessFor(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cycle := range g.cycles() {
+		for _, id := range cycle {
+			if strings.HasSuffix(g.titles[id], "032") {
+				t.Errorf("a diamond is reported as a loop: %v", cycle)
+			}
+		}
+	}
+}
+
+func TestCategoryCyclesReport(t *testing.T) {
+	first := addCategory(t, "Ping032", "")
+	second := addCategory(t, "Pong032", "[Category:Ping032]")
+	// a loop saved before they were refused
+	if _, err := authDB.Exec("INSERT INTO SubCategoryPages (subcategory_id, category_id) VALUES (?, ?)", first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, client := newTestServer(t)
+	_, body := get(t, client, ts.URL+"/title/Special:CategoryCycles")
+	if !inOrder(body, ">Ping032</a>", ">Pong032</a>", ">Ping032</a>") {
+		t.Error("Special:CategoryCycles doesn't report Ping032 › Pong032 › Ping032")
+	}
+	if _, body := get(t, client, ts.URL+"/title/Special:CategoryTree"); !strings.Contains(body, "(loops back)") {
+		t.Error("the tree doesn't stop at the loop")
+	}
+}
+
+func TestWantedCategoriesAttachLater(t *testing.T) {
+	savePage(t, "Early034", "[Category:Later034|Sort034]", 0)
+	if got := categoriesOf(t, "Early034"); len(got) != 0 {
+		t.Fatalf("linked to %v before the category exists", got)
+	}
+	var pending int
+	authDB.QueryRow("SELECT COUNT(*) FROM PendingCategoryLinks WHERE title = 'Later034'").Scan(&pending)
+	if pending != 1 {
+		t.Fatalf("%d pending links, want 1", pending)
+	}
+
+	testUser(t, "Editor034", "editor-pass-034", "editor", "")
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Editor034", "editor-pass-034")
+	_, body := get(t, client, ts.URL+"/title/Special:WantedCategories")
+	if !inOrder(body, ">Later034</a> (1 link)", ">Early034</a>") {
+		t.Error("Special:WantedCategories doesn't list Later034")
+	}
+
+	submit(t, client, ts.URL+"/title/Category:Later034", ts.URL+"/category/Later034", url.Values{})
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM CategoryPages WHERE category_id IN (SELECT id FROM Categories WHERE title = 'Later034')")
+		authDB.Exec("DELETE FROM Categories WHERE title = 'Later034'")
+	})
+	if got := categoriesOf(t, "Early034"); !equalStrings(got, []string{"Later034"}) {
+		t.Errorf("after creating the category the page is in %v", got)
+	}
+	var sortKey string
+	authDB.QueryRow("SELECT sort_key FROM CategoryPages JOIN Pages ON Pages.id = CategoryPages.page_id WHERE Pages.title = 'Early034'").Scan(&sortKey)
+	if sortKey != "Sort034" {
+		t.Errorf("sort key %q carried over, want Sort034", sortKey)
+	}
+	authDB.QueryRow("SELECT COUNT(*) FROM PendingCategoryLinks WHERE title = 'Later034'").Scan(&pending)
+	if pending != 0 {
+		t.Error("the pending link is still there")
+	}
+}
+
+func TestAutoCreateCategories(t *testing.T) {
+	config.AutoCreateCategories = true
+	t.Cleanup(func() {
+		config.AutoCreateCategories = false
+		authDB.Exec("DELETE FROM CategoryPages WHERE category_id IN (SELECT id FROM Categories WHERE title = 'Auto034')")
+		authDB.Exec("DELETE FROM Categories WHERE title = 'Auto034'")
+	})
+
+	savePage(t, "Tagged034", "[Category:Auto034]", 0)
+	if !checkCategoryExistence("Auto034") {
+		t.Fatal("the tagged category wasn't created")
+	}
+	if got := categoriesOf(t, "Tagged034"); !equalStrings(got, []string{"Auto034"}) {
+		t.Errorf("page categories %v, want [Auto034]", got)
+	}
+}
@@ -0,0 +1,626 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxCategoryDepth caps ?depth= so a roll-up can't walk an unbounded tree
+const maxCategoryDepth = 10
+
+// categoryGraph holds every category and its SubCategoryPages links in memory
+// so the whole taxonomy can be walked without a query per node
+type categoryGraph struct {
+	titles    map[int]string
+	ids       map[string]int
+	children  map[int][]int
+	parents   map[int][]int
+	pageCount map[int]int
+}
+
+// loadCategoryGraph leaves out the categories access can't read, and counts
+// only the pages it can
+func loadCategoryGraph(access *ReadAccess) (*categoryGraph, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	g := &categoryGraph{
+		titles:    make(map[int]string),
+		ids:       make(map[string]int),
+		children:  make(map[int][]int),
+		parents:   make(map[int][]int),
+		pageCount: make(map[int]int),
+	}
+
+	rows, err := dbConn.Query(`SELECT Categories.id, Categories.title, COUNT(CategoryPages.page_id)
+		FROM Categories LEFT JOIN CategoryPages ON CategoryPages.category_id = Categories.id
+		GROUP BY Categories.id`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, count int
+		var title string
+		if err := rows.Scan(&id, &title, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !access.canReadCategory(title) {
+			continue
+		}
+		g.titles[id] = title
+		g.ids[title] = id
+		g.pageCount[id] = count
+	}
+	rows.Close()
+
+	if access.hidesAnything() {
+		// count again, one page at a time
+		rows, err = dbConn.Query(`SELECT CategoryPages.category_id, Pages.title FROM CategoryPages
+			JOIN Pages ON Pages.id = CategoryPages.page_id`)
+		if err != nil {
+			return nil, err
+		}
+		for id := range g.pageCount {
+			g.pageCount[id] = 0
+		}
+		for rows.Next() {
+			var id int
+			var title string
+			if err := rows.Scan(&id, &title); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if _, ok := g.titles[id]; ok && access.canRead(title) {
+				g.pageCount[id]++
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err = dbConn.Query("SELECT DISTINCT subcategory_id, category_id FROM SubCategoryPages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var child, parent int
+		if err := rows.Scan(&child, &parent); err != nil {
+			return nil, err
+		}
+		if _, ok := g.titles[child]; !ok {
+			continue
+		}
+		if _, ok := g.titles[parent]; !ok {
+			continue
+		}
+		g.children[parent] = append(g.children[parent], child)
+		g.parents[child] = append(g.parents[child], parent)
+	}
+	for id := range g.children {
+		g.sortByTitle(g.children[id])
+	}
+	return g, rows.Err()
+}
+
+func (g *categoryGraph) sortByTitle(ids []int) {
+	c := newCollator()
+	sort.SliceStable(ids, func(i, j int) bool {
+		return c.CompareString(removeUnderscores(g.titles[ids[i]]), removeUnderscores(g.titles[ids[j]])) < 0
+	})
+}
+
+// newCollator orders titles by the Unicode collation algorithm, so "Émile"
+// sorts with the Es rather than after Z. A Collator isn't safe to share
+// between goroutines so each sort makes its own
+func newCollator() *collate.Collator {
+	return collate.New(language.Und, collate.IgnoreCase, collate.Numeric)
+}
+
+// roots are the categories with no parent category
+func (g *categoryGraph) roots() []int {
+	var roots []int
+	for id := range g.titles {
+		if len(g.parents[id]) == 0 {
+			roots = append(roots, id)
+		}
+	}
+	g.sortByTitle(roots)
+	return roots
+}
+
+// renderNode writes one category and, inside a collapsible <details>, its
+// subcategories. path guards against a category being its own ancestor
+func (g *categoryGraph) renderNode(b *strings.Builder, id int, path map[int]bool, visited map[int]bool, open bool) {
+	visited[id] = true
+	title := g.titles[id]
+	label := fmt.Sprintf(`<a href="/title/Category:%s">%s</a> <span class="text-muted">(%d %s)</span>`,
+		url.PathEscape(title), html.EscapeString(removeUnderscores(title)), g.pageCount[id], pluralize(g.pageCount[id], "page", "pages"))
+
+	if path[id] {
+		b.WriteString(`<li>` + label + ` <span style="color:red">(loops back)</span></li>`)
+		return
+	}
+	children := g.children[id]
+	if len(children) == 0 {
+		b.WriteString(`<li>` + label + `</li>`)
+		return
+	}
+
+	path[id] = true
+	defer delete(path, id)
+
+	openAttr := ""
+	if open {
+		openAttr = " open"
+	}
+	b.WriteString(fmt.Sprintf(`<li><details%s><summary>%s</summary><ul class="categoryTree">`, openAttr, label))
+	for _, child := range children {
+		g.renderNode(b, child, path, visited, false)
+	}
+	b.WriteString(`</ul></details></li>`)
+}
+
+// renderTree renders the whole taxonomy, starting from the root categories
+func (g *categoryGraph) renderTree() string {
+	var b strings.Builder
+	visited := make(map[int]bool)
+	b.WriteString(`<ul class="categoryTree">`)
+	for _, id := range g.roots() {
+		g.renderNode(&b, id, make(map[int]bool), visited, false)
+	}
+	// anything left is only reachable through a loop of categories
+	var rest []int
+	for id := range g.titles {
+		if !visited[id] {
+			rest = append(rest, id)
+		}
+	}
+	g.sortByTitle(rest)
+	for _, id := range rest {
+		if !visited[id] {
+			g.renderNode(&b, id, make(map[int]bool), visited, false)
+		}
+	}
+	b.WriteString(`</ul>`)
+	return b.String()
+}
+
+// renderSubtree renders the subcategories below a single category
+func (g *categoryGraph) renderSubtree(title string) string {
+	id, ok := g.ids[title]
+	if !ok || len(g.children[id]) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	visited := make(map[int]bool)
+	path := map[int]bool{id: true}
+	b.WriteString(`<ul class="categoryTree">`)
+	for _, child := range g.children[id] {
+		g.renderNode(&b, child, path, visited, false)
+	}
+	b.WriteString(`</ul>`)
+	return b.String()
+}
+
+// cycles returns every loop found in the SubCategoryPages links, each one
+// rotated to start at its alphabetically first category so it is reported once
+func (g *categoryGraph) cycles() [][]int {
+	const (
+		unvisited = iota
+		onStack
+		done
+	)
+	state := make(map[int]int)
+	seen := make(map[string]bool)
+	var stack []int
+	var found [][]int
+
+	var visit func(id int)
+	visit = func(id int) {
+		state[id] = onStack
+		stack = append(stack, id)
+		for _, child := range g.children[id] {
+			switch state[child] {
+			case unvisited:
+				visit(child)
+			case onStack:
+				start := len(stack) - 1
+				for stack[start] != child {
+					start--
+				}
+				cycle := append([]int(nil), stack[start:]...)
+				first := 0
+				for i := range cycle {
+					if strings.ToLower(g.titles[cycle[i]]) < strings.ToLower(g.titles[cycle[first]]) {
+						first = i
+					}
+				}
+				cycle = append(cycle[first:], cycle[:first]...)
+				key := fmt.Sprint(cycle)
+				if !seen[key] {
+					seen[key] = true
+					found = append(found, cycle)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = done
+	}
+
+	ids := make([]int, 0, len(g.titles))
+	for id := range g.titles {
+		ids = append(ids, id)
+	}
+	g.sortByTitle(ids)
+	for _, id := range ids {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+	return found
+}
+
+// renderParents lists every category a category has been placed in
+func (g *categoryGraph) renderParents(title string) string {
+	id, ok := g.ids[title]
+	if !ok || len(g.parents[id]) == 0 {
+		return ""
+	}
+	parents := append([]int(nil), g.parents[id]...)
+	g.sortByTitle(parents)
+	links := make([]string, 0, len(parents))
+	for _, parent := range parents {
+		links = append(links, fmt.Sprintf(`<a href="/title/Category:%s">%s</a>`,
+			url.PathEscape(g.titles[parent]), html.EscapeString(removeUnderscores(g.titles[parent]))))
+	}
+	return fmt.Sprintf(`<p class="text-muted">%s: %s</p>`, pluralize(len(links), "Parent category", "Parent categories"), strings.Join(links, " | "))
+}
+
+// CategoryMember is a page in a category or one of its subcategories, Via
+// holds the subcategories walked through to reach it, outermost first
+type CategoryMember struct {
+	Title   string   `json:"title"`
+	SortKey string   `json:"sort_key,omitempty"`
+	Via     []string `json:"via,omitempty"`
+}
+
+// sortName is what a member is sorted and grouped by
+func (m CategoryMember) sortName() string {
+	if m.SortKey != "" {
+		return m.SortKey
+	}
+	return removeUnderscores(m.Title)
+}
+
+// categoryPageSize is how many members a category page shows at once
+const categoryPageSize = 200
+
+// members lists the pages in a category and in its subcategories down to
+// depth levels. A page in several of them is listed once, under the
+// shallowest one, and each category is only visited once so loops end
+func (g *categoryGraph) members(title string, depth int) ([]CategoryMember, error) {
+	rootID, ok := g.ids[title]
+	if !ok {
+		return nil, fmt.Errorf("category %s does not exist", title)
+	}
+
+	via := map[int][]string{rootID: nil}
+	order := []int{rootID}
+	level := []int{rootID}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		var next []int
+		for _, id := range level {
+			for _, child := range g.children[id] {
+				if _, seen := via[child]; seen {
+					continue
+				}
+				via[child] = append(append([]string(nil), via[id]...), g.titles[child])
+				order = append(order, child)
+				next = append(next, child)
+			}
+		}
+		level = next
+	}
+
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(order)), ",")
+	args := make([]interface{}, len(order))
+	for i, id := range order {
+		args[i] = id
+	}
+	rows, err := dbConn.Query(`SELECT CategoryPages.category_id, Pages.title, COALESCE(CategoryPages.sort_key, '') FROM CategoryPages
+		JOIN Pages ON Pages.id = CategoryPages.page_id
+		WHERE CategoryPages.category_id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pagesByCategory := make(map[int][]CategoryMember)
+	for rows.Next() {
+		var categoryID int
+		var m CategoryMember
+		if err := rows.Scan(&categoryID, &m.Title, &m.SortKey); err != nil {
+			return nil, err
+		}
+		pagesByCategory[categoryID] = append(pagesByCategory[categoryID], m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	members := []CategoryMember{}
+	for _, id := range order {
+		for _, m := range pagesByCategory[id] {
+			if seen[m.Title] {
+				continue
+			}
+			seen[m.Title] = true
+			m.Via = via[id]
+			members = append(members, m)
+		}
+	}
+	c := newCollator()
+	sort.SliceStable(members, func(i, j int) bool {
+		return c.CompareString(members[i].sortName(), members[j].sortName()) < 0
+	})
+	return members, nil
+}
+
+// categoryDepth reads ?depth=N, clamped to 0..maxCategoryDepth
+func categoryDepth(r *http.Request) int {
+	depth, err := strconv.Atoi(r.URL.Query().Get("depth"))
+	if err != nil || depth < 0 {
+		return 0
+	}
+	if depth > maxCategoryDepth {
+		return maxCategoryDepth
+	}
+	return depth
+}
+
+// memberHeading is the letter a member is listed under, accents are dropped
+// so "Émile" is filed under E
+func memberHeading(m CategoryMember) string {
+	first, _ := utf8.DecodeRuneInString(norm.NFD.String(m.sortName()))
+	if first == utf8.RuneError {
+		return "#"
+	}
+	return string(unicode.ToUpper(first))
+}
+
+// formatMemberList is formatPageList for collated members, with a
+// breadcrumb after pages that came from a subcategory
+func formatMemberList(members []CategoryMember) string {
+	var b strings.Builder
+	heading := ""
+	for i, m := range members {
+		if h := memberHeading(m); i == 0 || h != heading {
+			if i > 0 {
+				b.WriteString("\n</ul>")
+			}
+			heading = h
+			b.WriteString(fmt.Sprintf("<h3>%s</h3><ul>\n", html.EscapeString(heading)))
+		}
+
+		link := fmt.Sprintf(`<li><a href="/title/%s">%s</a>`, url.PathEscape(m.Title), html.EscapeString(removeUnderscores(m.Title)))
+		if len(m.Via) > 0 {
+			crumbs := make([]string, len(m.Via))
+			for i, c := range m.Via {
+				crumbs[i] = fmt.Sprintf(`<a class="text-muted" href="/title/Category:%s">%s</a>`, url.PathEscape(c), html.EscapeString(removeUnderscores(c)))
+			}
+			link += ` <small class="text-muted">(via ` + strings.Join(crumbs, " › ") + `)</small>`
+		}
+		b.WriteString(link + "</li>\n")
+	}
+	if len(members) > 0 {
+		b.WriteString("</ul>")
+	}
+	return b.String()
+}
+
+// paginateMembers formats one page of categoryPageSize members, pageNumber
+// counts from 1, with previous and next links when there is more than one
+func paginateMembers(members []CategoryMember, title string, depth int, pageNumber int) string {
+	if len(members) <= categoryPageSize {
+		return formatMemberList(members)
+	}
+
+	pages := (len(members) + categoryPageSize - 1) / categoryPageSize
+	if pageNumber < 1 {
+		pageNumber = 1
+	} else if pageNumber > pages {
+		pageNumber = pages
+	}
+	start := (pageNumber - 1) * categoryPageSize
+	end := min(start+categoryPageSize, len(members))
+
+	link := func(n int, label string) string {
+		query := url.Values{}
+		if depth > 0 {
+			query.Set("depth", strconv.Itoa(depth))
+		}
+		if n > 1 {
+			query.Set("page", strconv.Itoa(n))
+		}
+		href := "/title/Category:" + url.PathEscape(title)
+		if len(query) > 0 {
+			href += "?" + query.Encode()
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(href), label)
+	}
+	prev, next := "previous page", "next page"
+	if pageNumber > 1 {
+		prev = link(pageNumber-1, prev)
+	}
+	if pageNumber < pages {
+		next = link(pageNumber+1, next)
+	}
+	nav := fmt.Sprintf(`<p>Showing %d–%d of %d pages. (%s) (%s)</p>`, start+1, end, len(members), prev, next)
+
+	return nav + formatMemberList(members[start:end]) + nav
+}
+
+// renderDepthLinks offers the roll-up views of a category that has subcategories
+func renderDepthLinks(title string, depth int) string {
+	options := []struct {
+		depth int
+		label string
+	}{{0, "This category only"}, {1, "1 level down"}, {2, "2 levels down"}, {maxCategoryDepth, "All subcategories"}}
+
+	links := make([]string, 0, len(options))
+	for _, o := range options {
+		if o.depth == depth {
+			links = append(links, "<b>"+o.label+"</b>")
+			continue
+		}
+		href := "/title/Category:" + url.PathEscape(title)
+		if o.depth > 0 {
+			href += fmt.Sprintf("?depth=%d", o.depth)
+		}
+		links = append(links, fmt.Sprintf(`<a href="%s">%s</a>`, href, o.label))
+	}
+	return `<p class="text-muted">Show pages from: ` + strings.Join(links, " | ") + `</p>`
+}
+
+// categoryAPIHandler serves /api/category/<name>?depth=N as JSON
+func categoryAPIHandler(w http.ResponseWriter, r *http.Request) {
+	name := canonicalizeTitle(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/category/"), "Category:"))
+	depth := categoryDepth(r)
+
+	access := readAccessFor(r)
+	g, err := loadCategoryGraph(access)
+	if err != nil {
+		log.Error("Error loading category tree:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := g.ids[name]; !ok {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	members, err := g.members(name, depth)
+	members = access.filterMembers(members)
+	if err != nil {
+		log.Error("Error listing category members:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		Category string           `json:"category"`
+		Depth    int              `json:"depth"`
+		Pages    []CategoryMember `json:"pages"`
+	}{name, depth, members}); err != nil {
+		log.Error("Error encoding category members:", err)
+	}
+}
+
+func pluralize(n int, singular string, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
+
+// Special:CategoryTree renders every category as a nested, collapsible tree
+func loadCategoryTree(r *http.Request, userAgent string) (*Page, error) {
+	g, err := loadCategoryGraph(readAccessFor(r))
+	if err != nil {
+		return nil, err
+	}
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(`<h2 class="wikih2">Category Tree</h2>`)
+	if len(g.titles) == 0 {
+		bodyHTML.WriteString(`<p>There are no categories yet.</p>`)
+	} else {
+		bodyHTML.WriteString(`<p>Click a category with subcategories to expand it. <a href="/title/Special:Categories">View as a list</a> · <a href="/title/Special:CategoryCycles">Find loops</a></p>`)
+		bodyHTML.WriteString(g.renderTree())
+	}
+
+	return newSpecialPage("Special:CategoryTree", bodyHTML.String(), userAgent), nil
+}
+
+// Special:CategoryCycles lists categories that are their own ancestor, these
+// were saved before cycles were refused and need fixing by hand
+func loadCategoryCycles(r *http.Request, userAgent string) (*Page, error) {
+	g, err := loadCategoryGraph(readAccessFor(r))
+	if err != nil {
+		return nil, err
+	}
+	cycles := g.cycles()
+
+	link := func(id int) string {
+		return fmt.Sprintf(`<a href="/title/Category:%s">%s</a>`, url.PathEscape(g.titles[id]), html.EscapeString(removeUnderscores(g.titles[id])))
+	}
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(`<h2 class="wikih2">Category Cycles</h2>`)
+	if len(cycles) == 0 {
+		bodyHTML.WriteString(`<p>No category is its own ancestor.</p>`)
+		return newSpecialPage("Special:CategoryCycles", bodyHTML.String(), userAgent), nil
+	}
+
+	bodyHTML.WriteString(fmt.Sprintf(`<p>%d %s found. Each line reads parent › subcategory, remove one of the category tags to break the loop.</p><ul>`,
+		len(cycles), pluralize(len(cycles), "loop", "loops")))
+	for _, cycle := range cycles {
+		parts := make([]string, 0, len(cycle)+1)
+		for _, id := range cycle {
+			parts = append(parts, link(id))
+		}
+		parts = append(parts, link(cycle[0]))
+
+		// the closing link comes from a category tag in the body of the first category
+		first := g.titles[cycle[0]]
+		bodyHTML.WriteString(fmt.Sprintf(`<li>%s <a class="btn btn-sm btn-outline-secondary" href="/edit/Category:%s">Edit %s</a></li>`,
+			strings.Join(parts, " › "), url.PathEscape(first), html.EscapeString(removeUnderscores(first))))
+	}
+	bodyHTML.WriteString(`</ul>`)
+
+	return newSpecialPage("Special:CategoryCycles", bodyHTML.String(), userAgent), nil
+}
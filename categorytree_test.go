@@ -0,0 +1,212 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// inOrder reports whether each of subs appears in s after the one before it
+func inOrder(s string, subs ...string) bool {
+	for _, sub := range subs {
+		i := strings.Index(s, sub)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(sub):]
+	}
+	return true
+}
+
+func TestCategoryTree(t *testing.T) {
+	addCategory(t, "Team030", "")
+	addCategory(t, "Service030", "[Category:Team030]")
+	addCategory(t, "Component030", "[Category:Service030]")
+	savePage(t, "Widget030", "[Category:Component030]", 0)
+	savePage(t, "Gadget030", "[Category:Component030]", 0)
+
+	g, err := loadCategoryGraph(readAccessFor(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := map[string]bool{}
+	for _, id := range g.roots() {
+		roots[g.titles[id]] = true
+	}
+	if !roots["Team030"] || roots["Service030"] || roots["Component030"] {
+		t.Errorf("roots %v, want Team030 and not its subcategories", roots)
+	}
+
+	tree := g.renderTree()
+	if !inOrder(tree, "<details><summary>", ">Team030</a>", "<details><summary>", ">Service030</a>", ">Component030</a> <span class=\"text-muted\">(2 pages)</span>") {
+		t.Errorf("Team030 > Service030 > Component030 (2 pages) isn't nested in\n%s", tree)
+	}
+
+	subtree := g.renderSubtree("Team030")
+	if strings.Contains(subtree, ">Team030</a>") || !inOrder(subtree, ">Service030</a>", ">Component030</a>") {
+		t.Errorf("subtree of Team030:\n%s", subtree)
+	}
+	if g.renderSubtree("Component030") != "" {
+		t.Error("a category without subcategories has a subtree")
+	}
+
+	ts, client := newTestServer(t)
+	if _, body := get(t, client, ts.URL+"/title/Special:CategoryTree"); !strings.Contains(body, ">Component030</a>") {
+		t.Error("Special:CategoryTree is missing Component030")
+	}
+	if _, body := get(t, client, ts.URL+"/title/Category:Team030"); !strings.Contains(body, ">Component030</a>") {
+		t.Error("Category:Team030 doesn't show its tree")
+	}
+}
+
+func TestRecursiveMembers(t *testing.T) {
+	addCategory(t, "Team033", "")
+	addCategory(t, "Service033", "[Category:Team033]")
+	addCategory(t, "Component033", "[Category:Service033]")
+	savePage(t, "TeamDoc033", "[Category:Team033]", 0)
+	savePage(t, "ServiceDoc033", "[Category:Service033]", 0)
+	savePage(t, "ComponentDoc033", "[Category:Component033] [Category:Service033]", 0)
+	savePage(t, "DeepDoc033", "[Category:Component033]", 0)
+
+	g, err := loadCategoryGraph(readAccessFor(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	via := func(depth int) map[string]string {
+		members, err := g.members("Team033", depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]string)
+		for _, m := range members {
+			if _, dup := found[m.Title]; dup {
+				t.Errorf("depth %d lists %s twice", depth, m.Title)
+			}
+			found[m.Title] = strings.Join(m.Via, " › ")
+		}
+		return found
+	}
+
+	if got := via(0); len(got) != 1 || got["TeamDoc033"] != "" {
+		t.Errorf("depth 0: %v, want only the direct member", got)
+	}
+	got := via(1)
+	if len(got) != 3 || got["ServiceDoc033"] != "Service033" || got["ComponentDoc033"] != "Service033" {
+		t.Errorf("depth 1: %v", got)
+	}
+	got = via(2)
+	// a page in two subcategories is listed under the shallower one
+	if len(got) != 4 || got["ComponentDoc033"] != "Service033" || got["DeepDoc033"] != "Service033 › Component033" {
+		t.Errorf("depth 2: %v", got)
+	}
+
+	for query, want := range map[string]int{"": 0, "?depth=2": 2, "?depth=99": maxCategoryDepth, "?depth=-1": 0, "?depth=x": 0} {
+		if got := categoryDepth(httptest.NewRequest("GET", "/title/Category:Team033"+query, nil)); got != want {
+			t.Errorf("categoryDepth(%q) = %d, want %d", query, got, want)
+		}
+	}
+
+	ts, client := newTestServer(t)
+	status, body := get(t, client, ts.URL+"/api/category/Team033?depth=2")
+	if status != http.StatusOK {
+		t.Fatalf("API: status %d", status)
+	}
+	var result struct {
+		Depth int              `json:"depth"`
+		Pages []CategoryMember `json:"pages"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Depth != 2 || len(result.Pages) != 4 {
+		t.Errorf("API: depth %d with %d pages, want 2 and 4", result.Depth, len(result.Pages))
+	}
+	if status, _ := get(t, client, ts.URL+"/api/category/Missing033"); status != http.StatusNotFound {
+		t.Errorf("API for a missing category: status %d", status)
+	}
+
+	_, body = get(t, client, ts.URL+"/title/Category:Team033?depth=2")
+	if !inOrder(body, ">DeepDoc033</a>", "(via", ">Service033</a>", ">Component033</a>") {
+		t.Error("the category page doesn't show the breadcrumb at depth 2")
+	}
+}
+
+func TestCategorySortKeysAndCollation(t *testing.T) {
+	addCategory(t, "Sorted035", "")
+	savePage(t, "Zebra035", "[Category:Sorted035|Aardvark]", 0)
+	savePage(t, "Émile035", "[Category:Sorted035]", 0)
+	savePage(t, "Fox035", "[Category:Sorted035]", 0)
+	savePage(t, "Apple035", "[Category:Sorted035]", 0)
+
+	g, err := loadCategoryGraph(readAccessFor(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members, err := g.members("Sorted035", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, m := range members {
+		titles = append(titles, m.Title)
+	}
+	// the sort key files Zebra first and Émile sorts with the Es, not after Z
+	if want := []string{"Zebra035", "Apple035", "Émile035", "Fox035"}; strings.Join(titles, ",") != strings.Join(want, ",") {
+		t.Errorf("members sorted %v, want %v", titles, want)
+	}
+
+	list := formatMemberList(members)
+	if !inOrder(list, "<h3>A</h3>", ">Zebra035</a>", ">Apple035</a>", "<h3>E</h3>", ">Émile035</a>", "<h3>F</h3>", ">Fox035</a>") {
+		t.Errorf("headings in\n%s", list)
+	}
+}
+
+func TestCategoryPagination(t *testing.T) {
+	members := make([]CategoryMember, 450)
+	for i := range members {
+		members[i] = CategoryMember{Title: fmt.Sprintf("Page%03d", i)}
+	}
+
+	if got := paginateMembers(members[:categoryPageSize], "Big035", 0, 1); strings.Contains(got, "Showing") {
+		t.Error("a category that fits on one page is paginated")
+	}
+
+	first := paginateMembers(members, "Big035", 0, 1)
+	if !strings.Contains(first, "Showing 1–200 of 450 pages. (previous page) (<a href=\"/title/Category:Big035?page=2\">next page</a>)") {
+		t.Errorf("first page nav wrong in\n%.300s", first)
+	}
+	if !strings.Contains(first, ">Page199</a>") || strings.Contains(first, ">Page200</a>") {
+		t.Error("the first page doesn't hold exactly the first 200 members")
+	}
+
+	last := paginateMembers(members, "Big035", 2, 3)
+	if !strings.Contains(last, "Showing 401–450 of 450 pages. (<a href=\"/title/Category:Big035?depth=2&amp;page=2\">previous page</a>) (next page)") {
+		t.Errorf("last page nav wrong in\n%.300s", last)
+	}
+	if paginateMembers(members, "Big035", 2, 99) != last {
+		t.Error("a page past the end isn't clamped to the last one")
+	}
+	if paginateMembers(members, "Big035", 0, -4) != first {
+		t.Error("a page before the start isn't clamped to the first one")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// csrfField is the name of the hidden input every POST form carries
+const csrfField = "csrf_token"
+
+func newCSRFToken() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("csrf: cannot generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// csrfToken is the token of the visitor's session, csrfProtect makes sure
+// there is one before any handler runs
+func csrfToken(r *http.Request) string {
+	session, _ := store.Get(r, "cookie-name")
+	token, _ := session.Values[csrfField].(string)
+	return token
+}
+
+// csrfInput is the hidden input to put in a form
+func csrfInput(r *http.Request) string {
+	return fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, csrfField, html.EscapeString(csrfToken(r)))
+}
+
+// csrfProtect gives every session a token and refuses any POST that doesn't
+// send it back. Multipart forms pass it in the query string instead, so the
+// body is left for the upload handler to read under its own size limit
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := store.Get(r, "cookie-name")
+		expected, _ := session.Values[csrfField].(string)
+		if expected == "" {
+			expected = newCSRFToken()
+			session.Values[csrfField] = expected
+			session.Save(r, w)
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			sent := r.Header.Get("X-CSRF-Token")
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+				if sent == "" {
+					sent = r.URL.Query().Get(csrfField)
+				}
+			} else if sent == "" {
+				sent = r.PostFormValue(csrfField)
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+				log.Warnf("CSRF check failed for %s %s from %s", r.Method, r.URL.Path, clientIP(r))
+				w.WriteHeader(http.StatusForbidden)
+				renderTemplate(w, "title", newSpecialPage("Form expired", alert("alert-danger", "This form has expired or didn't come from this site. Go back, reload the page and try again."), getUserAgent(r)))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
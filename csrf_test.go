@@ -0,0 +1,105 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFRejectsForgedPosts(t *testing.T) {
+	edID := testUser(t, "Ed048", "ed-pass-048", "editor", "")
+	savePage(t, "Target048", "original", edID)
+	t.Cleanup(func() { authDB.Exec("DELETE FROM Categories WHERE title = 'Forged048'") })
+
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Ed048", "ed-pass-048")
+	_, other := newTestServer(t)
+	_, page := get(t, other, ts.URL+"/login")
+	foreign := csrfRegex.FindStringSubmatch(page)[1]
+
+	for name, token := range map[string]string{"no token": "", "another session's token": foreign} {
+		form := url.Values{"body": {"forged"}}
+		if token != "" {
+			form.Set(csrfField, token)
+		}
+		resp, err := client.PostForm(ts.URL+"/save/Target048", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("save with %s: status %d, want 403", name, resp.StatusCode)
+		}
+		resp, err = client.PostForm(ts.URL+"/category/Forged048", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("adding a category with %s: status %d, want 403", name, resp.StatusCode)
+		}
+	}
+	var body string
+	authDB.QueryRow("SELECT body FROM Pages WHERE title = 'Target048'").Scan(&body)
+	if body != "original" {
+		t.Errorf("a forged save changed the page to %q", body)
+	}
+	var categories int
+	authDB.QueryRow("SELECT COUNT(*) FROM Categories WHERE title = 'Forged048'").Scan(&categories)
+	if categories != 0 {
+		t.Error("a forged post added a category")
+	}
+
+	if status, _ := get(t, client, ts.URL+"/category/Forged048"); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /category/: status %d, want 405", status)
+	}
+}
+
+func TestCSRFTokenSources(t *testing.T) {
+	testUser(t, "Ed048b", "ed-pass-048b", "editor", "")
+	ts, client := newTestServer(t)
+	_, page := get(t, client, ts.URL+"/login")
+	before := csrfRegex.FindStringSubmatch(page)[1]
+	login(t, ts, client, "Ed048b", "ed-pass-048b")
+
+	_, page = get(t, client, ts.URL+"/edit/Header048")
+	token := csrfRegex.FindStringSubmatch(page)[1]
+	if token == before {
+		t.Error("the token wasn't replaced at login")
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/savecat/Header048", strings.NewReader(""))
+	req.Header.Set("X-CSRF-Token", before)
+	if resp, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("the token from before login: status %d, want 403", resp.StatusCode)
+	}
+
+	// uploads send the token in the query string
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/upload?"+csrfField+"=wrong", strings.NewReader("--x--\r\n"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	if resp, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload with a wrong token: status %d, want 403", resp.StatusCode)
+	}
+}
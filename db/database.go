@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -63,6 +64,161 @@ func DBSetup() {
             email     TEXT,
             is_admin  INTEGER NOT NULL DEFAULT 0
         );`,
+		`CREATE TABLE IF NOT EXISTS Files (
+            id          INTEGER PRIMARY KEY AUTOINCREMENT,
+            name        TEXT    NOT NULL UNIQUE,
+            size        INTEGER NOT NULL DEFAULT 0,
+            mime_type   TEXT,
+            user_id     INTEGER,
+            created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );`,
+		`CREATE TABLE IF NOT EXISTS Revisions (
+            id          INTEGER PRIMARY KEY AUTOINCREMENT,
+            page_id     INTEGER NOT NULL,
+            title       TEXT    NOT NULL,
+            body        TEXT,
+            user_id     INTEGER,
+            created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_revisions_page ON Revisions(page_id);`,
+		`CREATE TABLE IF NOT EXISTS Archive (
+            id          INTEGER PRIMARY KEY AUTOINCREMENT,
+            kind        TEXT    NOT NULL,
+            original_id INTEGER NOT NULL,
+            title       TEXT    NOT NULL,
+            body        TEXT,
+            user_id     INTEGER,
+            created_at  DATETIME,
+            updated_at  DATETIME,
+            deleted_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            deleted_by  INTEGER
+        );`,
+		`CREATE TABLE IF NOT EXISTS ArchiveLinks (
+            archive_id  INTEGER REFERENCES Archive(id) ON DELETE CASCADE,
+            link_type   TEXT    NOT NULL,
+            title       TEXT    NOT NULL
+        );`,
+		`CREATE TABLE IF NOT EXISTS Logs (
+            id          INTEGER PRIMARY KEY AUTOINCREMENT,
+            log_type    TEXT    NOT NULL,
+            action      TEXT    NOT NULL,
+            username    TEXT,
+            target      TEXT,
+            reason      TEXT,
+            details     TEXT,
+            ip          TEXT,
+            created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_logs_created ON Logs(created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_logs_username ON Logs(username);`,
+		// The audit log is append-only
+		`CREATE TRIGGER IF NOT EXISTS logs_no_update BEFORE UPDATE ON Logs
+            BEGIN SELECT RAISE(ABORT, 'Logs is append-only'); END;`,
+		`CREATE TRIGGER IF NOT EXISTS logs_no_delete BEFORE DELETE ON Logs
+            BEGIN SELECT RAISE(ABORT, 'Logs is append-only'); END;`,
+		`CREATE TABLE IF NOT EXISTS FileUsage (
+            page_id     INTEGER REFERENCES Pages(id) ON DELETE CASCADE,
+            file_name   TEXT    NOT NULL
+        );`,
+		// [Category:X] tags naming a category that doesn't exist yet, attached
+		// when it is created. Exactly one of page_id and subcategory_id is set
+		`CREATE TABLE IF NOT EXISTS PendingCategoryLinks (
+            title           TEXT NOT NULL,
+            page_id         INTEGER REFERENCES Pages(id) ON DELETE CASCADE,
+            subcategory_id  INTEGER REFERENCES Categories(id) ON DELETE CASCADE
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_pending_category_title ON PendingCategoryLinks(title);`,
+		// Comments on Talk: pages, replies point at the comment they answer
+		`CREATE TABLE IF NOT EXISTS TalkComments (
+            id          INTEGER PRIMARY KEY AUTOINCREMENT,
+            page_id     INTEGER NOT NULL REFERENCES Pages(id) ON DELETE CASCADE,
+            parent_id   INTEGER REFERENCES TalkComments(id),
+            subject     TEXT,
+            body        TEXT    NOT NULL,
+            user_id     INTEGER,
+            username    TEXT,
+            created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_talk_comments_page ON TalkComments(page_id);`,
+		// Edit and move protection by title, so missing pages can be protected too
+		`CREATE TABLE IF NOT EXISTS PageProtections (
+            title       TEXT    NOT NULL,
+            action      TEXT    NOT NULL,
+            level       TEXT    NOT NULL,
+            reason      TEXT,
+            user_id     INTEGER,
+            expires_at  DATETIME,
+            created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (title, action)
+        );`,
+		// One-time links to /register, only a hash of the token is kept
+		`CREATE TABLE IF NOT EXISTS Invites (
+            id          INTEGER PRIMARY KEY AUTOINCREMENT,
+            token_hash  TEXT    NOT NULL UNIQUE,
+            user_group  TEXT    NOT NULL,
+            note        TEXT,
+            created_by  INTEGER,
+            created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            expires_at  DATETIME NOT NULL,
+            used_by     INTEGER,
+            used_at     DATETIME
+        );`,
+		// Single use codes for logging in without the authenticator app
+		`CREATE TABLE IF NOT EXISTS RecoveryCodes (
+            user_id     INTEGER NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
+            code_hash   TEXT    NOT NULL,
+            used_at     DATETIME
+        );`,
+		// Logged-in sessions, the cookie holds the id and only its hash is kept
+		`CREATE TABLE IF NOT EXISTS Sessions (
+            id          INTEGER PRIMARY KEY AUTOINCREMENT,
+            token_hash  TEXT    NOT NULL UNIQUE,
+            user_id     INTEGER NOT NULL REFERENCES Users(id) ON DELETE CASCADE,
+            data        BLOB,
+            user_agent  TEXT,
+            ip          TEXT,
+            created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            last_seen   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            expires_at  DATETIME NOT NULL
+        );`,
+	}
+
+	// Columns added after a table was first released
+	columns := []struct{ table, column, definition string }{
+		{"Logs", "details", "TEXT"},
+		{"Logs", "ip", "TEXT"},
+		{"CategoryPages", "sort_key", "TEXT"},
+		{"PendingCategoryLinks", "sort_key", "TEXT"},
+		{"Pages", "namespace", "INTEGER NOT NULL DEFAULT 0"},
+		{"Users", "created_at", "DATETIME"},
+		// NULL falls back to admin or editor by is_admin
+		{"Users", "user_group", "TEXT"},
+		{"Users", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		// requested from /register and not yet approved
+		{"Users", "pending", "INTEGER NOT NULL DEFAULT 0"},
+		// base32 TOTP key, NULL when 2FA is off, and the last time step used
+		{"Users", "totp_secret", "TEXT"},
+		{"Users", "totp_last_step", "INTEGER"},
+		// set for the default admin/admin and after an admin resets a password
+		{"Users", "must_change_password", "INTEGER NOT NULL DEFAULT 0"},
+		// "<issuer> <subject>" of a single sign-on account, these have an empty password
+		{"Users", "oidc_subject", "TEXT"},
+	}
+
+	// Run once the columns above exist
+	migrations := []string{
+		`CREATE INDEX IF NOT EXISTS idx_pages_namespace ON Pages(namespace, title);`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON Sessions(user_id);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc_subject ON Users(oidc_subject);`,
+		// Help pages used to be stored as Help-<name>, move them into the Help namespace (12)
+		`UPDATE Pages SET title = 'Help:' || substr(title, 6), namespace = 12
+            WHERE substr(title, 1, 5) = 'Help-' AND 'Help:' || substr(title, 6) NOT IN (SELECT title FROM Pages);`,
+		`UPDATE Archive SET title = 'Help:' || substr(title, 6) WHERE kind = 'page' AND substr(title, 1, 5) = 'Help-';`,
+		// only the history of pages that were moved above, a Help-<name> left
+		// behind because Help:<name> already existed keeps its own
+		`UPDATE Revisions SET title = 'Help:' || substr(title, 6) WHERE substr(title, 1, 5) = 'Help-'
+            AND (page_id IN (SELECT id FROM Pages WHERE title = 'Help:' || substr(Revisions.title, 6))
+                OR page_id IN (SELECT original_id FROM Archive WHERE kind = 'page' AND title = 'Help:' || substr(Revisions.title, 6)));`,
 	}
 
 	for _, stmt := range stmts {
@@ -70,6 +226,16 @@ func DBSetup() {
 			log.Fatalf("Error creating table: %v", err)
 		}
 	}
+	for _, c := range columns {
+		if err := ensureColumn(db, c.table, c.column, c.definition); err != nil {
+			log.Fatalf("Error adding column %s.%s: %v", c.table, c.column, err)
+		}
+	}
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Fatalf("Error migrating database: %v", err)
+		}
+	}
 
 	var installed bool
 	err = db.QueryRow(`SELECT installed FROM Settings`).Scan(&installed)
@@ -91,3 +257,31 @@ func DBSetup() {
 		log.Fatalf("Error checking installer flag: %v", err)
 	}
 }
+
+// ensureColumn adds a column to a table created by an older version of ArcWiki
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
@@ -0,0 +1,97 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func pageExists(t *testing.T, title string) bool {
+	t.Helper()
+	var n int
+	if err := authDB.QueryRow("SELECT COUNT(*) FROM Pages WHERE title = ?", title).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestDeleteNeedsConfirmationAndReason(t *testing.T) {
+	modID := testUser(t, "Mod028", "mod-pass-028", "moderator", "")
+	savePage(t, "Doomed028", "soon gone", modID)
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Pages WHERE title = 'Doomed028'")
+		authDB.Exec("DELETE FROM Archive WHERE title = 'Doomed028'")
+		authDB.Exec("DELETE FROM Revisions WHERE title = 'Doomed028'")
+	})
+
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Mod028", "mod-pass-028")
+	confirm := ts.URL + "/delete/page/Doomed028"
+
+	status, body := get(t, client, confirm)
+	if status != http.StatusOK || !strings.Contains(body, `name="reason"`) {
+		t.Fatalf("GET %s: status %d, want the confirmation form", confirm, status)
+	}
+	if !pageExists(t, "Doomed028") {
+		t.Fatal("a GET deleted the page")
+	}
+
+	_, body = submit(t, client, confirm, confirm, url.Values{"reason": {"  "}})
+	if !strings.Contains(body, "Please give a reason") || !pageExists(t, "Doomed028") {
+		t.Fatal("deleting without a reason went ahead")
+	}
+
+	if status, _ := submit(t, client, confirm, confirm, url.Values{"reason": {"spam 028"}}); status != http.StatusOK {
+		t.Fatalf("confirmed delete: status %d", status)
+	}
+	if pageExists(t, "Doomed028") {
+		t.Fatal("the page is still there after a confirmed delete")
+	}
+
+	var username, reason string
+	err := authDB.QueryRow("SELECT username, reason FROM Logs WHERE log_type = 'delete' AND target = 'Doomed028' ORDER BY id DESC LIMIT 1").Scan(&username, &reason)
+	if err != nil {
+		t.Fatalf("no deletion log entry: %v", err)
+	}
+	if username != "Mod028" || reason != "spam 028" {
+		t.Errorf("logged %q/%q, want Mod028/spam 028", username, reason)
+	}
+	_, body = get(t, client, ts.URL+"/title/Special:Log/delete")
+	if !strings.Contains(body, "spam 028") {
+		t.Error("Special:Log/delete doesn't show the deletion")
+	}
+}
+
+func TestDeleteNeedsPermission(t *testing.T) {
+	editorID := testUser(t, "Editor028", "editor-pass-028", "editor", "")
+	savePage(t, "Kept028", "stays", editorID)
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Pages WHERE title = 'Kept028'")
+		authDB.Exec("DELETE FROM Revisions WHERE title = 'Kept028'")
+	})
+
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Editor028", "editor-pass-028")
+	submit(t, client, ts.URL+"/edit/Kept028", ts.URL+"/delete/page/Kept028", url.Values{"reason": {"no"}})
+	if !pageExists(t, "Kept028") {
+		t.Error("an editor deleted a page")
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// diffs larger than this many lines on both sides are shown in full rather
+// than risk a huge LCS table
+const maxDiffLines = 3000
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// diffLines is a plain longest-common-subsequence line diff
+func diffLines(oldText string, newText string) []diffLine {
+	a := strings.Split(strings.ReplaceAll(oldText, "\r\n", "\n"), "\n")
+	b := strings.Split(strings.ReplaceAll(newText, "\r\n", "\n"), "\n")
+	if oldText == "" {
+		a = nil
+	}
+
+	if len(a) > maxDiffLines && len(b) > maxDiffLines {
+		var out []diffLine
+		for _, line := range a {
+			out = append(out, diffLine{'-', line})
+		}
+		for _, line := range b {
+			out = append(out, diffLine{'+', line})
+		}
+		return out
+	}
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{'-', a[i]})
+			i++
+		default:
+			out = append(out, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{'+', b[j]})
+	}
+	return out
+}
+
+// renderDiff shows changed lines with up to context unchanged lines around them
+func renderDiff(lines []diffLine, context int) string {
+	show := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.op == ' ' {
+			continue
+		}
+		for k := max(0, i-context); k <= min(len(lines)-1, i+context); k++ {
+			show[k] = true
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<table class="table table-sm" style="font-family:monospace;white-space:pre-wrap">`)
+	changed := false
+	for i, l := range lines {
+		if !show[i] {
+			if i > 0 && show[i-1] {
+				b.WriteString(`<tr><td colspan="2" class="text-muted">…</td></tr>`)
+			}
+			continue
+		}
+		style := ""
+		switch l.op {
+		case '-':
+			style = ` style="background-color:#ffe49c"`
+			changed = true
+		case '+':
+			style = ` style="background-color:#d8ecff"`
+			changed = true
+		}
+		b.WriteString(fmt.Sprintf(`<tr%s><td style="width:1em">%c</td><td>%s</td></tr>`, style, l.op, html.EscapeString(l.text)))
+	}
+	b.WriteString(`</table>`)
+	if !changed {
+		return `<p>No difference in the text.</p>`
+	}
+	return b.String()
+}
+
+type Revision struct {
+	ID        int
+	PageID    int
+	Title     string
+	Body      string
+	Username  string
+	CreatedAt time.Time
+}
+
+func loadRevision(dbConn *sql.DB, query string, args ...interface{}) (*Revision, error) {
+	rev := &Revision{}
+	err := dbConn.QueryRow(`SELECT Revisions.id, Revisions.page_id, Revisions.title, COALESCE(Revisions.body, ''),
+		COALESCE(Users.username, ''), Revisions.created_at
+		FROM Revisions LEFT JOIN Users ON Users.id = Revisions.user_id `+query, args...).
+		Scan(&rev.ID, &rev.PageID, &rev.Title, &rev.Body, &rev.Username, &rev.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// diffHandler shows /diff/<revision id> against the revision before it
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/diff/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+	defer dbConn.Close()
+
+	rev, err := loadRevision(dbConn, "WHERE Revisions.id = ?", id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+	if !requireReadable(w, r, rev.Title) {
+		return
+	}
+	// a deleted page's history stays with it in the trash
+	var deleted bool
+	if err := dbConn.QueryRow("SELECT EXISTS(SELECT 1 FROM Archive WHERE kind = 'page' AND original_id = ?)", rev.PageID).Scan(&deleted); err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+	if deleted && !can(r, PermDelete) {
+		http.NotFound(w, r)
+		return
+	}
+	prev, err := loadRevision(dbConn, "WHERE Revisions.page_id = ? AND Revisions.id < ? ORDER BY Revisions.id DESC LIMIT 1", rev.PageID, rev.ID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+
+	describe := func(rev *Revision) string {
+		user := "unknown"
+		if rev.Username != "" {
+			user = fmt.Sprintf(`<a href="/title/User:%s">%s</a>`, url.PathEscape(rev.Username), html.EscapeString(rev.Username))
+		}
+		return fmt.Sprintf(`Revision as of %s by %s`, formatDateTime(rev.CreatedAt), user)
+	}
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(fmt.Sprintf(`<p><a href="/title/%s">%s</a></p>`, url.PathEscape(rev.Title), html.EscapeString(removeUnderscores(rev.Title))))
+	oldBody := ""
+	if prev != nil {
+		oldBody = prev.Body
+		bodyHTML.WriteString(fmt.Sprintf(`<p>%s<br>%s</p>`, describe(prev), describe(rev)))
+	} else {
+		bodyHTML.WriteString(fmt.Sprintf(`<p>%s, the page was created here</p>`, describe(rev)))
+	}
+	bodyHTML.WriteString(renderDiff(diffLines(oldBody, rev.Body), 3))
+
+	renderTemplate(w, "title", newSpecialPage("Difference between revisions", bodyHTML.String(), getUserAgent(r)))
+}
@@ -0,0 +1,449 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// uploaded files live here and are served under /files/
+const uploadDir = "uploads"
+
+const maxUploadSize = 32 << 20
+
+// matches [File:name] wiki links and /files/name urls used in markdown images and links
+var fileRefRegex = regexp.MustCompile(`\[File:([^\]|]+)\]|/files/([^\s)"'\]]+)`)
+
+var imageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true,
+}
+
+type File struct {
+	ID        int
+	Name      string
+	Size      int64
+	MimeType  string
+	Uploader  string
+	CreatedAt time.Time
+}
+
+// findFileReferences returns the distinct file names referenced from a page body
+func findFileReferences(body string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, match := range fileRefRegex.FindAllStringSubmatch(body, -1) {
+		name := match[1]
+		if name == "" {
+			name, _ = url.PathUnescape(match[2])
+		}
+		name = sanitizeFileName(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// updateFileUsage replaces the file usage rows for a page, called from every save path
+func updateFileUsage(tx *sql.Tx, pageID int, body string) error {
+	if _, err := tx.Exec("DELETE FROM FileUsage WHERE page_id = ?", pageID); err != nil {
+		return err
+	}
+	for _, name := range findFileReferences(body) {
+		if _, err := tx.Exec("INSERT INTO FileUsage (page_id, file_name) VALUES (?, ?)", pageID, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitizeFileName strips any path components so uploads cannot escape uploadDir
+func sanitizeFileName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = filepath.Base(strings.TrimSpace(name))
+	if name == "." || name == "/" || name == ".." || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	// not canonicalizeTitle, a colon in a file name is not a namespace
+	return upperFirst(strings.ReplaceAll(name, " ", "_"))
+}
+
+func isImageFile(name string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// renderFileLinks turns [File:name] into an image or a download link
+func renderFileLinks(text string) string {
+	re := regexp.MustCompile(`\[File:([^\]|]+)\]`)
+	return re.ReplaceAllStringFunc(text, func(match string) string {
+		name := sanitizeFileName(re.FindStringSubmatch(match)[1])
+		if name == "" {
+			return match
+		}
+		src := "/files/" + url.PathEscape(name)
+		if isImageFile(name) {
+			return fmt.Sprintf(`<img class="img-fluid" src="%s" alt="%s">`, src, html.EscapeString(name))
+		}
+		return fmt.Sprintf(`<a href="%s">%s</a>`, src, html.EscapeString(name))
+	})
+}
+
+// serveFile serves uploads with headers that stop them being treated as part of the site
+func serveFile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	// uploads are stored flat, so anything else would be a directory listing
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !requireReadable(w, r, "File:"+name) {
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.StripPrefix("/files/", http.FileServer(http.Dir(uploadDir))).ServeHTTP(w, r)
+}
+
+func uploadForm(r *http.Request, message string) string {
+	var b strings.Builder
+	b.WriteString(`<h2 class="wikih2">Upload File</h2>`)
+	if message != "" {
+		b.WriteString(fmt.Sprintf(`<p style="color:red">%s</p>`, html.EscapeString(message)))
+	}
+	// the token goes in the query string, see csrfProtect
+	b.WriteString(fmt.Sprintf(`<form action="/upload?%s=%s" method="POST" enctype="multipart/form-data">`, csrfField, url.QueryEscape(csrfToken(r))))
+	b.WriteString(`
+        <div class="form-group">
+          <label for="file">File:</label>
+          <input class="form-control" type="file" id="file" name="file" required>
+        </div>
+        <div class="form-group">
+          <label for="name">Name (optional):</label>
+          <input class="form-control" type="text" id="name" name="name">
+        </div>
+        <button class="bg-dark hover:bg-gray-100 text-white font-semibold py-2 px-4 border border-gray-400 rounded shadow" type="submit">Upload</button>
+    </form>`)
+	return b.String()
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	userAgent := getUserAgent(r)
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "title", newSpecialPage("Upload File", uploadForm(r, ""), userAgent))
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		log.Warn("Upload rejected:", err)
+		renderTemplate(w, "title", newSpecialPage("Upload File", uploadForm(r, "The file is too large or the upload was incomplete."), userAgent))
+		return
+	}
+	src, header, err := r.FormFile("file")
+	if err != nil {
+		renderTemplate(w, "title", newSpecialPage("Upload File", uploadForm(r, "Please choose a file to upload."), userAgent))
+		return
+	}
+	defer src.Close()
+
+	name := r.FormValue("name")
+	if strings.TrimSpace(name) == "" {
+		name = header.Filename
+	}
+	name = sanitizeFileName(name)
+	if name == "" {
+		renderTemplate(w, "title", newSpecialPage("Upload File", uploadForm(r, "That file name is not allowed."), userAgent))
+		return
+	}
+
+	size, err := saveUpload(name, header.Header.Get("Content-Type"), src, currentUserID(r))
+	if err != nil {
+		log.Error("Upload failed:", err)
+		renderTemplate(w, "title", newSpecialPage("Upload File", uploadForm(r, err.Error()), userAgent))
+		return
+	}
+
+	log.Info("Uploaded file: ", name)
+	writeLog(r, "upload", "upload", currentUsername(r), "File:"+name, "", formatFileSize(size))
+	http.Redirect(w, r, "/title/Special:ListFiles", http.StatusFound)
+}
+
+// saveUpload writes the file to disk and records it, removing the file again if the insert fails
+func saveUpload(name string, mimeType string, src io.Reader, userID int) (int64, error) {
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return 0, err
+	}
+	path := filepath.Join(uploadDir, name)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return 0, fmt.Errorf("a file named %s already exists", name)
+		}
+		return 0, err
+	}
+	size, err := io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+			mimeType = byExt
+		}
+	}
+
+	db, err := db.LoadDatabase()
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(
+		"INSERT INTO Files (name, size, mime_type, user_id, created_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		name, size, mimeType, nullUserID(userID),
+	)
+	if err != nil {
+		os.Remove(path)
+		if isUniqueConstraintError(err) {
+			return 0, fmt.Errorf("a file named %s already exists", name)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+func deleteFile(name string) error {
+	db, err := db.LoadDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.Exec("DELETE FROM Files WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Info("No file found with name:", name)
+		return nil
+	}
+	if err := os.Remove(filepath.Join(uploadDir, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Info("Deleted file: ", name)
+	return nil
+}
+
+// fileSortColumns whitelists the ?sort= values accepted by Special:ListFiles
+var fileSortColumns = map[string]string{
+	"date":     "Files.created_at",
+	"size":     "Files.size",
+	"uploader": "uploader",
+	"name":     "Files.name",
+}
+
+func queryFiles(where string, orderBy string, args ...interface{}) ([]File, error) {
+	db, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT Files.id, Files.name, Files.size, COALESCE(Files.mime_type, ''),
+		COALESCE(Users.username, '') AS uploader, Files.created_at
+		FROM Files LEFT JOIN Users ON Users.id = Files.user_id `+where+` ORDER BY `+orderBy, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.Name, &f.Size, &f.MimeType, &f.Uploader, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func formatFileSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+// Special:ListFiles, sortable by date, size, uploader or name
+func loadListFiles(r *http.Request, userAgent string) (*Page, error) {
+	sortKey := r.URL.Query().Get("sort")
+	column, ok := fileSortColumns[sortKey]
+	if !ok {
+		sortKey = "date"
+		column = fileSortColumns[sortKey]
+	}
+	dir := "DESC"
+	if r.URL.Query().Get("dir") == "asc" {
+		dir = "ASC"
+	}
+
+	files, err := queryFiles("", column+" "+dir+", Files.name ASC")
+	if err != nil {
+		return nil, err
+	}
+	access := readAccessFor(r)
+	readable := files[:0]
+	for _, f := range files {
+		if access.canReadFile(f.Name) {
+			readable = append(readable, f)
+		}
+	}
+	files = readable
+
+	header := func(key, label string) string {
+		next := "desc"
+		if key == sortKey && dir == "DESC" {
+			next = "asc"
+		}
+		return fmt.Sprintf(`<th><a href="/title/Special:ListFiles?sort=%s&dir=%s">%s</a></th>`, key, next, label)
+	}
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(`<h2 class="wikih2">All Files</h2>`)
+	if len(files) == 0 {
+		bodyHTML.WriteString(`<p>No files have been uploaded yet. <a href="/upload">Upload a file</a></p>`)
+	} else {
+		bodyHTML.WriteString(`<table class="table table-sm"><tr>`)
+		bodyHTML.WriteString(header("date", "Date") + header("name", "Name") + header("size", "Size") + header("uploader", "Uploader"))
+		bodyHTML.WriteString(`</tr>`)
+		for _, f := range files {
+			bodyHTML.WriteString(fmt.Sprintf(`<tr><td>%s</td><td><a href="/title/File:%s">%s</a></td><td>%s</td><td>%s</td></tr>`,
+				formatDateTime(f.CreatedAt), url.PathEscape(f.Name), html.EscapeString(f.Name), formatFileSize(f.Size), html.EscapeString(f.Uploader)))
+		}
+		bodyHTML.WriteString(`</table>`)
+	}
+
+	return newSpecialPage("Special:ListFiles", bodyHTML.String(), userAgent), nil
+}
+
+// Special:UnusedFiles, uploads that no page references
+func loadUnusedFiles(userAgent string) (*Page, error) {
+	files, err := queryFiles("WHERE Files.name NOT IN (SELECT file_name FROM FileUsage)", "Files.created_at ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(`<h2 class="wikih2">Unused Files</h2>`)
+	if len(files) == 0 {
+		bodyHTML.WriteString(`<p>Every uploaded file is used by at least one page.</p>`)
+	} else {
+		bodyHTML.WriteString(`<p>These files are not referenced from any page and can be deleted to free up storage.</p><ul>`)
+		for _, f := range files {
+			bodyHTML.WriteString(fmt.Sprintf(`<li><a href="/files/%s">%s</a> (%s, %s) <a href="/delete/file/%s"> Delete File</a></li>`,
+				url.PathEscape(f.Name), html.EscapeString(f.Name), formatFileSize(f.Size), formatDateTime(f.CreatedAt), url.PathEscape(f.Name)))
+		}
+		bodyHTML.WriteString(`</ul>`)
+	}
+
+	return newSpecialPage("Special:UnusedFiles", bodyHTML.String(), userAgent), nil
+}
+
+// File:<name> describes an upload and lists the pages using it
+func loadFilePage(r *http.Request, name string, userAgent string) (*Page, error) {
+	files, err := queryFiles("WHERE Files.name = ?", "Files.id", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file named %s", name)
+	}
+	f := files[0]
+
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+	rows, err := dbConn.Query(`SELECT DISTINCT Pages.title FROM FileUsage
+		JOIN Pages ON Pages.id = FileUsage.page_id WHERE FileUsage.file_name = ? ORDER BY Pages.title`, f.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	access := readAccessFor(r)
+	var usedOn []string
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, err
+		}
+		if !access.canRead(title) {
+			continue
+		}
+		usedOn = append(usedOn, fmt.Sprintf(`<li><a href="/title/%s">%s</a></li>`, url.PathEscape(title), html.EscapeString(removeUnderscores(title))))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	src := "/files/" + url.PathEscape(f.Name)
+	var bodyHTML strings.Builder
+	if isImageFile(f.Name) {
+		bodyHTML.WriteString(fmt.Sprintf(`<p><a href="%s"><img class="img-fluid" src="%s" alt="%s"></a></p>`, src, src, html.EscapeString(f.Name)))
+	}
+	bodyHTML.WriteString(fmt.Sprintf(`<p><a href="%s">%s</a> (%s, %s), uploaded by %s on %s</p>`,
+		src, html.EscapeString(f.Name), formatFileSize(f.Size), html.EscapeString(f.MimeType), html.EscapeString(f.Uploader), formatDateTime(f.CreatedAt)))
+	bodyHTML.WriteString(`<h2 class="wikih2">File usage</h2>`)
+	if len(usedOn) == 0 {
+		bodyHTML.WriteString(`<p>No pages use this file.</p>`)
+	} else {
+		bodyHTML.WriteString(`<ul>` + strings.Join(usedOn, "") + `</ul>`)
+	}
+
+	return newSpecialPage("File:"+f.Name, bodyHTML.String(), userAgent), nil
+}
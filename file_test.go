@@ -0,0 +1,78 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestUnusedFiles(t *testing.T) {
+	insertFile(t, "Used-026.png", 10, 0)
+	insertFile(t, "unUsed-026.png", 20, 0)
+	savePage(t, "File_user_026", "See [File:Used-026.png]", 0)
+
+	p, err := loadUnusedFiles(Desktop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := string(p.Body); !strings.Contains(body, "unUsed-026.png") || strings.Contains(body, "/files/Used-026.png") {
+		t.Fatalf("unused files list is wrong:\n%s", body)
+	}
+
+	// dropping the last reference makes it unused
+	savePage(t, "File_user_026", "Nothing here now", 0)
+	if p, err = loadUnusedFiles(Desktop); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(p.Body), "/files/Used-026.png") {
+		t.Fatal("a file that lost its last reference isn't listed as unused")
+	}
+}
+
+func TestListFilesSort(t *testing.T) {
+	insertFile(t, "Sort-b-026.png", 300, 0)
+	insertFile(t, "Sort-a-026.png", 100, 0)
+	insertFile(t, "Sort-c-026.png", 200, 0)
+
+	order := func(query string) []string {
+		t.Helper()
+		p, err := loadListFiles(httptest.NewRequest("GET", "/title/Special:ListFiles?"+query, nil), Desktop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := string(p.Body)
+		names := []string{"Sort-a-026.png", "Sort-b-026.png", "Sort-c-026.png"}
+		sort.Slice(names, func(i, j int) bool {
+			return strings.Index(body, ">"+names[i]+"<") < strings.Index(body, ">"+names[j]+"<")
+		})
+		return names
+	}
+
+	if got := strings.Join(order("sort=size&dir=asc"), " "); got != "Sort-a-026.png Sort-c-026.png Sort-b-026.png" {
+		t.Errorf("by size ascending: %s", got)
+	}
+	if got := strings.Join(order("sort=size"), " "); got != "Sort-b-026.png Sort-c-026.png Sort-a-026.png" {
+		t.Errorf("by size descending: %s", got)
+	}
+	if got := strings.Join(order("sort=name&dir=asc"), " "); got != "Sort-a-026.png Sort-b-026.png Sort-c-026.png" {
+		t.Errorf("by name: %s", got)
+	}
+}
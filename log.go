@@ -0,0 +1,410 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// logTypes names the logs shown on Special:Log/<type>
+var logTypes = map[string]string{
+	"auth":     "Login log",
+	"page":     "Page log",
+	"category": "Category log",
+	"delete":   "Deletion log",
+	"upload":   "Upload log",
+	"user":     "User creation log",
+	"rights":   "User rights log",
+	"protect":  "Protection log",
+	"config":   "Configuration log",
+}
+
+// adminOnlyLogs hold IP addresses and failed logins so only admins may read them
+var adminOnlyLogs = map[string]bool{
+	"auth":   true,
+	"config": true,
+}
+
+// titleLogs have a page, category or file title as their target
+var titleLogs = map[string]bool{
+	"page":     true,
+	"category": true,
+	"upload":   true,
+	"delete":   true,
+	"protect":  true,
+}
+
+type LogEntry struct {
+	ID        int       `json:"id"`
+	Type      string    `json:"type"`
+	Action    string    `json:"action"`
+	Username  string    `json:"user"`
+	Target    string    `json:"target,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Details   string    `json:"details,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"timestamp"`
+}
+
+// LogFilter narrows down Special:Log and the JSON export
+type LogFilter struct {
+	Type      string
+	Username  string
+	From      string
+	To        string
+	AdminView bool
+	Limit     int
+	Access    *ReadAccess // hides entries about private pages, nil shows all
+}
+
+// clientIP returns the address of the visitor, trusting X-Forwarded-For only when configured to
+func clientIP(r *http.Request) string {
+	if config.TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeLog appends to the audit log, username is who acted and r supplies the
+// IP address (nil for actions taken by the server itself). A failure here is
+// reported but never undoes the action being logged
+func writeLog(r *http.Request, logType string, action string, username string, target string, reason string, details string) {
+	ip := ""
+	if r != nil {
+		ip = clientIP(r)
+	}
+
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		log.Error("Error writing log entry:", err)
+		return
+	}
+	defer dbConn.Close()
+
+	_, err = dbConn.Exec(
+		"INSERT INTO Logs (log_type, action, username, target, reason, details, ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		logType, action, username, target, reason, details, ip,
+	)
+	if err != nil {
+		log.Error("Error writing log entry:", err)
+	}
+}
+
+// logConfigChange records a config entry whenever config.json differs from
+// the last one logged, r is nil for the copy the server started with
+func logConfigChange(r *http.Request, configBytes []byte) {
+	sum := sha256.Sum256(configBytes)
+	hash := "sha256:" + hex.EncodeToString(sum[:])
+
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		log.Error("Database Error:", err)
+		return
+	}
+	defer dbConn.Close()
+
+	var last string
+	_ = dbConn.QueryRow("SELECT COALESCE(details, '') FROM Logs WHERE log_type = 'config' ORDER BY id DESC LIMIT 1").Scan(&last)
+	if last == hash {
+		return
+	}
+	username := ""
+	if r != nil {
+		username = currentUsername(r)
+	}
+	writeLog(r, "config", "change", username, configPath, "", hash)
+}
+
+func queryLogs(filter LogFilter) ([]LogEntry, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	var where []string
+	var args []interface{}
+	if filter.Type != "" {
+		where = append(where, "log_type = ?")
+		args = append(args, filter.Type)
+	}
+	if !filter.AdminView {
+		for logType := range adminOnlyLogs {
+			where = append(where, "log_type != ?")
+			args = append(args, logType)
+		}
+	}
+	if filter.Username != "" {
+		where = append(where, "username = ?")
+		args = append(args, filter.Username)
+	}
+	if filter.From != "" {
+		where = append(where, "created_at >= date(?)")
+		args = append(args, filter.From)
+	}
+	if filter.To != "" {
+		where = append(where, "created_at < date(?, '+1 day')")
+		args = append(args, filter.To)
+	}
+
+	query := "SELECT id, log_type, action, COALESCE(username, ''), COALESCE(target, ''), COALESCE(reason, ''), COALESCE(details, ''), COALESCE(ip, ''), created_at FROM Logs"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LogEntry
+	for rows.Next() {
+		var e LogEntry
+		if err := rows.Scan(&e.ID, &e.Type, &e.Action, &e.Username, &e.Target, &e.Reason, &e.Details, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if !filter.AdminView {
+			e.IP = ""
+		}
+		if filter.Access != nil && titleLogs[e.Type] && e.Target != "" && !filter.Access.canRead(e.Target) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// logFilterFromRequest reads ?type=, ?user=, ?from= and ?to= (dates as YYYY-MM-DD)
+func logFilterFromRequest(r *http.Request, logType string) (LogFilter, error) {
+	q := r.URL.Query()
+	if logType == "" {
+		logType = q.Get("type")
+	}
+	if _, ok := logTypes[logType]; logType != "" && !ok {
+		return LogFilter{}, fmt.Errorf("unknown log type %q", logType)
+	}
+	filter := LogFilter{
+		Type:      logType,
+		Username:  strings.TrimSpace(q.Get("user")),
+		AdminView: can(r, PermManageUsers),
+		Access:    readAccessFor(r),
+	}
+	if from := q.Get("from"); from != "" {
+		if _, err := time.Parse("2006-01-02", from); err != nil {
+			return LogFilter{}, fmt.Errorf("invalid from date %q", from)
+		}
+		filter.From = from
+	}
+	if to := q.Get("to"); to != "" {
+		if _, err := time.Parse("2006-01-02", to); err != nil {
+			return LogFilter{}, fmt.Errorf("invalid to date %q", to)
+		}
+		filter.To = to
+	}
+	if adminOnlyLogs[filter.Type] && !filter.AdminView {
+		return LogFilter{}, fmt.Errorf("the %s is only visible to admins", logTypes[filter.Type])
+	}
+	return filter, nil
+}
+
+// formatLogEntry renders a single line such as "admin deleted Foo (spam)"
+func formatLogEntry(e LogEntry) string {
+	actions := map[string]string{
+		"delete":          "deleted",
+		"restore":         "restored",
+		"create":          "created",
+		"edit":            "edited",
+		"comment":         "commented on",
+		"move":            "moved",
+		"upload":          "uploaded",
+		"login":           "logged in",
+		"login-failure":   "failed to log in",
+		"logout":          "logged out",
+		"change":          "changed",
+		"protect":         "protected",
+		"unprotect":       "removed protection from",
+		"disable":         "disabled",
+		"enable":          "enabled",
+		"password-reset":  "reset the password of",
+		"group":           "changed the group of",
+		"request":         "requested an account",
+		"register":        "signed up",
+		"approve":         "approved",
+		"reject":          "rejected the request of",
+		"invite":          "created an invite",
+		"revoke-invite":   "revoked an invite",
+		"password-change": "changed their password",
+		"reset-request":   "asked for a password reset",
+		"2fa-enable":      "turned on two-factor authentication",
+		"2fa-disable":     "turned off two-factor authentication",
+		"2fa-codes":       "made new recovery codes",
+		"2fa-reset":       "removed two-factor authentication from",
+		"lockout":         "locked out",
+		"unlock":          "unlocked",
+		"force-logout":    "signed out",
+	}
+	verb, ok := actions[e.Action]
+	if !ok {
+		verb = e.Action
+	}
+	username := e.Username
+	if username == "" {
+		username = "system"
+	}
+
+	line := fmt.Sprintf(`%s <b>%s</b> %s`, formatDateTime(e.CreatedAt), html.EscapeString(username), verb)
+	switch {
+	case e.Target == "":
+	case e.Type == "page" || e.Type == "category" || e.Type == "delete" || e.Type == "upload" || e.Type == "protect":
+		line += fmt.Sprintf(` <a href="/title/%s">%s</a>`, url.PathEscape(e.Target), html.EscapeString(removeUnderscores(e.Target)))
+	case e.Type == "user" || e.Type == "rights":
+		line += fmt.Sprintf(` <a href="/title/User:%s">%s</a>`, url.PathEscape(e.Target), html.EscapeString(e.Target))
+	default:
+		line += " " + html.EscapeString(e.Target)
+	}
+	if e.Reason != "" {
+		line += " <i>(" + html.EscapeString(e.Reason) + ")</i>"
+	}
+	if e.Details != "" {
+		line += ` <span class="text-muted">` + html.EscapeString(e.Details) + `</span>`
+	}
+	if e.IP != "" {
+		line += ` <span class="text-muted">[` + html.EscapeString(e.IP) + `]</span>`
+	}
+	return "<li>" + line + "</li>"
+}
+
+// Special:Log shows every log, Special:Log/<type> a single one
+func loadLog(r *http.Request, logType string, userAgent string) (*Page, error) {
+	filter, err := logFilterFromRequest(r, logType)
+	if err != nil {
+		return nil, err
+	}
+	filter.Limit = 500
+
+	title := "Special:Log"
+	heading := "All logs"
+	if filter.Type != "" {
+		title += "/" + filter.Type
+		heading = logTypes[filter.Type]
+	}
+
+	entries, err := queryLogs(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(logTypes))
+	for key := range logTypes {
+		if filter.AdminView || !adminOnlyLogs[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(fmt.Sprintf(`<h2 class="wikih2">%s</h2>`, heading))
+	bodyHTML.WriteString(`<form action="/title/Special:Log" method="GET" class="row g-2 mb-3">
+        <div class="col-auto"><select class="form-select form-select-sm" name="type"><option value="">All logs</option>`)
+	for _, key := range keys {
+		selected := ""
+		if key == filter.Type {
+			selected = " selected"
+		}
+		bodyHTML.WriteString(fmt.Sprintf(`<option value="%s"%s>%s</option>`, key, selected, logTypes[key]))
+	}
+	bodyHTML.WriteString(fmt.Sprintf(`</select></div>
+        <div class="col-auto"><input class="form-control form-control-sm" type="text" name="user" placeholder="User" value="%s"></div>
+        <div class="col-auto"><input class="form-control form-control-sm" type="date" name="from" value="%s"></div>
+        <div class="col-auto"><input class="form-control form-control-sm" type="date" name="to" value="%s"></div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">Show</button></div>
+    </form>`, html.EscapeString(filter.Username), filter.From, filter.To))
+
+	if filter.AdminView {
+		query := url.Values{}
+		for key, value := range map[string]string{"type": filter.Type, "user": filter.Username, "from": filter.From, "to": filter.To} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		bodyHTML.WriteString(fmt.Sprintf(`<p><a href="/api/log?%s">Export as JSON</a></p>`, html.EscapeString(query.Encode())))
+	}
+
+	if len(entries) == 0 {
+		bodyHTML.WriteString(`<p>No matching log entries.</p>`)
+	} else {
+		bodyHTML.WriteString(`<ul>`)
+		for _, e := range entries {
+			bodyHTML.WriteString(formatLogEntry(e))
+		}
+		bodyHTML.WriteString(`</ul>`)
+	}
+
+	return newSpecialPage(title, bodyHTML.String(), userAgent), nil
+}
+
+// logExportHandler serves the filtered audit log as JSON for compliance reviews
+func logExportHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := logFilterFromRequest(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := queryLogs(filter)
+	if err != nil {
+		log.Error("Error exporting log:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="arcwiki-log.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		log.Error("Error encoding log export:", err)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLogsAppendOnly(t *testing.T) {
+	writeLog(nil, "page", "edit", "Someone029", "Locked029", "", "")
+	var id int
+	if err := authDB.QueryRow("SELECT id FROM Logs WHERE target = 'Locked029' ORDER BY id DESC LIMIT 1").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authDB.Exec("UPDATE Logs SET reason = 'rewritten' WHERE id = ?", id); err == nil {
+		t.Error("a log entry was updated")
+	}
+	if _, err := authDB.Exec("DELETE FROM Logs WHERE id = ?", id); err == nil {
+		t.Error("a log entry was deleted")
+	}
+}
+
+func TestLoginsLogged(t *testing.T) {
+	testUser(t, "Editor029", "editor-pass-029", "editor", "")
+	ts, client := newTestServer(t)
+
+	submit(t, client, ts.URL+"/login", ts.URL+"/loginPost", url.Values{
+		"username": {"Editor029"},
+		"password": {"wrong-pass-029"},
+	})
+	login(t, ts, client, "Editor029", "editor-pass-029")
+
+	entries, err := queryLogs(LogFilter{Type: "auth", Username: "Editor029", AdminView: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := map[string]string{}
+	for _, e := range entries {
+		actions[e.Action] = e.IP
+	}
+	for _, action := range []string{"login", "login-failure"} {
+		ip, ok := actions[action]
+		if !ok {
+			t.Errorf("no %s entry for Editor029", action)
+		} else if ip != "127.0.0.1" {
+			t.Errorf("%s logged from %q, want 127.0.0.1", action, ip)
+		}
+	}
+
+	// the login log is for admins, and so are the addresses
+	entries, err = queryLogs(LogFilter{Username: "Editor029"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Type == "auth" || e.IP != "" {
+			t.Errorf("non-admin view shows %s/%s from %q", e.Type, e.Action, e.IP)
+		}
+	}
+}
+
+func TestLogExport(t *testing.T) {
+	testUser(t, "Editor029b", "editor-pass-029", "editor", "")
+	testUser(t, "Admin029", "admin-pass-029", "admin", "")
+	writeLog(nil, "page", "create", "Editor029b", "Exported029", "", "")
+
+	ts, editor := newTestServer(t)
+	login(t, ts, editor, "Editor029b", "editor-pass-029")
+	if _, body := get(t, editor, ts.URL+"/api/log"); strings.Contains(body, "Exported029") {
+		t.Error("an editor can export the log")
+	}
+	if _, body := get(t, editor, ts.URL+"/title/Special:Log/auth"); strings.Contains(body, "Login log") {
+		t.Error("an editor can read the login log")
+	}
+
+	_, admin := newTestServer(t)
+	login(t, ts, admin, "Admin029", "admin-pass-029")
+	status, body := get(t, admin, ts.URL+"/api/log?type=page&user=Editor029b")
+	if status != http.StatusOK {
+		t.Fatalf("admin export: status %d", status)
+	}
+	var entries []LogEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("the export is missing the page entry")
+	}
+	for _, e := range entries {
+		if e.Type != "page" || e.Username != "Editor029b" {
+			t.Errorf("the filtered export has %s by %s", e.Type, e.Username)
+		}
+	}
+	if status, _ := get(t, admin, ts.URL+"/api/log?from=yesterday"); status != http.StatusBadRequest {
+		t.Errorf("bad date: status %d, want 400", status)
+	}
+	if !strings.Contains(body, `"target": "Exported029"`) {
+		t.Error("the export doesn't name the target")
+	}
+}
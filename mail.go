@@ -0,0 +1,78 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMTPConfig is the "smtp" section of config.json, mail is off without a host.
+// SMTP_PASSWORD in the environment overrides password
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"` // 587 if unset
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// mailEnabled also needs baseURL, the links in the mails can't come from the
+// Host header of whoever asked for them
+func mailEnabled() bool {
+	return config.SMTP.Host != "" && config.BaseURL != ""
+}
+
+// sendMail sends a plain text email, upgrading to TLS when the server offers
+// STARTTLS. Auth is only sent when a username is set
+func sendMail(to string, subject string, body string) error {
+	c := config.SMTP
+	port := c.Port
+	if port == 0 {
+		port = 587
+	}
+	from := c.From
+	if from == "" {
+		from = "arcwiki@" + c.Host
+	}
+
+	var auth smtp.Auth
+	if c.Username != "" {
+		password := c.Password
+		if env := os.Getenv("SMTP_PASSWORD"); env != "" {
+			password = env
+		}
+		auth = smtp.PlainAuth("", c.Username, password, c.Host)
+	}
+
+	// keep header injection out of the fields that came from users
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	msg := fmt.Sprintf("From: %s <%s>\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		clean.Replace(config.SiteTitle), from, clean.Replace(to), clean.Replace(subject), time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(fmt.Sprintf("%s:%d", c.Host, port), auth, from, []string{to}, []byte(msg))
+}
+
+// siteURL makes path absolute for links that leave the site, in emails and
+// invites. It is just path when baseURL isn't set
+func siteURL(path string) string {
+	return config.BaseURL + path
+}
@@ -0,0 +1,260 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP points the mail config at a listener that takes every message
+// without TLS or auth and hands it over on the returned channel
+func fakeSMTP(t *testing.T) <-chan string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+
+	saved := config.SMTP
+	config.SMTP = SMTPConfig{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, From: "wiki@example.org"}
+	t.Cleanup(func() { config.SMTP = saved })
+	return messages
+}
+
+func serveSMTP(conn net.Conn, messages chan<- string) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				line, err := in.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			messages <- msg.String()
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not here")
+		}
+	}
+}
+
+// withBaseURL sets baseURL for one test
+func withBaseURL(t *testing.T, base string) {
+	saved := config.BaseURL
+	config.BaseURL = base
+	t.Cleanup(func() { config.BaseURL = saved })
+}
+
+var resetLinkRegex = regexp.MustCompile(`https://wiki\.example\.org(/reset\?token=\S+)`)
+
+// requestResetLink asks for a reset of account and returns the path of the
+// link that was mailed
+func requestResetLink(t *testing.T, ts *httptest.Server, client *http.Client, messages <-chan string, account string) string {
+	t.Helper()
+	status, _ := submit(t, client, ts.URL+"/reset", ts.URL+"/reset", url.Values{"account": {account}})
+	if status != http.StatusOK {
+		t.Fatalf("asking for a reset: status %d", status)
+	}
+	select {
+	case msg := <-messages:
+		match := resetLinkRegex.FindStringSubmatch(msg)
+		if match == nil {
+			t.Fatalf("no reset link on the base URL in:\n%s", msg)
+		}
+		return match[1]
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset mail was sent")
+	}
+	return ""
+}
+
+// resetPassword sets a new password through the link at path
+func resetPassword(t *testing.T, ts *httptest.Server, client *http.Client, path string, password string) (int, string) {
+	t.Helper()
+	token, _ := url.ParseQuery(strings.TrimPrefix(path, "/reset?"))
+	return submit(t, client, ts.URL+"/reset", ts.URL+"/reset", url.Values{
+		"token":    {token.Get("token")},
+		"password": {password},
+		"confirm":  {password},
+	})
+}
+
+func TestResetLinkWorksOnce(t *testing.T) {
+	messages := fakeSMTP(t)
+	withBaseURL(t, "https://wiki.example.org")
+	ts, client := newTestServer(t)
+	testUser(t, "reset-once", "first-password-1", "editor", "once@example.org")
+
+	link := requestResetLink(t, ts, client, messages, "reset-once")
+	if status, body := resetPassword(t, ts, client, link, "second-password-2"); status != http.StatusOK || !strings.Contains(body, "Your password has been changed") {
+		t.Fatalf("first use: status %d", status)
+	}
+	if id, _, err := Authenticate("reset-once", "second-password-2"); err != nil || id == 0 {
+		t.Fatalf("the new password doesn't work: %v", err)
+	}
+	if status, _ := resetPassword(t, ts, client, link, "third-password-3"); status != http.StatusNotFound {
+		t.Fatalf("second use: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestResetLinkExpires(t *testing.T) {
+	fakeSMTP(t)
+	withBaseURL(t, "https://wiki.example.org")
+	ts, client := newTestServer(t)
+	id := testUser(t, "reset-expired", "first-password-1", "editor", "expired@example.org")
+
+	var passwordHash string
+	if err := authDB.QueryRow("SELECT password FROM Users WHERE id = ?", id).Scan(&passwordHash); err != nil {
+		t.Fatal(err)
+	}
+	payload := fmt.Sprintf("%d.%d", id, time.Now().Add(-time.Minute).Unix())
+	token := payload + "." + resetSignature(payload, passwordHash)
+	if status, _ := get(t, client, ts.URL+"/reset?token="+token); status != http.StatusNotFound {
+		t.Fatalf("expired link: status %d, want %d", status, http.StatusNotFound)
+	}
+	if status, _ := get(t, client, ts.URL+"/reset?token="+resetToken(id, passwordHash)); status != http.StatusOK {
+		t.Fatalf("fresh link: status %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestResetLinkDiesWithPasswordChange(t *testing.T) {
+	messages := fakeSMTP(t)
+	withBaseURL(t, "https://wiki.example.org")
+	ts, client := newTestServer(t)
+	id := testUser(t, "reset-changed", "first-password-1", "editor", "changed@example.org")
+
+	link := requestResetLink(t, ts, client, messages, "changed@example.org")
+	if err := setPassword(id, "changed-password-2", false); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := resetPassword(t, ts, client, link, "third-password-3"); status != http.StatusNotFound {
+		t.Fatalf("link after a password change: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestNoMailWithoutBaseURL(t *testing.T) {
+	messages := fakeSMTP(t)
+	withBaseURL(t, "")
+	ts, client := newTestServer(t)
+	testUser(t, "reset-nobase", "first-password-1", "editor", "nobase@example.org")
+
+	if mailEnabled() {
+		t.Fatal("mail is enabled without a base URL")
+	}
+	if status, _ := get(t, client, ts.URL+"/reset"); status != http.StatusNotFound {
+		t.Fatalf("/reset: status %d, want %d", status, http.StatusNotFound)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/reset", strings.NewReader("account=reset-nobase"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Host = "evil.example.com"
+	resetHandler(httptest.NewRecorder(), req)
+	select {
+	case msg := <-messages:
+		t.Fatalf("mail sent without a base URL:\n%s", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestInviteLinkWorksOnce(t *testing.T) {
+	withBaseURL(t, "https://wiki.example.org")
+	ts, client := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/users", strings.NewReader("group=editor"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Host = "evil.example.com"
+	message, status := inviteAccount(req)
+	match := regexp.MustCompile(`https://wiki\.example\.org/register\?invite=(\S+)`).FindStringSubmatch(message)
+	if status != http.StatusOK || match == nil {
+		t.Fatalf("invite: status %d, %q", status, message)
+	}
+	register := func(username string) int {
+		status, _ := submit(t, client, ts.URL+"/login", ts.URL+"/register", url.Values{
+			"invite":   {match[1]},
+			"username": {username},
+			"password": {"invited-password-1"},
+			"confirm":  {"invited-password-1"},
+		})
+		return status
+	}
+	if status := register("invited-one"); status != http.StatusOK {
+		t.Fatalf("first use: status %d", status)
+	}
+	t.Cleanup(func() { authDB.Exec("DELETE FROM Users WHERE username = 'invited-one'") })
+	if findUsername("invited-one") == "" {
+		t.Fatal("the invited account wasn't created")
+	}
+	if status := register("invited-two"); status != http.StatusNotFound {
+		t.Fatalf("second use: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestInviteLinkExpires(t *testing.T) {
+	ts, client := newTestServer(t)
+	token, err := createInvite("editor", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authDB.Exec("UPDATE Invites SET expires_at = datetime('now', '-1 minute') WHERE token_hash = ?", hashInviteToken(token)); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get(t, client, ts.URL+"/register?invite="+token); status != http.StatusNotFound {
+		t.Fatalf("expired invite: status %d, want %d", status, http.StatusNotFound)
+	}
+}
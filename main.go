@@ -19,10 +19,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"html/template"
 
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -46,7 +49,7 @@ var allowedPaths = []string{
 	"savecat", "save", "title", "login", "loginPost", "logout", "Category", "Special",
 }
 
-var validPath = regexp.MustCompile("^/(" + strings.Join(allowedPaths, "|") + `)(?:/([^/?#]+))?$`)
+var validPath = regexp.MustCompile("^/(" + strings.Join(allowedPaths, "|") + `)(?:/([^?#]+))?$`)
 
 func viewHandler(w http.ResponseWriter, r *http.Request, title string, userAgent string) {
 	path := r.URL.Path
@@ -68,35 +71,40 @@ func viewHandler(w http.ResponseWriter, r *http.Request, title string, userAgent
 
 	case category == "":
 		log.Info("No title/category given. Falling back to Main_Page.")
+		if !requireReadable(w, r, "Main_Page") {
+			return
+		}
 		renderOrRedirect(w, r, "Main_Page", userAgent)
 
-	case strings.HasPrefix(category, "Help:"):
-		handleHelpPage(w, r, category, userAgent)
+	case strings.HasPrefix(category, "Help-"):
+		// Help pages were stored as Help-<name> before namespaces
+		http.Redirect(w, r, "/title/Help:"+strings.TrimPrefix(category, "Help-"), http.StatusMovedPermanently)
 
 	case strings.HasPrefix(category, "Special:Random"):
 		handleRandomPage(w, r)
 
-	case strings.HasPrefix(category, "Special:"):
-		handleSpecialPage(w, r, category, userAgent)
-
-	case strings.Contains(category, ":"):
-		handleCategoryPage(w, r, title, category, userAgent)
-
 	default:
-		renderOrRedirect(w, r, title, userAgent)
+		ns, _ := splitTitle(category)
+		if ns.ID != NamespaceSpecial && !requireReadable(w, r, canonicalizeTitle(category)) {
+			return
+		}
+		switch ns.ID {
+		case NamespaceSpecial:
+			handleSpecialPage(w, r, category, userAgent)
+		case NamespaceCategory:
+			handleCategoryPage(w, r, title, category, userAgent)
+		case NamespaceFile:
+			handleFilePage(w, r, category, userAgent)
+		case NamespaceTalk:
+			handleTalkPage(w, r, title, userAgent)
+		case NamespaceUser:
+			handleUserPage(w, r, title, userAgent)
+		default:
+			renderOrRedirect(w, r, canonicalizeTitle(title), userAgent)
+		}
 	}
 }
 
-func handleHelpPage(w http.ResponseWriter, r *http.Request, category, userAgent string) {
-	specialPageName := strings.TrimSpace(strings.TrimPrefix(category, "Help:"))
-	p, err := loadPage("Help-"+specialPageName, userAgent)
-	if err != nil {
-		log.WithError(err).WithField("page", specialPageName).Error("Help page not found")
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-	renderTemplate(w, "title", p)
-}
 func handleRandomPage(w http.ResponseWriter, r *http.Request) {
 	db, err := db.LoadDatabase()
 	if err != nil {
@@ -106,17 +114,67 @@ func handleRandomPage(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	var title string
-	if err := db.QueryRow("SELECT title FROM Pages ORDER BY RANDOM() LIMIT 1").Scan(&title); err != nil {
-		log.Warn("No pages found for random redirect")
+	rows, err := db.Query("SELECT title FROM Pages WHERE namespace = ? ORDER BY RANDOM()", NamespaceMain)
+	if err != nil {
+		log.WithError(err).Error("Failed to pick a random page")
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/title/"+title, http.StatusFound)
+	defer rows.Close()
+	access := readAccessFor(r)
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			log.WithError(err).Error("Failed to pick a random page")
+			break
+		}
+		if access.canRead(title) {
+			http.Redirect(w, r, "/title/"+title, http.StatusFound)
+			return
+		}
+	}
+	log.Warn("No pages found for random redirect")
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 func handleSpecialPage(w http.ResponseWriter, r *http.Request, category, userAgent string) {
 	specialPageName := strings.TrimSpace(strings.TrimPrefix(category, "Special:"))
-	p, err := loadPageSpecial(specialPageName, userAgent)
+
+	var p *Page
+	var err error
+	switch specialPageName {
+	case "AllPages":
+		p, err = loadAllPages(r, userAgent)
+	case "Contributions":
+		p, err = loadContributions(r, "", userAgent)
+	case "ListFiles":
+		p, err = loadListFiles(r, userAgent)
+	case "UnusedFiles":
+		p, err = loadUnusedFiles(userAgent)
+	case "CategoryTree":
+		p, err = loadCategoryTree(r, userAgent)
+	case "CategoryCycles":
+		p, err = loadCategoryCycles(r, userAgent)
+	case "WantedCategories":
+		p, err = loadWantedCategories(r, userAgent)
+	case "Log":
+		p, err = loadLog(r, r.URL.Query().Get("type"), userAgent)
+	case "Undelete":
+		if !can(r, PermDelete) {
+			http.Redirect(w, r, "/error", http.StatusFound)
+			return
+		}
+		p, err = loadUndelete(r, userAgent)
+	default:
+		if logType, ok := strings.CutPrefix(specialPageName, "Log/"); ok {
+			p, err = loadLog(r, logType, userAgent)
+			break
+		}
+		if username, ok := strings.CutPrefix(specialPageName, "Contributions/"); ok {
+			p, err = loadContributions(r, username, userAgent)
+			break
+		}
+		p, err = loadPageSpecial(r, specialPageName, userAgent)
+	}
 	if err != nil {
 		log.WithError(err).WithField("page", specialPageName).Error("Special page error")
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -124,6 +182,17 @@ func handleSpecialPage(w http.ResponseWriter, r *http.Request, category, userAge
 	}
 	renderTemplate(w, "title", p)
 }
+func handleFilePage(w http.ResponseWriter, r *http.Request, title, userAgent string) {
+	_, name := splitTitle(title)
+	p, err := loadFilePage(r, sanitizeFileName(name), userAgent)
+	if err != nil {
+		log.WithError(err).WithField("file", name).Error("File page not found")
+		http.Redirect(w, r, "/title/Special:ListFiles", http.StatusFound)
+		return
+	}
+	renderTemplate(w, "title", p)
+}
+
 func handleCategoryPage(w http.ResponseWriter, r *http.Request, title, category, userAgent string) {
 	parts := strings.SplitN(category, ":", 2)
 	if len(parts) < 2 {
@@ -131,7 +200,7 @@ func handleCategoryPage(w http.ResponseWriter, r *http.Request, title, category,
 		return
 	}
 	categoryName := strings.TrimSpace(parts[1])
-	p, err := loadPageCategory(categoryName, userAgent)
+	p, err := loadPageCategory(r, categoryName, userAgent)
 
 	if err != nil {
 		log.WithError(err).WithField("category", categoryName).Error("Failed to load category")
@@ -160,71 +229,99 @@ func editHandler(w http.ResponseWriter, r *http.Request, title string, userAgent
 	} else {
 		size = "<div class=\"col-12 d-block d-sm-none\">"
 	}
-	category := r.URL.Path[len("/title/"):]
-
-	switch {
-	case strings.Contains(category, ":"):
-		categoryParts := strings.Split(category, ":")
-		categoryName := strings.TrimSpace(categoryParts[1])
+	ns, name := splitTitle(title)
+
+	switch ns.ID {
+	case NamespaceSpecial, NamespaceFile:
+		// generated pages and uploads have no wikitext to edit
+		http.Redirect(w, r, "/title/"+title, http.StatusFound)
+	case NamespaceCategory:
+		categoryName := strings.TrimSpace(name)
 		log.Debug("Category:", categoryName)
-
-		session, _ := store.Get(r, "cookie-name")
-		auth, ok := session.Values["authenticated"].(bool)
-
-		if !ok || !auth {
-			//http.Error(w, "Forbidden", http.StatusForbidden)
-			http.Redirect(w, r, "/error", http.StatusFound)
+		if !requireReadable(w, r, "Category:"+categoryName) {
+			return
+		}
+		if ok, p := canEditTitle(r, "Category:"+categoryName); !ok {
+			denyProtected(w, r, "Category:"+categoryName, p)
 			return
-		} else {
+		}
 
-			ep, err := loadCategoryNoHtml(categoryName, userAgent)
+		ep, err := loadCategoryNoHtml(categoryName, userAgent)
 
-			if err != nil {
-				ep = &EditPage{CTitle: categoryName, Title: categoryName, Size: template.HTML(size), UpdatedDate: updated_at}
-			}
-			renderEditPageTemplate(w, "editCategory", ep)
+		if err != nil {
+			ep = &EditPage{CTitle: categoryName, Title: categoryName, Size: template.HTML(size), UpdatedDate: updated_at}
 		}
+		ep.CSRF = csrfToken(r)
+		renderEditPageTemplate(w, "editCategory", ep)
 	default:
-
-		// check our user is logged in
-		session, _ := store.Get(r, "cookie-name")
-		auth, ok := session.Values["authenticated"].(bool)
-
-		if !ok || !auth {
-			//http.Error(w, "Forbidden", http.StatusForbidden)
-			http.Redirect(w, r, "/error", http.StatusFound)
+		title = canonicalizeTitle(title)
+		if !requireReadable(w, r, title) {
 			return
-		} else {
-
-			ep, err := loadPageNoHtml(title, userAgent)
-			if err != nil {
-				safeMenu, _ := loadMenu()
-				ep = &EditPage{
-					NavTitle:    config.SiteTitle,
-					ThemeColor:  template.HTML(arcWikiLogo()),
-					CTitle:      removeUnderscores(title),
-					Title:       title,
-					Body:        template.HTML(""),
-					Menu:        safeMenu,
-					Size:        template.HTML(size),
-					UpdatedDate: "Not yet created",
-				}
-			}
+		}
+		if ok, p := canEditTitle(r, title); !ok {
+			denyProtected(w, r, title, p)
+			return
+		}
 
-			renderEditPageTemplate(w, "edit", ep)
+		ep, err := loadPageNoHtml(title, userAgent)
+		if err != nil {
+			if !can(r, PermCreate) {
+				http.Redirect(w, r, "/error", http.StatusFound)
+				return
+			}
+			safeMenu, _ := loadMenu()
+			ep = &EditPage{
+				NavTitle:    config.SiteTitle,
+				ThemeColor:  template.HTML(arcWikiLogo()),
+				CTitle:      removeUnderscores(title),
+				Title:       title,
+				Body:        template.HTML(""),
+				Menu:        safeMenu,
+				Size:        template.HTML(size),
+				UpdatedDate: "Not yet created",
+			}
 		}
+
+		ep.CSRF = csrfToken(r)
+		renderEditPageTemplate(w, "edit", ep)
 	}
 }
 
 func saveCatHandler(w http.ResponseWriter, r *http.Request, title string, userAgent string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireReadable(w, r, "Category:"+title) {
+		return
+	}
+	if ok, p := canEditTitle(r, "Category:"+title); !ok {
+		denyProtected(w, r, "Category:"+title, p)
+		return
+	}
 	body := r.FormValue("body")
 
 	p := &Page{Title: title, Body: template.HTML(body)}
-	err := p.saveCat()
-	if err != nil {
+	err := p.saveCat(currentUserID(r))
+	var cycleErr *CategoryCycleError
+	if errors.As(err, &cycleErr) {
+		// send the user back to their edit with the reason it was refused
+		ep, loadErr := loadCategoryNoHtml(title, userAgent)
+		if loadErr != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		ep.Body = template.HTML(body)
+		ep.Error = err.Error()
+		w.WriteHeader(http.StatusConflict)
+		ep.CSRF = csrfToken(r)
+		renderEditPageTemplate(w, "editCategory", ep)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	writeLog(r, "category", "edit", currentUsername(r), "Category:"+title, "", "")
 	http.Redirect(w, r, "/title/Special:Categories", http.StatusFound)
 }
 
@@ -259,81 +356,102 @@ func makeHandler(fn func(http.ResponseWriter, *http.Request, string, string)) ht
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the resource type and title using strings.SplitN
 
-	session, _ := store.Get(r, "cookie-name")
-	auth, ok := session.Values["authenticated"].(bool)
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/delete/"), "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "Invalid URL format", http.StatusBadRequest)
+		return
+	}
+	resourceType := parts[0]
+	title := parts[1]
 
-	if !ok || !auth {
-		//http.Error(w, "Forbidden", http.StatusForbidden)
+	targets := map[string]string{"page": title, "category": "Category:" + title, "file": "File:" + title}
+	target, ok := targets[resourceType]
+	if !ok {
+		// Handle invalid resource type
 		http.Redirect(w, r, "/error", http.StatusFound)
 		return
+	}
+
+	// Nothing is deleted until the confirmation form is posted back with a reason
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "title", newSpecialPage("Delete "+removeUnderscores(target), deleteConfirmForm(r, resourceType, title, ""), getUserAgent(r)))
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		renderTemplate(w, "title", newSpecialPage("Delete "+removeUnderscores(target), deleteConfirmForm(r, resourceType, title, "Please give a reason for the deletion."), getUserAgent(r)))
+		return
+	}
+
+	// Handle deletion based on resource type
+	var err error
+	redirect := "/admin/manage"
+	switch resourceType {
+	case "page":
+		p := &Page{Title: title}
+		err = p.deletePage(currentUserID(r))
+	case "category":
+		cat := &Category{Title: title}
+		err = cat.deleteCategory(currentUserID(r))
+	case "file":
+		err = deleteFile(title)
+		redirect = "/title/Special:UnusedFiles"
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeLog(r, "delete", "delete", currentUsername(r), target, reason, "")
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// deleteConfirmForm asks for a reason before anything is deleted
+func deleteConfirmForm(r *http.Request, resourceType string, title string, message string) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`<h2 class="wikih2">Delete %s: %s</h2>`, resourceType, html.EscapeString(removeUnderscores(title))))
+	if message != "" {
+		b.WriteString(fmt.Sprintf(`<p style="color:red">%s</p>`, html.EscapeString(message)))
+	}
+	if resourceType == "file" {
+		b.WriteString(`<p>The file will be removed from storage. This cannot be undone.</p>`)
 	} else {
-		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/delete/"), "/", 2)
-		if len(parts) != 2 {
-			http.Error(w, "Invalid URL format", http.StatusBadRequest)
-			return
-		}
-		resourceType := parts[0]
-		title := parts[1]
-
-		// Handle deletion based on resource type
-		if resourceType == "page" {
-			// Handle deletion of a page
-			p := &Page{Title: title}
-			err := p.deletePage()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			http.Redirect(w, r, "/admin/manage", http.StatusFound)
-		} else if resourceType == "category" {
-			// Handle deletion of a category
-			cat := &Category{Title: title}
-			err := cat.deleteCategory()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			http.Redirect(w, r, "/admin/manage", http.StatusFound)
-		} else {
-			// Handle invalid resource type
-			//http.Error(w, "Invalid resource type", http.StatusBadRequest)
-			http.Redirect(w, r, "/error", http.StatusFound)
-		}
+		b.WriteString(`<p>It will be moved to the trash, where it can be restored from <a href="/title/Special:Undelete">Special:Undelete</a>.</p>`)
 	}
+	b.WriteString(fmt.Sprintf(`<form action="/delete/%s/%s" method="POST">
+        %s
+        <div class="form-group">
+          <label for="reason">Reason:</label>
+          <input class="form-control" type="text" id="reason" name="reason" required autofocus>
+        </div>
+        <button class="bg-dark hover:bg-gray-100 text-white font-semibold py-2 px-4 border border-gray-400 rounded shadow" type="submit">Delete</button>
+        <a href="/admin">Cancel</a>
+    </form>`, resourceType, url.PathEscape(title), csrfInput(r)))
+	return b.String()
 }
 
 func addHandler(w http.ResponseWriter, r *http.Request) {
-	// check our user is logged in
-	session, _ := store.Get(r, "cookie-name")
-	auth, ok := session.Values["authenticated"].(bool)
+	detect := mobiledetect.New(r, nil)
+	size := ""
+	if detect.IsMobile() || detect.IsTablet() {
+		//fmt.Println("is either a mobile or tablet")
 
-	if !ok || !auth {
-		http.Redirect(w, r, "/error", http.StatusFound)
-		//http.Error(w, "Forbidden", http.StatusForbidden)
-		return
+		size = "<div class=\"col-12 d-block d-sm-none\">"
 	} else {
-		detect := mobiledetect.New(r, nil)
-		size := ""
-		if detect.IsMobile() || detect.IsTablet() {
-			//fmt.Println("is either a mobile or tablet")
-
-			size = "<div class=\"col-12 d-block d-sm-none\">"
-		} else {
-			size = "<div class=\"col-11 d-none d-sm-block\">"
-		}
+		size = "<div class=\"col-11 d-none d-sm-block\">"
+	}
 
-		title := ""
-		safeMenu, err := loadMenu()
-		if err != nil {
-			log.Error("Error Loading Menu:", err)
-		}
-		// Create an AddPage instance directly (no loading from file)
-		ap := &AddPage{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: "Add Page", Title: title, Menu: safeMenu, Size: template.HTML(size), UpdatedDate: ""}
+	title := ""
+	safeMenu, err := loadMenu()
+	if err != nil {
+		log.Error("Error Loading Menu:", err)
+	}
+	// Create an AddPage instance directly (no loading from file)
+	ap := &AddPage{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: "Add Page", Title: title, Menu: safeMenu, Size: template.HTML(size), UpdatedDate: "", CSRF: csrfToken(r)}
 
-		// Populate other fields of ap as needed (e.g., from session data, user input, etc.)
+	// Populate other fields of ap as needed (e.g., from session data, user input, etc.)
 
-		renderAddPageTemplate(w, "add", ap)
-	}
+	renderAddPageTemplate(w, "add", ap)
 }
 
 // Error page needs to be used
@@ -346,7 +464,7 @@ func errorPage(w http.ResponseWriter, r *http.Request) {
 	} else {
 		userAgent = Desktop
 	}
-	p, err := loadPageSpecial("specialPageName", userAgent)
+	p, err := loadPageSpecial(r, "specialPageName", userAgent)
 	if err != nil {
 		http.Error(w, "Error loading HTML file", http.StatusInternalServerError)
 		return
@@ -405,9 +523,38 @@ func renderAddPageTemplate(w http.ResponseWriter, tmpl string, ap *AddPage) {
 }
 
 type Config struct {
-	SiteTitle string     `json:"siteTitle"`
-	TColor    string     `json:"TColor"`
-	Menu      []MenuItem `json:"menu"`
+	SiteTitle         string     `json:"siteTitle"`
+	TColor            string     `json:"TColor"`
+	Menu              []MenuItem `json:"menu"`
+	TrashPurgeDays    int        `json:"trashPurgeDays"`
+	TrustProxyHeaders bool       `json:"trustProxyHeaders"`
+	// where the wiki is reached from outside, e.g. https://wiki.example.org,
+	// links in emails and invites start with it instead of the Host header
+	BaseURL string `json:"baseURL"`
+	// create a category the first time a page is tagged with it instead of
+	// listing it on Special:WantedCategories
+	AutoCreateCategories bool `json:"autoCreateCategories"`
+	// extra namespaces on top of the builtin ones, ids from 100 up
+	Namespaces []Namespace `json:"namespaces"`
+	// group name to the permissions it grants, "anonymous" is visitors who
+	// aren't logged in. Left out, the builtin reader/editor/moderator/admin apply
+	Groups map[string][]string `json:"groups"`
+	// namespace name ("Main" for none) to the group needed to edit in it
+	NamespaceProtection map[string]string `json:"namespaceProtection"`
+	// namespace ("Main" for none) or category name to the groups that may
+	// read the pages in it, everyone else doesn't see them anywhere
+	PrivateNamespaces map[string][]string `json:"privateNamespaces"`
+	PrivateCategories map[string][]string `json:"privateCategories"`
+	// account requests and invite links from /register
+	Registration Registration `json:"registration"`
+	// rules for new passwords
+	PasswordPolicy PasswordPolicy `json:"passwordPolicy"`
+	// outgoing mail for password resets
+	SMTP SMTPConfig `json:"smtp"`
+	// authenticator app codes at login
+	TwoFactor TwoFactor `json:"twoFactor"`
+	// single sign-on through an OpenID Connect provider
+	OIDC OIDC `json:"oidc"`
 }
 
 type Admin struct {
@@ -422,6 +569,9 @@ type MenuItem struct {
 
 var config Config
 
+// configPath is read once at startup and written by /admin/config
+const configPath = "config/config.json"
+
 func loadMenu() (template.HTML, error) {
 	var links strings.Builder
 
@@ -450,6 +600,31 @@ func main() {
 		log.Fatalf("Auth DB init error: %v", err)
 	}
 
+	// Load site configuration, the password policy applies to the seeded admin
+	configBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		log.Panic("Error reading "+configPath+":", err)
+	}
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		log.Panic("Error parsing config:", err)
+	}
+
+	loadNamespaces(config.Namespaces)
+	loadGroups(config.Groups)
+	checkPrivateConfig()
+	if err := assignNamespaces(); err != nil {
+		log.Error("Error assigning namespaces:", err)
+	}
+
+	// Maintenance: "arcwiki reindex" rebuilds the category and file links then
+	// exits, after the config so links come out the same as on a live save
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		if err := reindex(); err != nil {
+			log.Fatalf("Reindex failed: %v", err)
+		}
+		return
+	}
+
 	// Seed a single admin on first run
 	var userCount int
 	if err := authDB.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount); err != nil {
@@ -461,69 +636,110 @@ func main() {
 		adminPass := os.Getenv("PASSWORD")
 		if adminUser == "" || adminPass == "" {
 			log.Warn("No USERNAME/PASSWORD env vars found; defaulting to admin/admin")
+			if err := insertUser("admin", "admin", true); err != nil {
+				log.Fatalf("Seeding admin user failed: %v", err)
+			}
+			if _, err := authDB.Exec("UPDATE Users SET must_change_password = 1 WHERE username = 'admin'"); err != nil {
+				log.Fatalf("Seeding admin user failed: %v", err)
+			}
 			adminUser = "admin"
-			adminPass = "admin"
-		}
-		if err := CreateUser(adminUser, adminPass, true); err != nil {
+		} else if err := CreateUser(adminUser, adminPass, true); err != nil {
 			log.Fatalf("Seeding admin user failed: %v", err)
 		}
+		writeLog(nil, "user", "create", "", adminUser, "seeded admin account", "")
 		log.Infof("Seeded admin user '%s' (admin)", adminUser)
 	}
 
-	// Load site configuration
-	configBytes, err := os.ReadFile("config/config.json")
-	if err != nil {
-		log.Panic("Error reading config/config.json:", err)
-	}
-	if err := json.Unmarshal(configBytes, &config); err != nil {
-		log.Panic("Error parsing config:", err)
-	}
+	logConfigChange(nil, configBytes)
 	if os.Getenv("COLOR") != "" {
 		config.TColor = os.Getenv("COLOR")
 	}
 	if os.Getenv("SITENAME") != "" {
 		config.SiteTitle = os.Getenv("SITENAME")
 	}
+	if os.Getenv("BASE_URL") != "" {
+		config.BaseURL = os.Getenv("BASE_URL")
+	}
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	if config.SMTP.Host != "" && config.BaseURL == "" {
+		log.Warn("smtp is set but baseURL isn't, no mail will be sent")
+	}
+
+	// Empty the trash of anything deleted more than trashPurgeDays ago
+	if config.TrashPurgeDays > 0 {
+		go func() {
+			for {
+				if err := purgeArchive(config.TrashPurgeDays); err != nil {
+					log.Error("Error purging archive:", err)
+				}
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
 
-	// Background updater
+	// Forget expired sessions
 	go func() {
 		for {
-			if err := updateSubCategoryLinks(); err != nil {
-				log.Error("Error updating subcategories:", err)
+			if err := purgeSessions(); err != nil {
+				log.Error("Error purging sessions:", err)
 			}
-			time.Sleep(60 * time.Second)
+			time.Sleep(time.Hour)
 		}
 	}()
 
-	// HTTP routes
-	http.HandleFunc("/admin", requireLogin(func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	log.Fatal(http.ListenAndServe(":8080", csrfProtect(mux)))
+}
+
+// registerRoutes adds every route, each behind the permission from the groups
+// matrix it needs
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin", requirePermission(PermEdit, func(w http.ResponseWriter, r *http.Request) {
 		adminHandler(w, r, "", getUserAgent(r))
 	}))
 
 	// Handle /admin/page and /admin/category
-	http.HandleFunc("/admin/", requireLogin(makeHandler(adminHandler)))
-	http.HandleFunc("/", makeHandler(viewHandler))
-	http.HandleFunc("/search", makeHandler(SearchHandler))
-	http.HandleFunc("/query", QueryHandler)
-	http.HandleFunc("/add", addHandler)
-	http.HandleFunc("/addpage", addPage)
-	http.HandleFunc("/delete/", deleteHandler)
-	http.HandleFunc("/category/", addCat)
-	http.HandleFunc("/savecat/", makeHandler(saveCatHandler))
-
-	http.HandleFunc("/logout", makeHandler(logout))
-	http.HandleFunc("/logout/", makeHandler(logout)) // handle trailing slash
-
-	http.HandleFunc("/login", makeHandler(loginFormHandler))
-	http.HandleFunc("/loginPost", makeHandler(loginHandler))
-	http.HandleFunc("/title/", makeHandler(viewHandler))
-	http.HandleFunc("/edit/", makeHandler(editHandler))
-	http.HandleFunc("/save/", makeHandler(saveHandler))
-	http.HandleFunc("/error", errorPage)
+	mux.HandleFunc("/admin/", requirePermission(PermEdit, makeHandler(adminHandler)))
+	mux.HandleFunc("/admin/users", requirePermission(PermManageUsers, usersHandler))
+	mux.HandleFunc("/admin/config", requirePermission(PermEditConfig, configHandler))
+	mux.HandleFunc("/", requirePermission(PermRead, makeHandler(viewHandler)))
+	mux.HandleFunc("/search", requirePermission(PermRead, makeHandler(SearchHandler)))
+	mux.HandleFunc("/query", requirePermission(PermRead, QueryHandler))
+	mux.HandleFunc("/add", requirePermission(PermCreate, addHandler))
+	mux.HandleFunc("/addpage", requirePermission(PermCreate, addPage))
+	mux.HandleFunc("/delete/", requirePermission(PermDelete, deleteHandler))
+	mux.HandleFunc("/move/", requirePermission(PermMove, moveHandler))
+	mux.HandleFunc("/category/", requirePermission(PermCreate, addCat))
+	mux.HandleFunc("/savecat/", requirePermission(PermEdit, makeHandler(saveCatHandler)))
+	mux.HandleFunc("/upload", requirePermission(PermUpload, uploadHandler))
+	mux.HandleFunc("/talk/", requirePermission(PermEdit, talkPostHandler))
+	mux.HandleFunc("/undelete/", requirePermission(PermDelete, undeleteHandler))
+	mux.HandleFunc("/protect/", requirePermission(PermProtect, protectHandler))
+	mux.HandleFunc("/files/", requirePermission(PermRead, serveFile))
+	mux.HandleFunc("/diff/", requirePermission(PermRead, diffHandler))
+	mux.HandleFunc("/api/log", requirePermission(PermManageUsers, logExportHandler))
+	mux.HandleFunc("/api/category/", requirePermission(PermRead, categoryAPIHandler))
+
+	mux.HandleFunc("/logout", makeHandler(logout))
+	mux.HandleFunc("/logout/", makeHandler(logout)) // handle trailing slash
+
+	mux.HandleFunc("/login", makeHandler(loginFormHandler))
+	mux.HandleFunc("/loginPost", makeHandler(loginHandler))
+	mux.HandleFunc("/register", registerHandler)
+	mux.HandleFunc("/reset", resetHandler)
+	mux.HandleFunc("/account", accountHandler)
+	mux.HandleFunc("/account/2fa", twoFactorHandler)
+	mux.HandleFunc("/account/sessions", sessionsHandler)
+	mux.HandleFunc("/login/2fa", twoFactorLoginHandler)
+	mux.HandleFunc("/login/oidc", oidcLoginHandler)
+	mux.HandleFunc("/login/oidc/callback", oidcCallbackHandler)
+	mux.HandleFunc("/title/", requirePermission(PermRead, makeHandler(viewHandler)))
+	mux.HandleFunc("/edit/", requirePermission(PermEdit, makeHandler(editHandler)))
+	mux.HandleFunc("/save/", requirePermission(PermEdit, makeHandler(saveHandler)))
+	mux.HandleFunc("/error", errorPage)
 
 	// Static assets
 	fs := http.FileServer(http.Dir("./assets"))
-	http.Handle("/assets/", http.StripPrefix("/assets/", fs))
-
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	mux.Handle("/assets/", http.StripPrefix("/assets/", fs))
 }
@@ -0,0 +1,187 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/ArcWiki/ArcWiki/db"
+)
+
+// sourceDir is the package directory, the tests run somewhere else
+var sourceDir string
+
+// TestMain runs the tests against a fresh database in a scratch directory.
+// The templates are parsed before this, from the package directory
+func TestMain(m *testing.M) {
+	var err error
+	if sourceDir, err = os.Getwd(); err != nil {
+		panic(err)
+	}
+	dir, err := os.MkdirTemp("", "arcwiki-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	db.DBSetup()
+	if err := InitAuthDB("arcWiki.db"); err != nil {
+		panic(err)
+	}
+	loadNamespaces(nil)
+	loadGroups(nil)
+
+	code := m.Run()
+	authDB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestServer serves every route behind the same CSRF check as the real
+// server. Session cookies are Secure, so it is TLS
+func newTestServer(t *testing.T) (*httptest.Server, *http.Client) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	ts := httptest.NewTLSServer(csrfProtect(mux))
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ts.Client()
+	client.Jar = jar
+	return ts, client
+}
+
+var csrfRegex = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// get fetches a page and returns its status and body
+func get(t *testing.T, client *http.Client, target string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// submit posts form to target with the CSRF token from formPage
+func submit(t *testing.T, client *http.Client, formPage string, target string, form url.Values) (int, string) {
+	t.Helper()
+	_, page := get(t, client, formPage)
+	match := csrfRegex.FindStringSubmatch(page)
+	if match == nil {
+		t.Fatalf("no csrf token on %s", formPage)
+	}
+	form.Set("csrf_token", match[1])
+	resp, err := client.PostForm(target, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// testUser adds an approved account for the length of the test and returns its id
+func testUser(t *testing.T, username string, password string, group string, email string) int {
+	t.Helper()
+	id, err := addUser(username, password, group, email, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deleteAccount(id, "1") })
+	return id
+}
+
+// savePage stores a page as userID, the way a save from the edit form does
+func savePage(t *testing.T, title string, body string, userID int) {
+	t.Helper()
+	p := &Page{Title: title, Body: template.HTML(body)}
+	if err := p.save(userID); err != nil {
+		t.Fatalf("saving %s: %v", title, err)
+	}
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM CategoryPages WHERE page_id IN (SELECT id FROM Pages WHERE title = ?)", title)
+		authDB.Exec("DELETE FROM PendingCategoryLinks WHERE page_id IN (SELECT id FROM Pages WHERE title = ?)", title)
+		authDB.Exec("DELETE FROM Pages WHERE title = ?", title)
+		authDB.Exec("DELETE FROM Revisions WHERE title = ?", title)
+	})
+}
+
+// addCategory creates a category and saves body to it, the way Special:Categories
+// and the category edit form do, and returns its id
+func addCategory(t *testing.T, title string, body string) int {
+	t.Helper()
+	res, err := authDB.Exec("INSERT INTO Categories (title, body) VALUES (?, '')", title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM SubCategoryPages WHERE category_id = ? OR subcategory_id = ?", id, id)
+		authDB.Exec("DELETE FROM PendingCategoryLinks WHERE subcategory_id = ?", id)
+		authDB.Exec("DELETE FROM CategoryPages WHERE category_id = ?", id)
+		authDB.Exec("DELETE FROM Categories WHERE id = ?", id)
+	})
+	if body != "" {
+		if err := (&Page{Title: title, Body: template.HTML(body)}).saveCat(0); err != nil {
+			t.Fatalf("saving Category:%s: %v", title, err)
+		}
+	}
+	return int(id)
+}
+
+// insertFile records an upload without a file behind it
+func insertFile(t *testing.T, name string, size int64, userID int) {
+	t.Helper()
+	if _, err := authDB.Exec("INSERT INTO Files (name, size, mime_type, user_id) VALUES (?, ?, 'image/png', ?)", name, size, nullUserID(userID)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { authDB.Exec("DELETE FROM Files WHERE name = ?", name) })
+}
+
+// login signs client in through the login form
+func login(t *testing.T, ts *httptest.Server, client *http.Client, username string, password string) {
+	t.Helper()
+	status, body := submit(t, client, ts.URL+"/login", ts.URL+"/loginPost", url.Values{
+		"username": {username},
+		"password": {password},
+	})
+	if status != http.StatusOK || !regexp.MustCompile(`href="/logout"`).MatchString(body) {
+		t.Fatalf("logging in as %s: status %d", username, status)
+	}
+}
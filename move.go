@@ -0,0 +1,191 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// errTitleTaken is returned by movePage when the new title is already a page
+var errTitleTaken = errors.New("there is already a page with that title")
+
+// moveHandler shows the move form for /move/<title> and moves the page on POST
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	title := canonicalizeTitle(strings.TrimPrefix(r.URL.Path, "/move/"))
+	ns, _ := splitTitle(title)
+	if !ns.holdsPages() || ns.ID == NamespaceTalk {
+		http.Error(w, "Only pages can be moved, and talk pages move with their page", http.StatusBadRequest)
+		return
+	}
+	if !requireReadable(w, r, title) {
+		return
+	}
+	if !checkPageExistence(title) {
+		http.NotFound(w, r)
+		return
+	}
+	if ok, p := canMoveTitle(r, title); !ok {
+		denyProtected(w, r, title, p)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		renderMoveForm(w, r, title, "", "", http.StatusOK)
+		return
+	}
+
+	target := canonicalizeTitle(r.FormValue("target"))
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	targetNS, _ := splitTitle(target)
+	switch {
+	case target == "" || target == title:
+		renderMoveForm(w, r, title, target, "Choose a new title for the page.", http.StatusBadRequest)
+		return
+	case !targetNS.holdsPages() || targetNS.ID == NamespaceTalk:
+		renderMoveForm(w, r, title, target, fmt.Sprintf("Pages can't be moved into the %s namespace.", targetNS.Name), http.StatusBadRequest)
+		return
+	case !readAccessFor(r).canRead(target):
+		renderMoveForm(w, r, title, target, "You can't move a page to a title you can't read.", http.StatusForbidden)
+		return
+	}
+	if ok, p := canEditTitle(r, target); !ok {
+		renderMoveForm(w, r, title, target, fmt.Sprintf("%s is protected so that only the %s group can edit it.", removeUnderscores(target), p.Level), http.StatusForbidden)
+		return
+	}
+
+	talkMoved, err := movePage(title, target)
+	if errors.Is(err, errTitleTaken) {
+		renderMoveForm(w, r, title, target, fmt.Sprintf("There is already a page called %s.", removeUnderscores(target)), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Error("Error moving page:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+
+	details := "to " + target
+	if talkMoved {
+		details += ", with its talk page"
+	}
+	writeLog(r, "page", "move", currentUsername(r), title, reason, details)
+	log.Infof("%s moved %s to %s", currentUsername(r), title, target)
+	http.Redirect(w, r, "/title/"+url.PathEscape(target), http.StatusFound)
+}
+
+// renderMoveForm asks for the new title, message explains a refused move
+func renderMoveForm(w http.ResponseWriter, r *http.Request, title string, target string, message string, status int) {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`<h2 class="wikih2">Move <a href="/title/%s">%s</a></h2>`, url.PathEscape(title), html.EscapeString(removeUnderscores(title))))
+	if message != "" {
+		b.WriteString(alert("alert-danger", message))
+	}
+	b.WriteString(`<p>The page keeps its history, categories and protection, and its talk page moves with it. Links to the old title aren't changed.</p>`)
+	b.WriteString(fmt.Sprintf(`<form action="/move/%s" method="POST">
+        %s
+        <div class="mb-2"><label for="target">New title:</label> <input class="form-control" type="text" id="target" name="target" value="%s" required autofocus></div>
+        <div class="mb-2"><label for="reason">Reason:</label> <input class="form-control" type="text" id="reason" name="reason"></div>
+        <button class="btn btn-sm btn-outline-secondary" type="submit">Move</button>
+        <a href="/title/%s">Cancel</a>
+    </form>`, url.PathEscape(title), csrfInput(r), html.EscapeString(removeUnderscores(target)), url.PathEscape(title)))
+
+	w.WriteHeader(status)
+	renderTemplate(w, "title", newSpecialPage("Move "+removeUnderscores(title), b.String(), getUserAgent(r)))
+}
+
+// movePage renames a page along with its history and protection, and its
+// talk page too unless the new title already has one
+func movePage(from string, to string) (talkMoved bool, err error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return false, err
+	}
+	defer dbConn.Close()
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	pageID, err := pageIDInTx(tx, from)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("%s does not exist", from)
+	} else if err != nil {
+		return false, err
+	}
+	if _, err := pageIDInTx(tx, to); err == nil {
+		return false, errTitleTaken
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+	if err := renamePage(tx, pageID, from, to); err != nil {
+		return false, err
+	}
+
+	_, fromTalk, _ := talkPair(from)
+	_, toTalk, _ := talkPair(to)
+	talkID, err := pageIDInTx(tx, fromTalk)
+	if err == nil {
+		if _, err := pageIDInTx(tx, toTalk); err == sql.ErrNoRows {
+			if err := renamePage(tx, talkID, fromTalk, toTalk); err != nil {
+				return false, err
+			}
+			talkMoved = true
+		} else if err != nil {
+			return false, err
+		}
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	return talkMoved, tx.Commit()
+}
+
+func pageIDInTx(tx *sql.Tx, title string) (int, error) {
+	var id int
+	err := tx.QueryRow("SELECT id FROM Pages WHERE title = ?", title).Scan(&id)
+	return id, err
+}
+
+// renamePage gives a page a new title, its revisions are renamed with it so
+// the history reads as one page
+func renamePage(tx *sql.Tx, pageID int, from string, to string) error {
+	ns, _ := splitTitle(to)
+	for _, q := range []struct {
+		stmt string
+		args []interface{}
+	}{
+		{"UPDATE Pages SET title = ?, namespace = ? WHERE id = ?", []interface{}{to, ns.ID, pageID}},
+		{"UPDATE Revisions SET title = ? WHERE page_id = ?", []interface{}{to, pageID}},
+		{"UPDATE OR REPLACE PageProtections SET title = ? WHERE title = ?", []interface{}{to, from}},
+	} {
+		if _, err := tx.Exec(q.stmt, q.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
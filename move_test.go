@@ -0,0 +1,141 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cleanTitle removes whatever a move left behind under title
+func cleanTitle(t *testing.T, title string) {
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Pages WHERE title = ?", title)
+		authDB.Exec("DELETE FROM Revisions WHERE title = ?", title)
+		authDB.Exec("DELETE FROM PageProtections WHERE title = ?", title)
+	})
+}
+
+func TestMovePage(t *testing.T) {
+	modID := testUser(t, "Mod041", "mod-pass-041", "moderator", "")
+	savePage(t, "Old041", "first", modID)
+	savePage(t, "Old041", "second", modID)
+	savePage(t, "Talk:Old041", "about it", modID)
+	cleanTitle(t, "New041")
+	cleanTitle(t, "Talk:New041")
+	cleanTitle(t, "Old041")
+	if err := saveProtection("Old041", map[string]string{"edit": "moderator"}, sql.NullTime{}, "", modID); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Mod041", "mod-pass-041")
+	status, body := submit(t, client, ts.URL+"/move/Old041", ts.URL+"/move/Old041", url.Values{"target": {"New041"}, "reason": {"clearer"}})
+	if status != http.StatusOK || !strings.Contains(body, "second") {
+		t.Fatalf("move: status %d, want the page under its new title", status)
+	}
+	if pageExists(t, "Old041") || !pageExists(t, "New041") {
+		t.Fatal("the page wasn't renamed")
+	}
+	if pageExists(t, "Talk:Old041") || !pageExists(t, "Talk:New041") {
+		t.Fatal("the talk page didn't move with the page")
+	}
+	var revisions int
+	authDB.QueryRow("SELECT COUNT(*) FROM Revisions WHERE title = 'New041'").Scan(&revisions)
+	if revisions != 2 {
+		t.Errorf("%d revisions under the new title, want 2", revisions)
+	}
+	if p, _ := loadProtections("New041"); p["edit"].Level != "moderator" {
+		t.Error("the protection stayed behind")
+	}
+	var details string
+	authDB.QueryRow("SELECT details FROM Logs WHERE action = 'move' AND target = 'Old041' ORDER BY id DESC LIMIT 1").Scan(&details)
+	if details != "to New041, with its talk page" {
+		t.Errorf("log details %q", details)
+	}
+}
+
+func TestMoveRefusals(t *testing.T) {
+	modID := testUser(t, "Mod041b", "mod-pass-041b", "moderator", "")
+	testUser(t, "Ed041", "ed-pass-041", "editor", "")
+	savePage(t, "Stay041", "here", modID)
+	savePage(t, "Taken041", "already", modID)
+	savePage(t, "Locked041", "locked", modID)
+	if err := saveProtection("Locked041", map[string]string{"move": "admin"}, sql.NullTime{}, "", modID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { authDB.Exec("DELETE FROM PageProtections WHERE title = 'Locked041'") })
+	cleanTitle(t, "Elsewhere041")
+
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Mod041b", "mod-pass-041b")
+	status, body := submit(t, client, ts.URL+"/move/Stay041", ts.URL+"/move/Stay041", url.Values{"target": {"Taken041"}})
+	if status != http.StatusConflict || !strings.Contains(body, "There is already a page called Taken041") {
+		t.Errorf("moving onto an existing page: status %d", status)
+	}
+	if !pageExists(t, "Stay041") {
+		t.Error("a refused move renamed the page")
+	}
+
+	status, body = get(t, client, ts.URL+"/move/Locked041")
+	if status != http.StatusForbidden || !strings.Contains(body, "only the admin group can move it") {
+		t.Errorf("move protected page: status %d, want the protection notice", status)
+	}
+	if len(editRestrictions("Locked041")) != 0 {
+		t.Error("move protection also stopped editing")
+	}
+
+	_, editor := newTestServer(t)
+	login(t, ts, editor, "Ed041", "ed-pass-041")
+	if _, body := get(t, editor, ts.URL+"/move/Stay041"); strings.Contains(body, `name="target"`) {
+		t.Error("an editor without move got the move form")
+	}
+}
+
+func TestProtectionExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Time{
+		"1d": now.AddDate(0, 0, 1),
+		"1w": now.AddDate(0, 0, 7),
+		"1y": now.AddDate(1, 0, 0),
+	} {
+		got, err := expiryTime(value, now)
+		if err != nil || !got.Valid || !got.Time.Equal(want) {
+			t.Errorf("expiryTime(%q) = %v, %v", value, got, err)
+		}
+	}
+	if got, err := expiryTime("", now); err != nil || got.Valid {
+		t.Errorf(`expiryTime("") = %v, %v, want no expiry`, got, err)
+	}
+	if _, err := expiryTime("2d", now); err == nil {
+		t.Error("an unknown expiry was accepted")
+	}
+
+	past, _ := expiryTime("1d", time.Now().AddDate(0, 0, -2))
+	if err := saveProtection("Lapsed041", map[string]string{"edit": "admin", "move": "admin"}, past, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { authDB.Exec("DELETE FROM PageProtections WHERE title = 'Lapsed041'") })
+	if p, err := loadProtections("Lapsed041"); err != nil || len(p) != 0 {
+		t.Errorf("expired protections still apply: %v, %v", p, err)
+	}
+}
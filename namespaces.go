@@ -0,0 +1,300 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// Namespace is a title prefix such as Help: with the id stored in Pages.namespace
+type Namespace struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Namespace ids follow MediaWiki so exported titles mean the same thing there
+const (
+	NamespaceSpecial  = -1
+	NamespaceMain     = 0
+	NamespaceTalk     = 1
+	NamespaceUser     = 2
+	NamespaceProject  = 4
+	NamespaceFile     = 6
+	NamespaceTemplate = 10
+	NamespaceHelp     = 12
+	NamespaceCategory = 14
+)
+
+// custom namespaces from config.json must use ids from here up
+const firstCustomNamespace = 100
+
+var builtinNamespaces = []Namespace{
+	{NamespaceSpecial, "Special"},
+	{NamespaceMain, ""},
+	{NamespaceTalk, "Talk"},
+	{NamespaceUser, "User"},
+	{NamespaceProject, "Project"},
+	{NamespaceFile, "File"},
+	{NamespaceTemplate, "Template"},
+	{NamespaceHelp, "Help"},
+	{NamespaceCategory, "Category"},
+}
+
+// namespaces is the registry, the builtins plus any added by loadNamespaces
+var namespaces = builtinNamespaces
+
+// loadNamespaces adds the custom namespaces from config.json, skipping any
+// that would clash with one already registered
+func loadNamespaces(custom []Namespace) {
+	registry := append([]Namespace(nil), builtinNamespaces...)
+	for _, ns := range custom {
+		ns.Name = canonicalizeNamespaceName(ns.Name)
+		switch {
+		case ns.ID < firstCustomNamespace:
+			log.Warnf("Ignoring namespace %q: custom namespace ids start at %d", ns.Name, firstCustomNamespace)
+			continue
+		case ns.Name == "" || strings.Contains(ns.Name, ":"):
+			log.Warnf("Ignoring namespace %d: invalid name %q", ns.ID, ns.Name)
+			continue
+		}
+		clash := false
+		for _, existing := range registry {
+			if existing.ID == ns.ID || strings.EqualFold(existing.Name, ns.Name) {
+				log.Warnf("Ignoring namespace %q: clashes with %q", ns.Name, existing.Name)
+				clash = true
+				break
+			}
+		}
+		if !clash {
+			registry = append(registry, ns)
+		}
+	}
+	namespaces = registry
+}
+
+func canonicalizeNamespaceName(name string) string {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "_", " ")
+	first, size := utf8.DecodeRuneInString(name)
+	if first == utf8.RuneError {
+		return name
+	}
+	return string(unicode.ToUpper(first)) + name[size:]
+}
+
+func namespaceByName(name string) (Namespace, bool) {
+	name = strings.ReplaceAll(strings.TrimSpace(name), "_", " ")
+	for _, ns := range namespaces {
+		if ns.Name != "" && strings.EqualFold(ns.Name, name) {
+			return ns, true
+		}
+	}
+	return Namespace{}, false
+}
+
+func namespaceByID(id int) (Namespace, bool) {
+	for _, ns := range namespaces {
+		if ns.ID == id {
+			return ns, true
+		}
+	}
+	return Namespace{}, false
+}
+
+// splitTitle returns the namespace of a title and the title without its
+// prefix, a prefix that isn't a registered namespace is part of a Main title
+func splitTitle(title string) (Namespace, string) {
+	if prefix, rest, ok := strings.Cut(title, ":"); ok {
+		if ns, found := namespaceByName(prefix); found {
+			return ns, rest
+		}
+	}
+	return Namespace{NamespaceMain, ""}, title
+}
+
+// Title joins a namespace and a name back into a full title
+func (ns Namespace) Title(name string) string {
+	if ns.Name == "" {
+		return name
+	}
+	return strings.ReplaceAll(ns.Name, " ", "_") + ":" + name
+}
+
+// Label is how the namespace is shown in lists
+func (ns Namespace) Label() string {
+	if ns.Name == "" {
+		return "(Main)"
+	}
+	return ns.Name
+}
+
+// holdsPages is false for namespaces whose titles aren't rows in Pages
+func (ns Namespace) holdsPages() bool {
+	return ns.ID != NamespaceSpecial && ns.ID != NamespaceCategory && ns.ID != NamespaceFile
+}
+
+// pageNamespaces lists the namespaces that can hold pages, in id order
+func pageNamespaces() []Namespace {
+	var list []Namespace
+	for _, ns := range namespaces {
+		if ns.holdsPages() {
+			list = append(list, ns)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// assignNamespaces brings Pages.namespace in line with the title prefixes,
+// needed after namespaces are added to or removed from config.json
+func assignNamespaces() error {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	rows, err := dbConn.Query("SELECT id, title, namespace FROM Pages")
+	if err != nil {
+		return err
+	}
+	changed := make(map[int]int)
+	for rows.Next() {
+		var id, current int
+		var title string
+		if err := rows.Scan(&id, &title, &current); err != nil {
+			rows.Close()
+			return err
+		}
+		if ns, _ := splitTitle(title); ns.ID != current {
+			changed[id] = ns.ID
+		}
+	}
+	rows.Close()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, namespace := range changed {
+		if _, err := tx.Exec("UPDATE Pages SET namespace = ? WHERE id = ?", namespace, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof("Updated the namespace of %d pages", len(changed))
+	return nil
+}
+
+// Special:AllPages?namespace=N lists the pages in one namespace, Main by default
+func loadAllPages(r *http.Request, userAgent string) (*Page, error) {
+	access := readAccessFor(r)
+	current, _ := namespaceByID(NamespaceMain)
+	if value := r.URL.Query().Get("namespace"); value != "" {
+		var ok bool
+		if id, err := strconv.Atoi(value); err == nil {
+			current, ok = namespaceByID(id)
+		} else {
+			current, ok = namespaceByName(value)
+		}
+		if !ok || !current.holdsPages() || !access.canReadNamespace(current.ID) {
+			return nil, fmt.Errorf("unknown namespace %q", value)
+		}
+	}
+
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	// counted here rather than with GROUP BY so private pages aren't counted
+	counts := make(map[int]int)
+	var titles []string
+	rows, err := dbConn.Query("SELECT namespace, title FROM Pages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var namespace int
+		var title string
+		if err := rows.Scan(&namespace, &title); err != nil {
+			return nil, err
+		}
+		if !access.canRead(title) {
+			continue
+		}
+		counts[namespace]++
+		if namespace == current.ID {
+			titles = append(titles, title)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	c := newCollator()
+	sort.SliceStable(titles, func(i, j int) bool {
+		return c.CompareString(removeUnderscores(titles[i]), removeUnderscores(titles[j])) < 0
+	})
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(`<h2 class="wikih2">All Pages</h2><form action="/title/Special:AllPages" method="GET" class="row g-2 mb-3">
+        <div class="col-auto"><select class="form-select form-select-sm" name="namespace">`)
+	for _, ns := range pageNamespaces() {
+		if !access.canReadNamespace(ns.ID) {
+			continue
+		}
+		selected := ""
+		if ns.ID == current.ID {
+			selected = " selected"
+		}
+		bodyHTML.WriteString(fmt.Sprintf(`<option value="%d"%s>%s (%d)</option>`, ns.ID, selected, html.EscapeString(ns.Label()), counts[ns.ID]))
+	}
+	bodyHTML.WriteString(`</select></div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">Show</button></div>
+    </form>`)
+
+	if len(titles) == 0 {
+		bodyHTML.WriteString(`<p>There are no pages in this namespace.</p>`)
+	} else {
+		bodyHTML.WriteString("<ul>\n")
+		for _, title := range titles {
+			bodyHTML.WriteString(fmt.Sprintf("<li><a href=\"/title/%s\">%s</a></li>\n", url.PathEscape(title), html.EscapeString(removeUnderscores(title))))
+		}
+		bodyHTML.WriteString("</ul>")
+	}
+
+	return newSpecialPage("Special:AllPages", bodyHTML.String(), userAgent), nil
+}
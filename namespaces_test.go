@@ -0,0 +1,126 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ArcWiki/ArcWiki/db"
+)
+
+func TestSplitTitle(t *testing.T) {
+	loadNamespaces([]Namespace{
+		{100, "Team_space"},
+		{101, "help"}, // clashes with Help
+		{5, "Low"},    // below the custom range
+		{102, "Bad:Name"},
+	})
+	t.Cleanup(func() { loadNamespaces(nil) })
+
+	tests := []struct {
+		title string
+		ns    int
+		name  string
+	}{
+		{"Main_Page", NamespaceMain, "Main_Page"},
+		{"Help:Intro", NamespaceHelp, "Intro"},
+		{"help:Intro", NamespaceHelp, "Intro"},
+		{"Category:Docs", NamespaceCategory, "Docs"},
+		{"Talk:Help:Intro", NamespaceTalk, "Help:Intro"},
+		{"Team_space:Plan", 100, "Plan"},
+		{"Team space:Plan", 100, "Plan"},
+		{"Low:Plan", NamespaceMain, "Low:Plan"},
+		{"Help-Intro", NamespaceMain, "Help-Intro"},
+		{"Nowhere:Plan", NamespaceMain, "Nowhere:Plan"},
+	}
+	for _, tt := range tests {
+		ns, name := splitTitle(tt.title)
+		if ns.ID != tt.ns || name != tt.name {
+			t.Errorf("splitTitle(%q) = %d, %q, want %d, %q", tt.title, ns.ID, name, tt.ns, tt.name)
+		}
+	}
+	if ns, _ := namespaceByID(101); ns.Name != "" {
+		t.Errorf("a namespace clashing with Help was registered as %q", ns.Name)
+	}
+	if ns, _ := namespaceByID(100); ns.Title("Plan") != "Team_space:Plan" {
+		t.Errorf("Title = %q", ns.Title("Plan"))
+	}
+}
+
+func TestHelpPagesMigrated(t *testing.T) {
+	for _, title := range []string{"Help-Moved036", "Help-Clash036", "Help:Clash036"} {
+		savePage(t, title, "body of "+title, 0)
+	}
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Pages WHERE title = 'Help:Moved036'")
+		authDB.Exec("DELETE FROM Revisions WHERE title = 'Help:Moved036'")
+	})
+	// saved before Help: was a namespace
+	if _, err := authDB.Exec("UPDATE Pages SET namespace = 0 WHERE title LIKE 'Help-%036'"); err != nil {
+		t.Fatal(err)
+	}
+
+	db.DBSetup()
+
+	var namespace int
+	if err := authDB.QueryRow("SELECT namespace FROM Pages WHERE title = 'Help:Moved036'").Scan(&namespace); err != nil {
+		t.Fatalf("Help-Moved036 wasn't moved: %v", err)
+	}
+	if namespace != NamespaceHelp {
+		t.Errorf("moved page namespace %d, want %d", namespace, NamespaceHelp)
+	}
+	var revisions int
+	authDB.QueryRow("SELECT COUNT(*) FROM Revisions WHERE title = 'Help:Moved036'").Scan(&revisions)
+	if revisions != 1 {
+		t.Errorf("%d revisions moved with the page, want 1", revisions)
+	}
+
+	// Help:Clash036 already existed so Help-Clash036 stays, history and all
+	var bodies []string
+	rows, err := authDB.Query("SELECT body FROM Pages WHERE title IN ('Help-Clash036', 'Help:Clash036') ORDER BY title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var body string
+		rows.Scan(&body)
+		bodies = append(bodies, body)
+	}
+	rows.Close()
+	if strings.Join(bodies, "|") != "body of Help-Clash036|body of Help:Clash036" {
+		t.Errorf("clashing pages %q", bodies)
+	}
+	authDB.QueryRow("SELECT COUNT(*) FROM Revisions WHERE title = 'Help-Clash036'").Scan(&revisions)
+	if revisions != 1 {
+		t.Error("the left behind page lost its history")
+	}
+}
+
+func TestPagesOnlyInPageNamespaces(t *testing.T) {
+	for _, title := range []string{"Special:Nope036", "Category:Nope036", "File:Nope036.png"} {
+		err := (&Page{Title: title, Body: "x"}).save(0)
+		if err == nil || !strings.Contains(err.Error(), "can't be created") {
+			t.Errorf("saving %s: %v", title, err)
+		}
+		err = (&Page{Title: title}).deletePage(0)
+		if err == nil || !strings.Contains(err.Error(), "can't be deleted") {
+			t.Errorf("deleting %s: %v", title, err)
+		}
+	}
+}
@@ -0,0 +1,677 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OIDC is the "oidc" section of config.json, single sign-on is off without
+// an issuer. OIDC_CLIENT_SECRET in the environment overrides clientSecret
+type OIDC struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientID"`
+	ClientSecret string `json:"clientSecret"`
+	// where the provider sends people back, /login/oidc/callback on this site if unset
+	RedirectURL string `json:"redirectURL"`
+	// shown on the login button, "single sign-on" if unset
+	Name string `json:"name"`
+	// asked for besides openid, profile and email if unset
+	Scopes []string `json:"scopes"`
+	// claims holding the username and the list of groups, preferred_username and groups if unset
+	UsernameClaim string `json:"usernameClaim"`
+	GroupsClaim   string `json:"groupsClaim"`
+	// provider groups to ArcWiki groups, the first one the user is in wins
+	GroupMapping []OIDCGroup `json:"groupMapping"`
+	// group for people in none of the mapped groups, they can't log in if unset
+	DefaultGroup string `json:"defaultGroup"`
+}
+
+type OIDCGroup struct {
+	Claim string `json:"claim"`
+	Group string `json:"group"`
+}
+
+const (
+	// how long someone has at the provider before the login has to start over
+	oidcLoginWindow = 10 * time.Minute
+	// allowed difference between our clock and the provider's
+	oidcClockSkew = time.Minute
+	// discovery is fetched again after this, keys whenever an unknown one turns up
+	oidcDiscoveryTTL = time.Hour
+	oidcKeysMinAge   = time.Minute
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcEnabled also needs somewhere to send the provider back to
+func oidcEnabled() bool {
+	return config.OIDC.Issuer != "" && config.OIDC.ClientID != "" &&
+		(config.OIDC.RedirectURL != "" || config.BaseURL != "")
+}
+
+func oidcName() string {
+	if config.OIDC.Name != "" {
+		return config.OIDC.Name
+	}
+	return "single sign-on"
+}
+
+func oidcRedirectURL() string {
+	if config.OIDC.RedirectURL != "" {
+		return config.OIDC.RedirectURL
+	}
+	return siteURL("/login/oidc/callback")
+}
+
+// oidcDiscovery is the part of /.well-known/openid-configuration used here
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// oidcProvider caches the discovery document and signing keys of the issuer
+type oidcProvider struct {
+	mu          sync.Mutex
+	doc         *oidcDiscovery
+	discovered  time.Time
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+var provider = &oidcProvider{}
+
+func getJSON(rawURL string, header http.Header, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *oidcProvider) discovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.doc != nil && time.Since(p.discovered) < oidcDiscoveryTTL {
+		return p.doc, nil
+	}
+	issuer := strings.TrimSuffix(config.OIDC.Issuer, "/")
+	var doc oidcDiscovery
+	if err := getJSON(issuer+"/.well-known/openid-configuration", nil, &doc); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", doc.Issuer, config.OIDC.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing an endpoint")
+	}
+	p.doc, p.discovered = &doc, time.Now()
+	return p.doc, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	number := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := number(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := number(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := number(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := number(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key finds the signing key with kid, fetching the key set again when the
+// provider has rotated to a key not seen yet
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	doc, err := p.discovery()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	find := func() crypto.PublicKey {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k
+			}
+		}
+		return p.keys[kid]
+	}
+	if k := find(); k != nil || time.Since(p.keysFetched) < oidcKeysMinAge {
+		if k == nil {
+			return nil, fmt.Errorf("no signing key %q", kid)
+		}
+		return k, nil
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(doc.JWKSURI, nil, &set); err != nil {
+		return nil, err
+	}
+	p.keys, p.keysFetched = make(map[string]crypto.PublicKey), time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Warnf("oidc: skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		p.keys[k.Kid] = pub
+	}
+	if k := find(); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("no signing key %q", kid)
+}
+
+// verifyIDToken checks the signature and the standard claims of an ID token
+// and returns its claims
+func verifyIDToken(token string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID token is not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	var hash crypto.Hash
+	switch header.Alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		// "none" and the HMAC algorithms are refused along with anything unknown
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	key, err := provider.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg[0] != 'R' || rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return nil, errors.New("bad ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if header.Alg[0] != 'E' || len(signature) != 2*size ||
+			!ecdsa.Verify(pub, digest, new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			return nil, errors.New("bad ID token signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	doc, err := provider.discovery()
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != doc.Issuer {
+		return nil, fmt.Errorf("ID token is from issuer %q", iss)
+	}
+	var audience []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	found := false
+	for _, a := range audience {
+		found = found || a == config.OIDC.ClientID
+	}
+	if !found {
+		return nil, errors.New("ID token is for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != config.OIDC.ClientID {
+		return nil, errors.New("ID token was issued to another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(time.Now().Add(oidcClockSkew)) {
+		return nil, errors.New("ID token was issued in the future")
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func randomToken() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("oidc: cannot generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// oidcLoginHandler is /login/oidc, it sends the visitor to the provider with
+// a fresh state, nonce and PKCE verifier kept in their session
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	doc, err := provider.discovery()
+	if err != nil {
+		log.Error("oidc: ", err)
+		oidcFailed(w, r, "", "The login provider can't be reached right now.", http.StatusBadGateway)
+		return
+	}
+
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	session, _ := store.Get(r, "cookie-name")
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Values["oidc_since"] = time.Now().Unix()
+	session.Save(r, w)
+
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := config.OIDC.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {config.OIDC.ClientID},
+		"redirect_uri":          {oidcRedirectURL()},
+		"scope":                 {strings.Join(append([]string{"openid"}, scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	target := doc.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcCallbackHandler is /login/oidc/callback, where the provider sends the
+// visitor back with a code to swap for their ID token
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := store.Get(r, "cookie-name")
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	since, _ := session.Values["oidc_since"].(int64)
+	for _, key := range []string{"oidc_state", "oidc_nonce", "oidc_verifier", "oidc_since"} {
+		delete(session.Values, key)
+	}
+	session.Save(r, w)
+
+	q := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 || time.Since(time.Unix(since, 0)) > oidcLoginWindow {
+		oidcFailed(w, r, "", "This login link has expired, please try again.", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		log.Warnf("oidc: provider refused the login: %s %s", e, q.Get("error_description"))
+		oidcFailed(w, r, "", "The login provider didn't let you in.", http.StatusForbidden)
+		return
+	}
+
+	claims, err := oidcExchange(r, q.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Error("oidc: ", err)
+		oidcFailed(w, r, "", "The login provider's answer couldn't be checked.", http.StatusBadGateway)
+		return
+	}
+
+	userID, username, err := oidcAccount(r, claims)
+	if err != nil {
+		oidcFailed(w, r, username, "Sorry, "+err.Error()+".", http.StatusForbidden)
+		return
+	}
+	completeLogin(w, r, session, userID, username)
+}
+
+// oidcExchange swaps the code for tokens and returns the verified ID token's
+// claims, topped up from the userinfo endpoint when the groups aren't in it
+func oidcExchange(r *http.Request, code string, verifier string, nonce string) (map[string]interface{}, error) {
+	doc, err := provider.discovery()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL()},
+		"code_verifier": {verifier},
+		"client_id":     {config.OIDC.ClientID},
+	}
+	secret := config.OIDC.ClientSecret
+	if env := os.Getenv("OIDC_CLIENT_SECRET"); env != "" {
+		secret = env
+	}
+	basic := secret != ""
+	if basic && len(doc.TokenAuthMethods) > 0 {
+		// client_secret_basic is the default, only post the secret if that's all it takes
+		basic = false
+		for _, m := range doc.TokenAuthMethods {
+			basic = basic || m == "client_secret_basic"
+		}
+		if !basic {
+			form.Set("client_secret", secret)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(config.OIDC.ClientID), url.QueryEscape(secret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint: %s: %s %s", resp.Status, tokens.Error, tokens.Description)
+	}
+
+	claims, err := verifyIDToken(tokens.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims[groupsClaim()]; !ok && doc.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		var info map[string]interface{}
+		if err := getJSON(doc.UserinfoEndpoint, http.Header{"Authorization": {"Bearer " + tokens.AccessToken}}, &info); err != nil {
+			return nil, err
+		}
+		if info["sub"] != claims["sub"] {
+			return nil, errors.New("userinfo is for another subject")
+		}
+		for k, v := range info {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+	return claims, nil
+}
+
+func groupsClaim() string {
+	if config.OIDC.GroupsClaim != "" {
+		return config.OIDC.GroupsClaim
+	}
+	return "groups"
+}
+
+// oidcGroup maps the provider's groups to the first matching ArcWiki group
+func oidcGroup(claims map[string]interface{}) string {
+	var member []string
+	switch v := claims[groupsClaim()].(type) {
+	case string:
+		member = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				member = append(member, s)
+			}
+		}
+	}
+	for _, m := range config.OIDC.GroupMapping {
+		for _, g := range member {
+			if g == m.Claim {
+				return m.Group
+			}
+		}
+	}
+	return config.OIDC.DefaultGroup
+}
+
+// oidcUsername is the configured claim, preferred_username or the start of the email address
+func oidcUsername(claims map[string]interface{}) string {
+	for _, claim := range []string{config.OIDC.UsernameClaim, "preferred_username"} {
+		if name, _ := claims[claim].(string); claim != "" && name != "" {
+			return strings.TrimSpace(name)
+		}
+	}
+	email, _ := claims["email"].(string)
+	if i := strings.Index(email, "@"); i > 0 {
+		return email[:i]
+	}
+	return ""
+}
+
+// oidcAccount finds the account linked to the provider's subject, linking or
+// creating one on the first login, and moves it into the mapped group
+func oidcAccount(r *http.Request, claims map[string]interface{}) (int, string, error) {
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	subject := iss + " " + sub
+	username := oidcUsername(claims)
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	group := oidcGroup(claims)
+	if group == "" {
+		return 0, username, errors.New("your account isn't in any group that may use this wiki")
+	}
+	if _, ok := groups[group]; !ok || group == anonymousGroup {
+		log.Errorf("oidc: groupMapping names %q, which isn't a group", group)
+		return 0, username, errors.New("single sign-on isn't set up properly, tell an administrator")
+	}
+
+	var userID int
+	var disabled, pending bool
+	err := authDB.QueryRow("SELECT id, username, disabled, pending FROM Users WHERE oidc_subject = ?", subject).
+		Scan(&userID, &username, &disabled, &pending)
+	if err == sql.ErrNoRows {
+		if err := validUsername(username); err != nil {
+			return 0, username, err
+		}
+		var localEmail string
+		err = authDB.QueryRow("SELECT id, COALESCE(email, ''), disabled, pending FROM Users WHERE username = ? AND oidc_subject IS NULL", username).
+			Scan(&userID, &localEmail, &disabled, &pending)
+		switch {
+		case err == sql.ErrNoRows:
+			// nobody has the name yet, the account is made on the spot with no
+			// password of its own
+			res, err := authDB.Exec(`INSERT INTO Users (username, password, email, is_admin, user_group, oidc_subject, created_at)
+				VALUES (?, '', ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+				username, sql.NullString{String: email, Valid: email != ""}, boolToInt(group == "admin"), group, subject)
+			if err != nil {
+				if isUniqueConstraintError(err) {
+					return 0, username, errUserExists
+				}
+				log.Error("Database Error:", err)
+				return 0, username, errors.New("the account couldn't be created")
+			}
+			id, _ := res.LastInsertId()
+			writeLog(r, "user", "register", username, "", "", "single sign-on, group="+group)
+			return int(id), username, nil
+		case err != nil:
+			log.Error("Database Error:", err)
+			return 0, username, errors.New("the account couldn't be looked up")
+		case !emailVerified || localEmail == "" || !strings.EqualFold(localEmail, email):
+			// taking over a local account needs proof it's the same person
+			return 0, username, fmt.Errorf("an account called %s already exists here, ask an administrator", username)
+		}
+		if _, err := authDB.Exec("UPDATE Users SET oidc_subject = ? WHERE id = ?", subject, userID); err != nil {
+			log.Error("Database Error:", err)
+			return 0, username, errors.New("the account couldn't be linked")
+		}
+		log.Infof("oidc: linked %s to %s by email", username, subject)
+	} else if err != nil {
+		log.Error("Database Error:", err)
+		return 0, username, errors.New("the account couldn't be looked up")
+	}
+	if disabled {
+		return 0, username, errAccountDisabled
+	}
+	if pending {
+		return 0, username, errAccountPending
+	}
+
+	// the provider decides the group, every login
+	if _, err := authDB.Exec("UPDATE Users SET user_group = ?, is_admin = ? WHERE id = ?", group, boolToInt(group == "admin"), userID); err != nil {
+		log.Error("Database Error:", err)
+	}
+	return userID, username, nil
+}
+
+func oidcFailed(w http.ResponseWriter, r *http.Request, username string, message string, status int) {
+	writeLog(r, "auth", "login-failure", username, "", "", "single sign-on: "+message)
+	w.WriteHeader(status)
+	renderTemplate(w, "title", newSpecialPage("Login", alert("alert-danger", message)+`<a href="/login">Back to the login page</a>`, getUserAgent(r)))
+}
@@ -0,0 +1,476 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID provider with discovery, a key set and a token
+// endpoint that checks PKCE. Codes are handed out by the test, not a login page
+type mockIssuer struct {
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge   string
+	redirectURI string
+	claims      map[string]interface{}
+}
+
+// newMockIssuer starts an issuer and points the oidc config at it
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{rsaKey: rsaKey, ecKey: ecKey, codes: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		grant, ok := m.codes[r.PostFormValue("code")]
+		delete(m.codes, r.PostFormValue("code"))
+		m.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		id, secret, _ := r.BasicAuth()
+		switch {
+		case !ok, grant.challenge != base64.RawURLEncoding.EncodeToString(sum[:]),
+			r.PostFormValue("redirect_uri") != grant.redirectURI, id != "wiki", secret != "s3cret":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token":     m.sign(t, "RS256", "rsa", grant.claims),
+			"access_token": "at",
+		})
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+
+	savedOIDC, savedProvider, savedBase := config.OIDC, provider, config.BaseURL
+	config.OIDC = OIDC{
+		Issuer:       m.srv.URL,
+		ClientID:     "wiki",
+		ClientSecret: "s3cret",
+		GroupMapping: []OIDCGroup{{Claim: "wiki-admins", Group: "admin"}, {Claim: "staff", Group: "editor"}},
+		DefaultGroup: "reader",
+	}
+	config.BaseURL = "https://wiki.example.org"
+	provider = &oidcProvider{}
+	t.Cleanup(func() { config.OIDC, provider, config.BaseURL = savedOIDC, savedProvider, savedBase })
+	return m
+}
+
+// claims are valid ID token claims for sub with nonce
+func (m *mockIssuer) claims(sub string, nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   m.srv.URL,
+		"aud":   "wiki",
+		"azp":   "wiki",
+		"sub":   sub,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+	}
+}
+
+// sign makes a JWT with alg, signed by the issuer's key of that type. "none"
+// is left unsigned and HS256 uses the RSA modulus as the secret, the usual
+// way of trying to pass a public key off as a shared one
+func (m *mockIssuer) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	input := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, m.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, m.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "HS256":
+		mac := hmac.New(sha256.New, m.rsaKey.N.Bytes())
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := newMockIssuer(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(change func(map[string]interface{})) map[string]interface{} {
+		claims := m.claims("alice", "n0nce")
+		change(claims)
+		return claims
+	}
+	valid := m.claims("alice", "n0nce")
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", m.sign(t, "RS256", "rsa", valid), true},
+		{"ES256", m.sign(t, "ES256", "ec", valid), true},
+		{"audience list", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { c["aud"] = []string{"other", "wiki"} })), true},
+		{"bad signature", func() string {
+			forged := &mockIssuer{rsaKey: otherKey}
+			return forged.sign(t, "RS256", "rsa", valid)
+		}(), false},
+		{"tampered claims", func() string {
+			parts := strings.Split(m.sign(t, "RS256", "rsa", valid), ".")
+			b, _ := json.Marshal(with(func(c map[string]interface{}) { c["sub"] = "mallory" }))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(b) + "." + parts[2]
+		}(), false},
+		{"RSA key with ES256", m.sign(t, "ES256", "rsa", valid), false},
+		{"alg none", m.sign(t, "none", "rsa", valid), false},
+		{"HS256", m.sign(t, "HS256", "rsa", valid), false},
+		{"wrong issuer", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), false},
+		{"wrong audience", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { c["aud"] = "other" })), false},
+		{"no audience", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { delete(c, "aud") })), false},
+		{"wrong azp", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { c["azp"] = "other" })), false},
+		{"expired", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix() })), false},
+		{"no expiry", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { delete(c, "exp") })), false},
+		{"issued in the future", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { c["iat"] = time.Now().Add(2 * oidcClockSkew).Unix() })), false},
+		{"nonce mismatch", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { c["nonce"] = "other" })), false},
+		{"no nonce", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { delete(c, "nonce") })), false},
+		{"no subject", m.sign(t, "RS256", "rsa", with(func(c map[string]interface{}) { delete(c, "sub") })), false},
+		{"unknown key", m.sign(t, "RS256", "gone", valid), false},
+		{"not a JWT", "abc.def", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyIDToken(tt.token, "n0nce")
+			if tt.ok && (err != nil || claims["sub"] != "alice") {
+				t.Fatalf("want the token accepted, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("want the token refused")
+			}
+		})
+	}
+}
+
+// startOIDCLogin follows /login/oidc as far as the provider and returns the
+// authorization request it was sent with
+func startOIDCLogin(t *testing.T, m *mockIssuer, ts *httptest.Server, client *http.Client) url.Values {
+	t.Helper()
+	resp, err := client.Get(ts.URL + "/login/oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), m.srv.URL+"/authorize?") {
+		t.Fatalf("/login/oidc: status %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return location.Query()
+}
+
+// issueCode stands in for the login page, handing out a code for claims
+func (m *mockIssuer) issueCode(auth url.Values, claims map[string]interface{}) string {
+	code := randomToken()
+	m.mu.Lock()
+	m.codes[code] = mockGrant{challenge: auth.Get("code_challenge"), redirectURI: auth.Get("redirect_uri"), claims: claims}
+	m.mu.Unlock()
+	return code
+}
+
+func callback(t *testing.T, ts *httptest.Server, client *http.Client, code string, state string) *http.Response {
+	t.Helper()
+	resp, err := client.Get(ts.URL + "/login/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func newOIDCClient(t *testing.T) (*httptest.Server, *http.Client) {
+	ts, client := newTestServer(t)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return ts, client
+}
+
+func TestOIDCLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	ts, client := newOIDCClient(t)
+
+	auth := startOIDCLogin(t, m, ts, client)
+	if got := auth.Get("redirect_uri"); got != "https://wiki.example.org/login/oidc/callback" {
+		t.Errorf("redirect_uri is %q, not on the base URL", got)
+	}
+	if auth.Get("code_challenge_method") != "S256" || auth.Get("code_challenge") == "" || auth.Get("state") == "" || auth.Get("nonce") == "" {
+		t.Fatalf("authorization request is missing state, nonce or PKCE: %v", auth)
+	}
+
+	claims := m.claims("sso-login", auth.Get("nonce"))
+	claims["preferred_username"] = "sso-login"
+	claims["groups"] = []string{"staff"}
+	resp := callback(t, ts, client, m.issueCode(auth, claims), auth.Get("state"))
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/admin" {
+		t.Fatalf("callback: status %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	var id int
+	var group string
+	if err := authDB.QueryRow("SELECT id, user_group FROM Users WHERE oidc_subject = ?", m.srv.URL+" sso-login").Scan(&id, &group); err != nil || group != "editor" {
+		t.Fatalf("account: group %q, %v", group, err)
+	}
+	t.Cleanup(func() { deleteAccount(id, "1") })
+}
+
+func TestOIDCNeedsBaseURL(t *testing.T) {
+	newMockIssuer(t)
+	ts, client := newOIDCClient(t)
+	config.BaseURL = ""
+	if status, _ := get(t, client, ts.URL+"/login/oidc"); status != http.StatusNotFound {
+		t.Errorf("without baseURL: status %d", status)
+	}
+	config.OIDC.RedirectURL = "https://sso.example.org/login/oidc/callback"
+	if got := oidcRedirectURL(); got != config.OIDC.RedirectURL || !oidcEnabled() {
+		t.Errorf("redirectURL: got %q", got)
+	}
+}
+
+func TestOIDCCallbackChecksState(t *testing.T) {
+	m := newMockIssuer(t)
+	ts, client := newOIDCClient(t)
+
+	// a callback nobody started
+	if resp := callback(t, ts, client, "code", "state"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsolicited callback: status %d", resp.StatusCode)
+	}
+
+	auth := startOIDCLogin(t, m, ts, client)
+	claims := m.claims("sso-state", auth.Get("nonce"))
+	claims["preferred_username"] = "sso-state"
+	if resp := callback(t, ts, client, m.issueCode(auth, claims), "forged"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong state: status %d", resp.StatusCode)
+	}
+	// the state is used up by the failed try as well
+	if resp := callback(t, ts, client, m.issueCode(auth, claims), auth.Get("state")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("state used twice: status %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCCallbackChecksPKCE(t *testing.T) {
+	m := newMockIssuer(t)
+	ts, client := newOIDCClient(t)
+
+	// the code was issued to a login with another verifier, so the issuer
+	// won't swap it for this session's
+	auth := startOIDCLogin(t, m, ts, client)
+	other := sha256.Sum256([]byte("someone else's verifier"))
+	stolen := url.Values{"code_challenge": {base64.RawURLEncoding.EncodeToString(other[:])}, "redirect_uri": {auth.Get("redirect_uri")}}
+	claims := m.claims("sso-pkce", auth.Get("nonce"))
+	claims["preferred_username"] = "sso-pkce"
+	if resp := callback(t, ts, client, m.issueCode(stolen, claims), auth.Get("state")); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("code for another verifier: status %d", resp.StatusCode)
+	}
+	if findUsername("sso-pkce") != "" {
+		t.Error("account created from a refused login")
+	}
+}
+
+func TestOIDCCallbackChecksNonce(t *testing.T) {
+	m := newMockIssuer(t)
+	ts, client := newOIDCClient(t)
+
+	auth := startOIDCLogin(t, m, ts, client)
+	claims := m.claims("sso-nonce", "replayed")
+	claims["preferred_username"] = "sso-nonce"
+	if resp := callback(t, ts, client, m.issueCode(auth, claims), auth.Get("state")); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("token for another nonce: status %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCGroupMapping(t *testing.T) {
+	newMockIssuer(t)
+	tests := []struct {
+		name   string
+		groups interface{}
+		want   string
+	}{
+		{"first mapping wins", []interface{}{"staff", "wiki-admins"}, "admin"},
+		{"single group", []interface{}{"staff"}, "editor"},
+		{"string claim", "staff", "editor"},
+		{"no match", []interface{}{"sales"}, "reader"},
+		{"no claim", nil, "reader"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{}
+			if tt.groups != nil {
+				claims["groups"] = tt.groups
+			}
+			if got := oidcGroup(claims); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	config.OIDC.GroupsClaim = "roles"
+	if got := oidcGroup(map[string]interface{}{"roles": []interface{}{"staff"}, "groups": []interface{}{"wiki-admins"}}); got != "editor" {
+		t.Errorf("groupsClaim: got %q, want editor", got)
+	}
+}
+
+func TestOIDCAccount(t *testing.T) {
+	m := newMockIssuer(t)
+	r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback", nil)
+	login := func(sub string, username string, groups ...interface{}) map[string]interface{} {
+		claims := m.claims(sub, "")
+		claims["preferred_username"] = username
+		claims["groups"] = groups
+		return claims
+	}
+	groupOf := func(id int) string {
+		var group string
+		if err := authDB.QueryRow("SELECT user_group FROM Users WHERE id = ?", id).Scan(&group); err != nil {
+			t.Fatal(err)
+		}
+		return group
+	}
+
+	t.Run("created on first login", func(t *testing.T) {
+		id, username, err := oidcAccount(r, login("sub-new", "sso-new", "staff"))
+		if err != nil || username != "sso-new" || groupOf(id) != "editor" {
+			t.Fatalf("got %d %q %v", id, username, err)
+		}
+		t.Cleanup(func() { deleteAccount(id, "1") })
+
+		// the provider's groups are applied again, and the name stays
+		again, username, err := oidcAccount(r, login("sub-new", "renamed", "wiki-admins"))
+		if err != nil || again != id || username != "sso-new" || groupOf(id) != "admin" {
+			t.Fatalf("second login: got %d %q %v", again, username, err)
+		}
+	})
+
+	t.Run("no group", func(t *testing.T) {
+		config.OIDC.DefaultGroup = ""
+		defer func() { config.OIDC.DefaultGroup = "reader" }()
+		if _, _, err := oidcAccount(r, login("sub-none", "sso-none", "sales")); err == nil {
+			t.Fatal("want the login refused")
+		}
+		if findUsername("sso-none") != "" {
+			t.Fatal("account created without a group")
+		}
+	})
+
+	t.Run("mapped to a missing group", func(t *testing.T) {
+		config.OIDC.GroupMapping = append(config.OIDC.GroupMapping, OIDCGroup{Claim: "typo", Group: "editorz"})
+		defer func() { config.OIDC.GroupMapping = config.OIDC.GroupMapping[:2] }()
+		if _, _, err := oidcAccount(r, login("sub-typo", "sso-typo", "typo")); err == nil {
+			t.Fatal("want the login refused")
+		}
+	})
+
+	t.Run("local account needs a verified email", func(t *testing.T) {
+		local := testUser(t, "sso-local", "local-password-1", "editor", "local@example.org")
+		claims := login("sub-local", "sso-local", "staff")
+		claims["email"] = "local@example.org"
+		if _, _, err := oidcAccount(r, claims); err == nil {
+			t.Fatal("unverified email took over a local account")
+		}
+		claims["email"] = "other@example.org"
+		claims["email_verified"] = true
+		if _, _, err := oidcAccount(r, claims); err == nil {
+			t.Fatal("another verified email took over a local account")
+		}
+		claims["email"] = "LOCAL@example.org"
+		if id, _, err := oidcAccount(r, claims); err != nil || id != local {
+			t.Fatalf("matching verified email: got %d %v", id, err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		id, _, err := oidcAccount(r, login("sub-disabled", "sso-disabled", "staff"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { deleteAccount(id, "1") })
+		if _, err := authDB.Exec("UPDATE Users SET disabled = 1 WHERE id = ?", id); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := oidcAccount(r, login("sub-disabled", "sso-disabled", "staff")); err != errAccountDisabled {
+			t.Fatalf("got %v, want %v", err, errAccountDisabled)
+		}
+	})
+}
@@ -22,7 +22,6 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
-	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -43,6 +42,7 @@ type AddPage struct {
 	Menu        template.HTML
 	Size        template.HTML
 	UpdatedDate string
+	CSRF        string
 }
 type Page struct {
 	ID           int
@@ -55,6 +55,9 @@ type Page struct {
 	Size         template.HTML
 	CategoryLink []string
 	UpdatedDate  string
+	Tabs         *TalkTabs
+	Protection   string // lock icon tooltip, empty when unprotected
+	CSRF         string // form token, only set for pages with a form in their template
 }
 
 type EditPage struct {
@@ -66,9 +69,12 @@ type EditPage struct {
 	Menu        template.HTML
 	Size        template.HTML
 	UpdatedDate string
+	Error       string
+	CSRF        string
 }
 
-func (p *Page) save() error {
+// save stores the page and a revision, userID is the author of this version
+func (p *Page) save(userID int) error {
 	log.Info("Saving page: " + canonicalizeTitle(p.Title))
 
 	db, err := db.LoadDatabase()
@@ -90,6 +96,11 @@ func (p *Page) save() error {
 	}()
 
 	title := canonicalizeTitle(p.Title)
+	ns, _ := splitTitle(title)
+	if !ns.holdsPages() {
+		err = fmt.Errorf("pages can't be created in the %s namespace", ns.Name)
+		return err
+	}
 
 	var pageID int
 	err = tx.QueryRow("SELECT id FROM Pages WHERE title = ?", title).Scan(&pageID)
@@ -98,8 +109,8 @@ func (p *Page) save() error {
 		// INSERT new page
 		log.Info("Page not found, inserting new:", title)
 		res, err := tx.Exec(
-			"INSERT INTO Pages (title, body, user_id, created_at, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
-			title, string(p.Body), 1,
+			"INSERT INTO Pages (title, namespace, body, user_id, created_at, updated_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+			title, ns.ID, string(p.Body), nullUserID(userID),
 		)
 		if err != nil {
 			log.Error("Insert error:", err)
@@ -124,30 +135,19 @@ func (p *Page) save() error {
 		log.Info("Updated page with ID:", pageID)
 	}
 
-	// Remove previous category links
-	_, err = tx.Exec("DELETE FROM CategoryPages WHERE page_id = ?", pageID)
-	if err != nil {
-		log.Error("Error clearing old category links:", err)
-	}
-
-	// Match categories in content
-	var categoryIDs []int
-	re := regexp.MustCompile(`\[Category:([^\]|]*)\]`)
-	for _, match := range re.FindAllStringSubmatch(string(p.Body), -1) {
-		var catID int
-		if err := tx.QueryRow("SELECT id FROM Categories WHERE title = ?", match[1]).Scan(&catID); err == nil {
-			categoryIDs = append(categoryIDs, catID)
-		} else {
-			log.Warnf("Unknown category: %s", match[1])
-		}
+	if err = linkPageCategories(tx, pageID, string(p.Body), userID); err != nil {
+		log.Error("Error linking category:", err)
+		return err
 	}
 
-	for _, cid := range categoryIDs {
-		_, err := tx.Exec("INSERT INTO CategoryPages (page_id, category_id) VALUES (?, ?)", pageID, cid)
-		if err != nil {
-			log.Error("Error linking category:", err)
-			return tx.Rollback()
-		}
+	if err = updateFileUsage(tx, pageID, string(p.Body)); err != nil {
+		log.Error("Error recording file usage:", err)
+		return err
+	}
+
+	if err = recordRevision(tx, pageID, title, string(p.Body), userID); err != nil {
+		log.Error("Error recording revision:", err)
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -159,16 +159,53 @@ func (p *Page) save() error {
 	return nil
 }
 
+func checkPageExistence(title string) bool {
+	db, err := db.LoadDatabase()
+	if err != nil {
+		log.Error("Database Error:", err)
+		return false
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM Pages WHERE title = ?)", title).Scan(&exists); err != nil {
+		log.Error("Database Error:", err)
+	}
+	return exists
+}
+
+// recordRevision stores a copy of every saved version of a page
+func recordRevision(tx *sql.Tx, pageID int, title string, body string, userID int) error {
+	_, err := tx.Exec(
+		"INSERT INTO Revisions (page_id, title, body, user_id, created_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		pageID, title, body, nullUserID(userID),
+	)
+	return err
+}
+
 func addPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	r.ParseForm()
 	title := r.FormValue("title")
 	if title != "index" {
 		body := r.FormValue("body")
-		// We Fix make the category links straight away more dev here
-		regex := regexp.MustCompile(`\[Category:([^\]|]*)\]`)
-		matches := regex.FindAllStringSubmatch(body, -1) // Find all matches
 
 		freshTitle := canonicalizeTitle(title)
+		ns, _ := splitTitle(freshTitle)
+		if !ns.holdsPages() {
+			http.Error(w, fmt.Sprintf("Pages can't be created in the %s namespace", ns.Name), http.StatusBadRequest)
+			return
+		}
+		if !requireReadable(w, r, freshTitle) {
+			return
+		}
+		if ok, p := canEditTitle(r, freshTitle); !ok {
+			denyProtected(w, r, freshTitle, p)
+			return
+		}
 
 		db, err := db.LoadDatabase()
 		if err != nil {
@@ -176,7 +213,7 @@ func addPage(w http.ResponseWriter, r *http.Request) {
 			return // Handle error
 		}
 
-		stmt := `INSERT INTO Pages (title, body, user_id, created_at, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP); SELECT last_insert_rowid();`
+		stmt := `INSERT INTO Pages (title, namespace, body, user_id, created_at, updated_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP); SELECT last_insert_rowid();`
 
 		tx, err := db.Begin()
 		if err != nil {
@@ -186,7 +223,8 @@ func addPage(w http.ResponseWriter, r *http.Request) {
 		}
 		defer tx.Rollback() // Rollback if any error occurs
 
-		result, err := tx.Exec(stmt, freshTitle, body, 1)
+		userID := currentUserID(r)
+		result, err := tx.Exec(stmt, freshTitle, ns.ID, body, nullUserID(userID))
 		if err != nil {
 
 			log.Error("Database Error:", err) // Clearer message
@@ -207,30 +245,19 @@ func addPage(w http.ResponseWriter, r *http.Request) {
 			return            // Handle error
 		}
 
-		// Prepare a list of category IDs to insert based on match[1]
-		var categoryIDsToInsert []int
-		for _, matchedCategory := range matches {
-			var categoryID int
-			err := tx.QueryRow("SELECT id FROM Categories WHERE title = ?", matchedCategory[1]).Scan(&categoryID)
-			if err != nil { // Handle potential error fetching category ID
-
-				log.Error("Error fetching category ID:", err)
-				continue // Skip to next category if error occurs
-			}
-			categoryIDsToInsert = append(categoryIDsToInsert, categoryID)
+		if err = linkPageCategories(tx, int(pageID), body, userID); err != nil {
+			log.Error("Database Error:", err)
+			return // Handle error
 		}
 
-		// Batch insert new category links (adjusted for current page only)
-		for _, categoryID := range categoryIDsToInsert {
-			_, err = tx.Exec("INSERT INTO CategoryPages (page_id, category_id) VALUES (?, ?)", pageID, categoryID)
-
-			log.Info("Inserting Category links" + string(pageID) + " " + string(categoryID)) // Clearer message
+		if err = updateFileUsage(tx, int(pageID), body); err != nil {
+			log.Error("Database Error:", err)
+			return // Handle error
+		}
 
-			if err != nil {
-				log.Error("Database Error:", err)
-				_ = tx.Rollback() // Explicitly
-				return            // Handle error
-			}
+		if err = recordRevision(tx, int(pageID), freshTitle, body, userID); err != nil {
+			log.Error("Database Error:", err)
+			return // Handle error
 		}
 
 		// Commit the transaction only once after successful insertions
@@ -240,6 +267,7 @@ func addPage(w http.ResponseWriter, r *http.Request) {
 
 			return // Handle error
 		}
+		writeLog(r, "page", "create", currentUsername(r), freshTitle, "", fmt.Sprintf("%d bytes", len(body)))
 
 		http.Redirect(w, r, "/title/"+freshTitle, http.StatusFound)
 	} else {
@@ -248,82 +276,121 @@ func addPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (p *Page) deletePage() error {
+// deletePage moves the page and its category links into the Archive, the
+// page's revisions are kept so Special:Undelete can bring it back whole
+func (p *Page) deletePage(deletedBy int) error {
 	db, err := db.LoadDatabase()
 	if err != nil {
 		log.Error("Database Error:", err)
+		return err
 	}
 	defer db.Close()
 
 	tx, err := db.Begin() // Start transaction
 	if err != nil {
 		log.Error("error starting transaction: ", err)
-
+		return err
 	}
-	defer func() {
-		if err != nil { // Rollback on any error
-			_ = tx.Rollback()
-		}
-	}()
-	var pageID int
-	// Check if the page exists before deleting
-	row := tx.QueryRow("SELECT id FROM Pages WHERE title = ?", canonicalizeTitle(p.Title))
-	// Placeholder variable to eliminate unnecessary scan
-	err = row.Scan(&pageID)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-
-			log.Warn("page with title", canonicalizeTitle(p.Title)+" not found")
-		}
+	defer tx.Rollback() // Rollback if we don't reach the commit
 
-		log.Error("error checking for existing page: %w", err)
+	title := canonicalizeTitle(p.Title)
+	ns, _ := splitTitle(title)
+	if !ns.holdsPages() {
+		err = fmt.Errorf("pages can't be deleted in the %s namespace", ns.Name)
+		return err
 	}
 
-	// Delete category links first (assuming foreign key constraints exist)
-	_, err = tx.Exec("DELETE FROM CategoryPages WHERE page_id = ?", pageID) // Use title for efficiency (assuming unique constraint)
-	if err != nil {
-		log.Error("Error Deleting Category Links:", err)
-		// Consider logging the error and continuing with page deletion (optional)
+	var pageID int
+	var body sql.NullString
+	var userID sql.NullInt64
+	var createdAt time.Time
+	var updatedAt sql.NullTime
+	err = tx.QueryRow("SELECT id, body, user_id, created_at, updated_at FROM Pages WHERE title = ?", title).
+		Scan(&pageID, &body, &userID, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		log.Warn("No page found with title: ", title)
+		return nil
+	} else if err != nil {
+		log.Error("error checking for existing page: ", err)
+		return err
 	}
 
-	// Delete the page
-	result, err := tx.Exec("DELETE FROM Pages WHERE title = ?", canonicalizeTitle(p.Title))
+	res, err := tx.Exec(
+		"INSERT INTO Archive (kind, original_id, title, body, user_id, created_at, updated_at, deleted_at, deleted_by) VALUES ('page', ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?)",
+		pageID, title, body, userID, createdAt, updatedAt, nullUserID(deletedBy),
+	)
 	if err != nil {
-		log.Error("error deleting page:", err)
+		log.Error("error archiving page: ", err)
+		return err
 	}
+	archiveID, _ := res.LastInsertId()
 
-	rowsDeleted, err := result.RowsAffected()
+	// Category links are archived by title so they survive a category being recreated
+	_, err = tx.Exec(`INSERT INTO ArchiveLinks (archive_id, link_type, title)
+		SELECT ?, 'category', Categories.title FROM CategoryPages
+		JOIN Categories ON Categories.id = CategoryPages.category_id
+		WHERE CategoryPages.page_id = ?`, archiveID, pageID)
 	if err != nil {
-		log.Error("error checking rows affected:", err)
+		log.Error("Error Archiving Category Links:", err)
+		return err
 	}
 
-	if rowsDeleted > 0 {
-		log.Error("Deleted page with title:", canonicalizeTitle(p.Title))
-	} else {
-		log.Error("No page found with title:", canonicalizeTitle(p.Title)) // May indicate a race condition
+	for _, stmt := range []string{
+		"DELETE FROM CategoryPages WHERE page_id = ?",
+		"DELETE FROM PendingCategoryLinks WHERE page_id = ?",
+		"DELETE FROM FileUsage WHERE page_id = ?",
+		"DELETE FROM Pages WHERE id = ?",
+	} {
+		if _, err = tx.Exec(stmt, pageID); err != nil {
+			log.Error("error deleting page: ", err)
+			return err
+		}
 	}
 
-	err = tx.Commit() // Commit the transaction
-	if err != nil {
+	if err = tx.Commit(); err != nil {
 		log.Error("error committing transaction:", err)
+		return err
 	}
 
+	log.Info("Moved page to archive: ", title)
 	return nil
 }
 
 func saveHandler(w http.ResponseWriter, r *http.Request, title string, userAgent string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	titleSave := r.FormValue("title")
 	body := r.FormValue("body")
+	if !requireReadable(w, r, canonicalizeTitle(titleSave)) {
+		return
+	}
+	if ok, p := canEditTitle(r, canonicalizeTitle(titleSave)); !ok {
+		denyProtected(w, r, canonicalizeTitle(titleSave), p)
+		return
+	}
+
+	action := "edit"
+	if !checkPageExistence(canonicalizeTitle(titleSave)) {
+		action = "create"
+		if !can(r, PermCreate) {
+			http.Redirect(w, r, "/error", http.StatusFound)
+			return
+		}
+	}
+
+	body = expandSignatures(body, currentUsername(r), time.Now())
 
 	p := &Page{CTitle: title, Title: titleSave, Body: template.HTML(body)}
-	err := p.save()
+	err := p.save(currentUserID(r))
 	if err != nil {
 		log.Error("Error Saving Page:", err)
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	writeLog(r, "page", action, currentUsername(r), canonicalizeTitle(titleSave), "", fmt.Sprintf("%d bytes", len(body)))
 	http.Redirect(w, r, "/title/"+canonicalizeTitle(titleSave), http.StatusFound)
 }
 func loadPage(title string, userAgent string) (*Page, error) {
@@ -367,19 +434,19 @@ func loadPage(title string, userAgent string) (*Page, error) {
 	//log.Info(noLinks)
 	perfecthtml := parseWikiText(noLinks)
 
-	internalLinks := convertLinksToAnchors(perfecthtml)
+	internalLinks := convertLinksToAnchors(renderFileLinks(perfecthtml))
 	safeBodyHTML := template.HTML(internalLinks)
 	footer := "This page was last modified on " + formatDateTime(updated_at)
 
 	//need to double check this as I'm not certain why this is
 	if err == nil { // Page found in database
 		// ... (existing code for markdown parsing and HTML generation)
-		return &Page{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: removeUnderscores(title), Title: title, Body: safeBodyHTML, Size: template.HTML(size), Menu: safeMenu, CategoryLink: categoryLink, UpdatedDate: footer}, nil
+		return &Page{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: removeUnderscores(title), Title: title, Body: safeBodyHTML, Size: template.HTML(size), Menu: safeMenu, CategoryLink: categoryLink, UpdatedDate: footer, Tabs: loadTalkTabs(title), Protection: protectionSummary(title)}, nil
 	} else if err != sql.ErrNoRows { // Handle other SQLite errors
 		return nil, err
 	}
 
-	return &Page{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: removeUnderscores(title), Title: title, Body: safeBodyHTML, Size: template.HTML(size), Menu: safeMenu, UpdatedDate: footer}, nil
+	return &Page{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: removeUnderscores(title), Title: title, Body: safeBodyHTML, Size: template.HTML(size), Menu: safeMenu, UpdatedDate: footer, Tabs: loadTalkTabs(title), Protection: protectionSummary(title)}, nil
 	//return nil, fmt.Errorf("File not found: %s.txt", title) // File not found in any folder
 }
 
@@ -418,7 +485,31 @@ func loadPageNoHtml(title string, userAgent string) (*EditPage, error) {
 	footer := "This page was last modified on " + formatDateTime(updated_at)
 	return &EditPage{NavTitle: config.SiteTitle, ThemeColor: template.HTML(arcWikiLogo()), CTitle: removeUnderscores(title), Title: title, Body: template.HTML(body), Menu: template.HTML(safeMenu), Size: template.HTML(size), UpdatedDate: footer}, nil
 }
-func loadPageSpecial(categoryName string, userAgent string) (*Page, error) {
+
+// newSpecialPage wraps generated HTML in the standard page layout
+func newSpecialPage(title string, bodyHTML string, userAgent string) *Page {
+	size := ""
+	if userAgent == Desktop {
+		size = "<div class=\"col-11 d-none d-sm-block\">"
+	} else {
+		size = "<div class=\"col-12 d-block d-sm-none\">"
+	}
+	safeMenu, err := loadMenu()
+	if err != nil {
+		log.Error("Error Loading Menu")
+	}
+	return &Page{
+		NavTitle:   config.SiteTitle,
+		ThemeColor: template.HTML(arcWikiLogo()),
+		CTitle:     title,
+		Title:      title,
+		Body:       template.HTML(bodyHTML),
+		Size:       template.HTML(size),
+		Menu:       safeMenu,
+	}
+}
+
+func loadPageSpecial(r *http.Request, categoryName string, userAgent string) (*Page, error) {
 	//func loadPageSpecial(title string, categoryName string, userAgent string) (*Page, error) {
 	//size := "w-full max-w-7xl mx-auto px-4 py-8"
 
@@ -450,6 +541,7 @@ func loadPageSpecial(categoryName string, userAgent string) (*Page, error) {
 		}
 		defer rows.Close()
 
+		access := readAccessFor(r)
 		var categories []string // Slice to store category names
 		for rows.Next() {
 			var name string
@@ -457,13 +549,16 @@ func loadPageSpecial(categoryName string, userAgent string) (*Page, error) {
 			if err != nil {
 				return nil, err
 			}
+			if !access.canReadCategory(name) {
+				continue
+			}
 			//categories = append(categories, name)
 			categories = append(categories, fmt.Sprintf("<li><a href=\"%sCategory:%s\">%s</a></li>", baseURL, name, name))
 		}
 
 		sort.Strings(categories) // Sort alphabetically
 
-		bodyHTML := fmt.Sprintf("<h2 class=\"wikih2\">All Categories</h2><ul>\n%s\n</ul>", strings.Join(categories, "\n"))
+		bodyHTML := fmt.Sprintf("<h2 class=\"wikih2\">All Categories</h2><p><a href=\"/title/Special:CategoryTree\">View as a tree</a> · <a href=\"/title/Special:WantedCategories\">Wanted categories</a></p><ul>\n%s\n</ul>", strings.Join(categories, "\n"))
 		safeMenu, err := loadMenu()
 		if err != nil {
 			log.Error("Error Loading Menu")
@@ -478,44 +573,6 @@ func loadPageSpecial(categoryName string, userAgent string) (*Page, error) {
 			Size:       template.HTML(size),
 			Menu:       template.HTML(safeMenu),
 		}, nil
-	} else if categoryName == "AllPages" {
-		db, err := db.LoadDatabase()
-		if err != nil {
-			log.Error("Database Error:", err)
-
-		}
-		defer db.Close()
-		// List all pages from the database
-		rows, err := db.Query("SELECT title FROM Pages") // Assuming you have a 'Pages' table with a 'title' column
-		if err != nil {
-			return nil, err
-		}
-		defer rows.Close()
-
-		var pageLinks []string
-		for rows.Next() {
-			var title string
-			err := rows.Scan(&title)
-			if err != nil {
-				return nil, err
-			}
-			pageLinks = append(pageLinks, fmt.Sprintf("<li><a href=\"%s%s\">%s</a></li>", baseURL, title, title))
-		}
-
-		bodyHTML := fmt.Sprintf("<h2 class=\"wikih2\">All Pages</h2><ul>\n%s\n</ul>", strings.Join(pageLinks, "\n"))
-		safeMenu, err := loadMenu()
-		if err != nil {
-			log.Error("Error Loading Menu")
-		}
-		return &Page{
-			NavTitle:   config.SiteTitle,
-			ThemeColor: template.HTML(arcWikiLogo()),
-			CTitle:     "Special:AllPages",
-			Title:      "Special:AllPages",
-			Body:       template.HTML(bodyHTML),
-			Size:       template.HTML(size),
-			Menu:       template.HTML(safeMenu),
-		}, nil
 	} else {
 
 		safeMenu, err := loadMenu()
@@ -0,0 +1,390 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy is the "passwordPolicy" section of config.json
+type PasswordPolicy struct {
+	// 8 if unset
+	MinLength int `json:"minLength"`
+	// file of breached passwords to refuse, one per line, either as they are
+	// or as SHA-1 hex like the Pwned Passwords "HASH:count" downloads
+	BreachList string `json:"breachList"`
+}
+
+// resetTokenLifetime is how long an emailed reset link works
+const resetTokenLifetime = time.Hour
+
+var (
+	breachListOnce   sync.Once
+	breachedPlain    map[string]bool
+	breachedSHA1     map[string]bool
+	errResetTokenBad = errors.New("this reset link is invalid or has expired")
+)
+
+func loadBreachList() {
+	breachedPlain = make(map[string]bool)
+	breachedSHA1 = make(map[string]bool)
+	path := config.PasswordPolicy.BreachList
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("passwordPolicy: can't read breach list: %v", err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if hash, _, _ := strings.Cut(line, ":"); len(hash) == 40 {
+			if _, err := hex.DecodeString(hash); err == nil {
+				breachedSHA1[strings.ToUpper(hash)] = true
+				continue
+			}
+		}
+		if line != "" {
+			breachedPlain[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Errorf("passwordPolicy: can't read breach list: %v", err)
+	}
+	log.Infof("Loaded %d breached passwords", len(breachedPlain)+len(breachedSHA1))
+}
+
+// checkPassword enforces the password policy on a new password
+func checkPassword(password string) error {
+	minLength := config.PasswordPolicy.MinLength
+	if minLength <= 0 {
+		minLength = 8
+	}
+	if n := len([]rune(password)); n < minLength {
+		return fmt.Errorf("the password needs at least %d characters", minLength)
+	}
+	// bcrypt ignores anything after 72 bytes
+	if len(password) > 72 {
+		return errors.New("the password can't be longer than 72 bytes")
+	}
+
+	breachListOnce.Do(loadBreachList)
+	sum := sha1.Sum([]byte(password))
+	if breachedPlain[password] || breachedSHA1[strings.ToUpper(hex.EncodeToString(sum[:]))] {
+		return errors.New("that password has appeared in a data breach, choose another")
+	}
+	return nil
+}
+
+// setPassword checks and stores a new password for an existing account,
+// mustChange makes them choose another one when they next log in
+func setPassword(userID int, password string, mustChange bool) error {
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = authDB.Exec("UPDATE Users SET password = ?, must_change_password = ? WHERE id = ?", hash, boolToInt(mustChange), userID)
+	return err
+}
+
+// resetSignature covers the current password hash, so a link stops working
+// once it has been used or the password has been changed some other way
+func resetSignature(payload string, passwordHash string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte("password-reset." + payload + "." + passwordHash))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func resetToken(userID int, passwordHash string) string {
+	payload := fmt.Sprintf("%d.%d", userID, time.Now().Add(resetTokenLifetime).Unix())
+	return payload + "." + resetSignature(payload, passwordHash)
+}
+
+// verifyResetToken returns the account a reset link is for
+func verifyResetToken(token string) (int, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, "", errResetTokenBad
+	}
+	userID, err1 := strconv.Atoi(parts[0])
+	expires, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || time.Now().Unix() > expires {
+		return 0, "", errResetTokenBad
+	}
+
+	var username, passwordHash string
+	var disabled, pending bool
+	err := authDB.QueryRow("SELECT username, password, disabled, pending FROM Users WHERE id = ?", userID).Scan(&username, &passwordHash, &disabled, &pending)
+	if err == sql.ErrNoRows || disabled || pending {
+		return 0, "", errResetTokenBad
+	} else if err != nil {
+		return 0, "", err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(resetSignature(parts[0]+"."+parts[1], passwordHash))) {
+		return 0, "", errResetTokenBad
+	}
+	return userID, username, nil
+}
+
+func alert(class string, message string) string {
+	return fmt.Sprintf(`<div class="alert %s">%s</div>`, class, html.EscapeString(message))
+}
+
+// accountHandler is /account, where a logged in user sets their email
+// address and changes their password
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r)
+	account := accountState(userID)
+	if account.Group == "" {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	var message string
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "email":
+			email := strings.TrimSpace(r.FormValue("email"))
+			if err := checkEmailAddress(email); err != nil {
+				message, status = alert("alert-danger", "Sorry, "+err.Error()+"."), http.StatusBadRequest
+				break
+			}
+			if _, err := authDB.Exec("UPDATE Users SET email = ? WHERE id = ?", sql.NullString{String: email, Valid: email != ""}, userID); err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			message = alert("alert-success", "Your email address has been saved.")
+
+		case "password":
+			var passwordHash string
+			if err := authDB.QueryRow("SELECT password FROM Users WHERE id = ?", userID).Scan(&passwordHash); err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			password := r.FormValue("password")
+			if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(r.FormValue("current"))) != nil {
+				message, status = alert("alert-danger", "Sorry, your current password is wrong."), http.StatusBadRequest
+			} else if password != r.FormValue("confirm") {
+				message, status = alert("alert-danger", "Sorry, the new passwords don't match."), http.StatusBadRequest
+			} else if err := checkPassword(password); err != nil {
+				message, status = alert("alert-danger", "Sorry, "+err.Error()+"."), http.StatusBadRequest
+			} else if password == r.FormValue("current") {
+				message, status = alert("alert-danger", "Sorry, the new password has to be different."), http.StatusBadRequest
+			} else if err := setPassword(userID, password, false); err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			} else {
+				writeLog(r, "user", "password-change", currentUsername(r), "", "", "")
+				// whoever knew the old one may still be logged in somewhere
+				if _, err := revokeUserSessions(userID, currentSessionID(r)); err != nil {
+					log.Error("Database Error:", err)
+				}
+				account.ChangePassword = false
+				if page := account.setupPage(); page != "" {
+					http.Redirect(w, r, page, http.StatusSeeOther)
+					return
+				}
+				message = alert("alert-success", "Your password has been changed, and any other sessions signed out.")
+			}
+		}
+	}
+
+	var email string
+	if err := authDB.QueryRow("SELECT COALESCE(email, '') FROM Users WHERE id = ?", userID).Scan(&email); err != nil {
+		log.Error("Database Error:", err)
+	}
+	if account.ChangePassword {
+		message = alert("alert-warning", "You have to choose a new password before you can carry on.") + message
+	}
+	body := message + fmt.Sprintf(`<h2 class="wikih2">Email address</h2>
+    <p>Used to send you a link if you forget your password.</p>
+    <form action="/account" method="POST" class="row g-2 mb-4">
+        %[2]s
+        <input type="hidden" name="action" value="email">
+        <div class="col-auto"><input class="form-control form-control-sm" type="email" name="email" value="%[1]s"></div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">Save</button></div>
+    </form>
+    <h2 class="wikih2">Two-factor authentication</h2>
+    <p><a href="/account/2fa">Set up or manage an authenticator app</a></p>
+    <h2 class="wikih2">Sessions</h2>
+    <p><a href="/account/sessions">See where you are logged in, and sign out</a></p>
+    <h2 class="wikih2">Change password</h2>
+    <form action="/account" method="POST">
+        %[2]s
+        <input type="hidden" name="action" value="password">
+        <div class="form-group">
+          <label for="current">Current password:</label>
+          <input class="form-control" type="password" id="current" name="current" autocomplete="current-password" required>
+        </div>
+        <div class="form-group">
+          <label for="password">New password:</label>
+          <input class="form-control" type="password" id="password" name="password" autocomplete="new-password" required>
+        </div>
+        <div class="form-group">
+          <label for="confirm">New password again:</label>
+          <input class="form-control" type="password" id="confirm" name="confirm" autocomplete="new-password" required>
+        </div>
+        <button class="btn btn-outline-secondary mt-2" type="submit">Change password</button>
+    </form>`, html.EscapeString(email), csrfInput(r))
+
+	w.WriteHeader(status)
+	renderTemplate(w, "title", newSpecialPage("Your account", body, getUserAgent(r)))
+}
+
+// resetHandler is /reset. Without a token it takes a username or email
+// address and mails a reset link, with one it sets the new password
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	render := func(body string, status int) {
+		w.WriteHeader(status)
+		renderTemplate(w, "title", newSpecialPage("Reset password", body, getUserAgent(r)))
+	}
+	if !mailEnabled() {
+		render(alert("alert-danger", "Passwords can't be reset by email here, ask an administrator."), http.StatusNotFound)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		if r.Method == http.MethodPost {
+			requestReset(r)
+			// the same answer either way, so this can't be used to find accounts
+			render(alert("alert-success", "If that account has an email address, a reset link is on its way. It works for an hour."), http.StatusOK)
+			return
+		}
+		render(`<p>Enter your username or email address and we'll send you a link to choose a new password.</p>
+    <form action="/reset" method="POST">
+        `+csrfInput(r)+`
+        <div class="form-group">
+          <label for="account">Username or email:</label>
+          <input class="form-control" type="text" id="account" name="account" required>
+        </div>
+        <button class="btn btn-outline-secondary mt-2" type="submit">Send reset link</button>
+    </form>`, http.StatusOK)
+		return
+	}
+
+	userID, username, err := verifyResetToken(token)
+	if err != nil {
+		if !errors.Is(err, errResetTokenBad) {
+			log.Error("Database Error:", err)
+		}
+		render(alert("alert-danger", "Sorry, "+errResetTokenBad.Error()+".")+`<a href="/reset">Send a new link</a>`, http.StatusNotFound)
+		return
+	}
+
+	var message string
+	if r.Method == http.MethodPost {
+		password := r.FormValue("password")
+		if password != r.FormValue("confirm") {
+			message = alert("alert-danger", "Sorry, the passwords don't match.")
+		} else if err := checkPassword(password); err != nil {
+			message = alert("alert-danger", "Sorry, "+err.Error()+".")
+		} else if err := setPassword(userID, password, false); err != nil {
+			log.Error("Database Error:", err)
+			http.Error(w, "Internal DB error", http.StatusInternalServerError)
+			return
+		} else {
+			writeLog(r, "user", "password-reset", username, username, "", "by email")
+			if _, err := revokeUserSessions(userID, ""); err != nil {
+				log.Error("Database Error:", err)
+			}
+			render(alert("alert-success", "Your password has been changed.")+`<a href="/login">Log in</a>`, http.StatusOK)
+			return
+		}
+	}
+	render(message+fmt.Sprintf(`<p>Choose a new password for <b>%s</b>.</p>
+    <form action="/reset" method="POST">
+        %s
+        <input type="hidden" name="token" value="%s">
+        <div class="form-group">
+          <label for="password">New password:</label>
+          <input class="form-control" type="password" id="password" name="password" autocomplete="new-password" required>
+        </div>
+        <div class="form-group">
+          <label for="confirm">New password again:</label>
+          <input class="form-control" type="password" id="confirm" name="confirm" autocomplete="new-password" required>
+        </div>
+        <button class="btn btn-outline-secondary mt-2" type="submit">Set password</button>
+    </form>`, html.EscapeString(username), csrfInput(r), html.EscapeString(token)), http.StatusOK)
+}
+
+// requestReset mails a reset link to the account named in the form, if it
+// has an address. Sending happens in the background so the response time
+// doesn't give away whether it does
+func requestReset(r *http.Request) {
+	account := strings.TrimSpace(r.FormValue("account"))
+	if account == "" {
+		return
+	}
+	var userID int
+	var username, email, passwordHash string
+	err := authDB.QueryRow(`SELECT id, username, email, password FROM Users
+		WHERE (username = ? OR lower(email) = lower(?)) AND email IS NOT NULL AND email != '' AND disabled = 0 AND pending = 0 AND oidc_subject IS NULL
+		ORDER BY username = ? DESC LIMIT 1`, account, account, account).Scan(&userID, &username, &email, &passwordHash)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Error("Database Error:", err)
+		return
+	}
+
+	link := siteURL("/reset?token=" + resetToken(userID, passwordHash))
+	body := fmt.Sprintf(`Someone, hopefully you, asked to reset the password of %s on %s.
+
+Open this link within an hour to choose a new password:
+
+%s
+
+If it wasn't you, ignore this email and your password stays the same.
+`, username, config.SiteTitle, link)
+	writeLog(r, "user", "reset-request", username, "", "", "")
+	go func() {
+		if err := sendMail(email, "Reset your "+config.SiteTitle+" password", body); err != nil {
+			log.Errorf("Sending the password reset for %s failed: %v", username, err)
+		}
+	}()
+}
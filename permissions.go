@@ -0,0 +1,193 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Permissions granted to groups in the "groups" matrix of config.json
+const (
+	PermRead        = "read"
+	PermEdit        = "edit"
+	PermCreate      = "create"
+	PermDelete      = "delete"
+	PermMove        = "move"
+	PermUpload      = "upload"
+	PermProtect     = "protect"
+	PermManageUsers = "manage-users"
+	PermEditConfig  = "edit-config"
+)
+
+var allPermissions = []string{
+	PermRead, PermEdit, PermCreate, PermDelete, PermMove, PermUpload, PermProtect, PermManageUsers, PermEditConfig,
+}
+
+// anonymousGroup is what visitors who aren't logged in belong to
+const anonymousGroup = "anonymous"
+
+// defaultUserGroup is the group of accounts that haven't been given one
+const defaultUserGroup = "editor"
+
+// defaultGroups is used when config.json has no groups
+var defaultGroups = map[string][]string{
+	anonymousGroup: {PermRead},
+	"reader":       {PermRead},
+	"editor":       {PermRead, PermEdit, PermCreate, PermUpload},
+	"moderator":    {PermRead, PermEdit, PermCreate, PermUpload, PermDelete, PermMove, PermProtect},
+	"admin":        allPermissions,
+}
+
+// groups is the permission matrix in force, set by loadGroups
+var groups = buildGroups(defaultGroups)
+
+func buildGroups(matrix map[string][]string) map[string]map[string]bool {
+	built := make(map[string]map[string]bool, len(matrix))
+	for group, perms := range matrix {
+		built[group] = make(map[string]bool, len(perms))
+		for _, perm := range perms {
+			built[group][perm] = true
+		}
+	}
+	return built
+}
+
+// loadGroups replaces the default matrix with the one from config.json,
+// warning about permissions it doesn't know
+func loadGroups(configured map[string][]string) {
+	if len(configured) == 0 {
+		groups = buildGroups(defaultGroups)
+		return
+	}
+	known := make(map[string]bool, len(allPermissions))
+	for _, perm := range allPermissions {
+		known[perm] = true
+	}
+	for group, perms := range configured {
+		for _, perm := range perms {
+			if !known[perm] {
+				log.Warnf("Group %q has unknown permission %q", group, perm)
+			}
+		}
+	}
+	if _, ok := configured["admin"]; !ok {
+		log.Warn("No admin group in config.json, nobody will be able to manage users")
+	}
+	groups = buildGroups(configured)
+}
+
+// groupNames lists the groups a user can be put in, anonymous excluded
+func groupNames() []string {
+	var names []string
+	for name := range groups {
+		if name != anonymousGroup {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AccountState is what a request needs to know about the logged in account
+type AccountState struct {
+	Group          string // "" for disabled, deleted and unapproved accounts
+	TwoFactor      bool   // has an authenticator set up
+	ChangePassword bool   // has to choose a new password first
+	SSO            bool   // logs in through the OIDC provider
+}
+
+// accountState looks the account up on every request so a change applies at
+// once, accounts without a group are admins if is_admin is set and editors otherwise
+func accountState(userID int) AccountState {
+	var a AccountState
+	if userID == 0 {
+		return a
+	}
+	var group sql.NullString
+	var disabled, pending bool
+	err := authDB.QueryRow("SELECT COALESCE(user_group, CASE WHEN is_admin = 1 THEN 'admin' END), disabled, pending, totp_secret IS NOT NULL, must_change_password, oidc_subject IS NOT NULL FROM Users WHERE id = ?", userID).
+		Scan(&group, &disabled, &pending, &a.TwoFactor, &a.ChangePassword, &a.SSO)
+	if err == sql.ErrNoRows || disabled || pending {
+		return AccountState{}
+	} else if err != nil {
+		log.Error("Database Error:", err)
+		return AccountState{}
+	}
+	a.Group = defaultUserGroup
+	if group.Valid {
+		a.Group = group.String
+	}
+	return a
+}
+
+// setupPage is where the user has to go before they get their group's
+// permissions, "" once they're done
+func (a AccountState) setupPage() string {
+	switch {
+	case a.Group == "":
+		return ""
+	case a.ChangePassword:
+		return "/account"
+	case !a.TwoFactor && !a.SSO && twoFactorRequired(a.Group):
+		// the provider is trusted with second factors for SSO accounts
+		return "/account/2fa"
+	}
+	return ""
+}
+
+// userGroup is the group whose permissions the user has. Disabled, deleted
+// and unapproved accounts are anonymous, even with a session, and so are
+// accounts that still have to change their password or set up 2FA
+func userGroup(userID int) string {
+	a := accountState(userID)
+	if a.Group == "" || a.setupPage() != "" {
+		return anonymousGroup
+	}
+	return a.Group
+}
+
+// can reports whether the visitor's group has perm
+func can(r *http.Request, perm string) bool {
+	return groups[userGroup(currentUserID(r))][perm]
+}
+
+// requirePermission sends anonymous visitors to log in, users who still have
+// to change their password or set up 2FA to do that, and everyone else
+// without perm to the error page
+func requirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !can(r, perm) {
+			userID := currentUserID(r)
+			if page := accountState(userID).setupPage(); page != "" {
+				http.Redirect(w, r, page, http.StatusFound)
+			} else if userID == 0 {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			} else {
+				log.Warnf("Permission %q denied to %s for %s", perm, currentUsername(r), r.URL.Path)
+				http.Redirect(w, r, "/error", http.StatusFound)
+			}
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDefaultGroups(t *testing.T) {
+	tests := []struct {
+		group string
+		has   []string
+		lacks []string
+	}{
+		{anonymousGroup, []string{PermRead}, []string{PermEdit}},
+		{"reader", []string{PermRead}, []string{PermEdit, PermCreate}},
+		{"editor", []string{PermEdit, PermCreate, PermUpload}, []string{PermDelete, PermMove, PermProtect}},
+		{"moderator", []string{PermDelete, PermMove, PermProtect}, []string{PermManageUsers, PermEditConfig}},
+		{"admin", allPermissions, nil},
+	}
+	for _, tt := range tests {
+		for _, perm := range tt.has {
+			if !groups[tt.group][perm] {
+				t.Errorf("%s lacks %s", tt.group, perm)
+			}
+		}
+		for _, perm := range tt.lacks {
+			if groups[tt.group][perm] {
+				t.Errorf("%s has %s", tt.group, perm)
+			}
+		}
+	}
+}
+
+// the shipped config.json grants the same as the builtin groups
+func TestShippedConfig(t *testing.T) {
+	configBytes, err := os.ReadFile(filepath.Join(sourceDir, configPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkConfig(configBytes); err != nil {
+		t.Fatal(err)
+	}
+	var c Config
+	json.Unmarshal(configBytes, &c)
+	sorted := func(perms []string) string {
+		perms = append([]string(nil), perms...)
+		sort.Strings(perms)
+		return strings.Join(perms, ",")
+	}
+	for group, perms := range defaultGroups {
+		if sorted(c.Groups[group]) != sorted(perms) {
+			t.Errorf("config.json gives %s %v, the default is %v", group, c.Groups[group], perms)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	loadGroups(map[string][]string{
+		anonymousGroup: {},
+		"viewer":       {PermRead},
+		"admin":        allPermissions,
+	})
+	t.Cleanup(func() { loadGroups(nil) })
+	testUser(t, "Viewer040", "viewer-pass-040", "viewer", "")
+	changeID := testUser(t, "Change040", "change-pass-040", "viewer", "")
+	authDB.Exec("UPDATE Users SET must_change_password = 1 WHERE id = ?", changeID)
+
+	ts, client := newTestServer(t)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	location := func(path string) string {
+		t.Helper()
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return "200"
+		}
+		return resp.Header.Get("Location")
+	}
+
+	// a private wiki: anonymous visitors have nothing, not even read
+	if got := location("/title/Main_Page"); got != "/login" {
+		t.Errorf("anonymous read: %s, want /login", got)
+	}
+
+	submit(t, client, ts.URL+"/login", ts.URL+"/loginPost", url.Values{"username": {"Viewer040"}, "password": {"viewer-pass-040"}})
+	if got := location("/title/Main_Page"); got != "200" {
+		t.Errorf("viewer read: %s, want 200", got)
+	}
+	if got := location("/edit/Main_Page"); got != "/error" {
+		t.Errorf("viewer edit: %s, want /error", got)
+	}
+
+	_, other := newTestServer(t)
+	other.CheckRedirect = client.CheckRedirect
+	client = other
+	submit(t, client, ts.URL+"/login", ts.URL+"/loginPost", url.Values{"username": {"Change040"}, "password": {"change-pass-040"}})
+	if got := location("/title/Main_Page"); got != "/account" {
+		t.Errorf("read before changing the password: %s, want /account", got)
+	}
+}
+
+func TestConfigEditor(t *testing.T) {
+	if err := os.MkdirAll(filepath.Dir(configPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	original := []byte(`{"siteTitle": "Before040"}`)
+	if err := os.WriteFile(configPath, original, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(configPath)) })
+
+	testUser(t, "Mod040", "mod-pass-040", "moderator", "")
+	testUser(t, "Admin040", "admin-pass-040", "admin", "")
+
+	ts, mod := newTestServer(t)
+	login(t, ts, mod, "Mod040", "mod-pass-040")
+	if _, body := get(t, mod, ts.URL+"/admin/config"); strings.Contains(body, "Before040") {
+		t.Error("a moderator can read the configuration")
+	}
+
+	_, admin := newTestServer(t)
+	login(t, ts, admin, "Admin040", "admin-pass-040")
+	page := ts.URL + "/admin/config"
+	if _, body := get(t, admin, page); !strings.Contains(body, "Before040") {
+		t.Fatal("the editor doesn't show config.json")
+	}
+
+	refused := map[string]string{
+		`{"siteTitle": `:                             "invalid configuration",
+		`{"siteTitel": "typo"}`:                      "unknown field",
+		`{"groups": {"admin": ["read", "fly"]}}`:     `unknown permission &#34;fly&#34;`,
+		`{"groups": {"admin": ["read", "edit"]}}`:    "no group would have the edit-config permission",
+		`{"groups": {"anonymous": ["edit-config"]}}`: "no group would have the edit-config permission",
+	}
+	for edited, want := range refused {
+		status, body := submit(t, admin, page, page, url.Values{"config": {edited}})
+		if status != http.StatusBadRequest || !strings.Contains(body, want) {
+			t.Errorf("saving %s: status %d, want 400 with %q", edited, status, want)
+		}
+	}
+	if saved, _ := os.ReadFile(configPath); string(saved) != string(original) {
+		t.Fatalf("a refused config was written: %s", saved)
+	}
+
+	edited := "{\r\n  \"siteTitle\": \"After040\",\r\n  \"groups\": {\"admin\": [\"read\", \"edit-config\"]}\r\n}"
+	_, body := submit(t, admin, page, page, url.Values{"config": {edited}})
+	if !strings.Contains(body, "Restart ArcWiki") {
+		t.Error("no word that a restart is needed")
+	}
+	saved, _ := os.ReadFile(configPath)
+	if string(saved) != strings.ReplaceAll(edited, "\r\n", "\n") {
+		t.Errorf("config.json is now %q", saved)
+	}
+	if config.SiteTitle == "After040" {
+		t.Error("the running configuration changed without a restart")
+	}
+
+	entries, err := queryLogs(LogFilter{Type: "config", Username: "Admin040", AdminView: true, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Details, "sha256:") {
+		t.Fatalf("config change log: %+v", entries)
+	}
+	// the restart that picks it up doesn't log it a second time
+	logConfigChange(nil, saved)
+	var last LogEntry
+	latest, _ := queryLogs(LogFilter{Type: "config", AdminView: true, Limit: 1})
+	if len(latest) == 1 {
+		last = latest[0]
+	}
+	if last.ID != entries[0].ID {
+		t.Error("the same config.json was logged again at startup")
+	}
+}
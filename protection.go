@@ -0,0 +1,384 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// Protection limits editing or moving a title to a group and every group
+// with at least its permissions. Titles are protected whether or not the
+// page exists, so a deleted page can't be recreated either
+type Protection struct {
+	Action    string // "edit" or "move"
+	Level     string // group name
+	Reason    string
+	Username  string
+	ExpiresAt sql.NullTime
+}
+
+var protectionActions = []string{"edit", "move"}
+
+// protectionExpiries are the choices on the protect form, "" never expires
+var protectionExpiries = []struct{ value, label string }{
+	{"", "Never"},
+	{"1d", "1 day"},
+	{"1w", "1 week"},
+	{"1m", "1 month"},
+	{"3m", "3 months"},
+	{"1y", "1 year"},
+}
+
+func expiryTime(value string, now time.Time) (sql.NullTime, error) {
+	var t time.Time
+	switch value {
+	case "":
+		return sql.NullTime{}, nil
+	case "1d":
+		t = now.AddDate(0, 0, 1)
+	case "1w":
+		t = now.AddDate(0, 0, 7)
+	case "1m":
+		t = now.AddDate(0, 1, 0)
+	case "3m":
+		t = now.AddDate(0, 3, 0)
+	case "1y":
+		t = now.AddDate(1, 0, 0)
+	default:
+		return sql.NullTime{}, fmt.Errorf("unknown expiry %q", value)
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}, nil
+}
+
+// meetsLevel reports whether group has every permission the level group has
+func meetsLevel(group string, level string) bool {
+	if level == "" || group == level {
+		return true
+	}
+	required, ok := groups[level]
+	if !ok {
+		return false
+	}
+	for perm := range required {
+		if !groups[group][perm] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadProtections returns the unexpired protections of a title by action
+func loadProtections(title string) (map[string]Protection, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	rows, err := dbConn.Query(`SELECT action, level, COALESCE(reason, ''), COALESCE(Users.username, ''), expires_at
+		FROM PageProtections LEFT JOIN Users ON Users.id = PageProtections.user_id WHERE title = ?`, title)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	protections := make(map[string]Protection)
+	now := time.Now()
+	for rows.Next() {
+		var p Protection
+		if err := rows.Scan(&p.Action, &p.Level, &p.Reason, &p.Username, &p.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if p.ExpiresAt.Valid && p.ExpiresAt.Time.Before(now) {
+			continue
+		}
+		protections[p.Action] = p
+	}
+	return protections, rows.Err()
+}
+
+// namespaceProtection is the edit level config.json sets for a title's
+// namespace, the Main namespace is keyed "Main"
+func namespaceProtection(title string) string {
+	ns, _ := splitTitle(title)
+	name := ns.Name
+	if ns.ID == NamespaceMain {
+		name = "Main"
+	}
+	return config.NamespaceProtection[name]
+}
+
+// editRestrictions lists the levels a user must meet to edit title, the
+// page's own protection and its namespace's
+func editRestrictions(title string) []Protection {
+	var levels []Protection
+	if level := namespaceProtection(title); level != "" {
+		levels = append(levels, Protection{Action: "edit", Level: level, Reason: "namespace protection"})
+	}
+	protections, err := loadProtections(title)
+	if err != nil {
+		log.Error("Database Error:", err)
+		// fail closed rather than let anyone edit a protected page
+		return append(levels, Protection{Action: "edit", Level: "admin"})
+	}
+	if p, ok := protections["edit"]; ok {
+		levels = append(levels, p)
+	}
+	return levels
+}
+
+// canEditTitle checks the visitor against a title's protection, returning
+// the protection that stopped them
+func canEditTitle(r *http.Request, title string) (bool, Protection) {
+	group := userGroup(currentUserID(r))
+	for _, p := range editRestrictions(title) {
+		if !meetsLevel(group, p.Level) {
+			return false, p
+		}
+	}
+	return true, Protection{}
+}
+
+// moveRestrictions is editRestrictions for moving title, which also needs
+// its move protection met
+func moveRestrictions(title string) []Protection {
+	levels := editRestrictions(title)
+	protections, err := loadProtections(title)
+	if err != nil {
+		log.Error("Database Error:", err)
+		return append(levels, Protection{Action: "move", Level: "admin"})
+	}
+	if p, ok := protections["move"]; ok {
+		levels = append(levels, p)
+	}
+	return levels
+}
+
+// canMoveTitle is canEditTitle for moving a page away from title
+func canMoveTitle(r *http.Request, title string) (bool, Protection) {
+	group := userGroup(currentUserID(r))
+	for _, p := range moveRestrictions(title) {
+		if !meetsLevel(group, p.Level) {
+			return false, p
+		}
+	}
+	return true, Protection{}
+}
+
+// protectionNotice explains why a page can't be edited or moved
+func protectionNotice(title string, p Protection) string {
+	action := p.Action
+	if action == "" {
+		action = "edit"
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`<div class="alert alert-warning"><i class="ri-lock-line"></i> <a href="/title/%s">%s</a> is protected so that only the %s group can %s it.`,
+		url.PathEscape(title), html.EscapeString(removeUnderscores(title)), html.EscapeString(p.Level), action))
+	if p.Reason != "" {
+		b.WriteString(fmt.Sprintf(` Reason: <i>%s</i>.`, html.EscapeString(p.Reason)))
+	}
+	if p.ExpiresAt.Valid {
+		b.WriteString(fmt.Sprintf(` The protection expires on %s.`, formatDateTime(p.ExpiresAt.Time)))
+	}
+	b.WriteString(`</div>`)
+	return b.String()
+}
+
+// denyProtected shows the notice with a 403 in place of the editor
+func denyProtected(w http.ResponseWriter, r *http.Request, title string, p Protection) {
+	log.Warnf("%s of protected %s denied to %s", p.Action, title, currentUsername(r))
+	w.WriteHeader(http.StatusForbidden)
+	renderTemplate(w, "title", newSpecialPage("Protected page", protectionNotice(title, p), getUserAgent(r)))
+}
+
+// protectionSummary is the tooltip of the lock icon in title.html, empty for
+// titles anyone who can edit may edit
+func protectionSummary(title string) string {
+	protections, err := loadProtections(title)
+	if err != nil {
+		log.Error("Database Error:", err)
+		return ""
+	}
+	var parts []string
+	if level := namespaceProtection(title); level != "" {
+		parts = append(parts, fmt.Sprintf("this namespace can only be edited by %s", level))
+	}
+	for _, action := range protectionActions {
+		if p, ok := protections[action]; ok {
+			parts = append(parts, fmt.Sprintf("%s restricted to %s", map[string]string{"edit": "editing", "move": "moving"}[action], p.Level))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	summary := strings.Join(parts, ", ")
+	return strings.ToUpper(summary[:1]) + summary[1:]
+}
+
+// protectHandler shows the protect form for /protect/<title> and saves it on POST
+func protectHandler(w http.ResponseWriter, r *http.Request) {
+	title := canonicalizeTitle(strings.TrimPrefix(r.URL.Path, "/protect/"))
+	if ns, _ := splitTitle(title); ns.ID == NamespaceSpecial || title == "" {
+		http.Error(w, "Special pages can't be protected", http.StatusBadRequest)
+		return
+	}
+
+	protections, err := loadProtections(title)
+	if err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+	// nobody can change a protection above their own group
+	group := userGroup(currentUserID(r))
+	for _, p := range protections {
+		if !meetsLevel(group, p.Level) {
+			denyProtected(w, r, title, p)
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "title", newSpecialPage("Protect "+removeUnderscores(title), protectForm(r, title, protections), getUserAgent(r)))
+		return
+	}
+
+	levels := make(map[string]string)
+	for _, action := range protectionActions {
+		level := r.FormValue(action)
+		if _, ok := groups[level]; level != "" && (!ok || level == anonymousGroup) {
+			http.Error(w, fmt.Sprintf("Unknown group %q", level), http.StatusBadRequest)
+			return
+		}
+		if !meetsLevel(group, level) {
+			http.Error(w, fmt.Sprintf("You can't protect a page above your own group (%s)", group), http.StatusForbidden)
+			return
+		}
+		levels[action] = level
+	}
+	expiry := r.FormValue("expiry")
+	expiresAt, err := expiryTime(expiry, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+
+	if err := saveProtection(title, levels, expiresAt, reason, currentUserID(r)); err != nil {
+		log.Error("Error saving protection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	action := "unprotect"
+	var details []string
+	for _, a := range protectionActions {
+		if levels[a] != "" {
+			action = "protect"
+			details = append(details, fmt.Sprintf("%s=%s", a, levels[a]))
+		}
+	}
+	if action == "protect" && expiresAt.Valid {
+		details = append(details, "expires "+formatDateTime(expiresAt.Time))
+	}
+	writeLog(r, "protect", action, currentUsername(r), title, reason, strings.Join(details, " "))
+	http.Redirect(w, r, "/title/"+url.PathEscape(title), http.StatusFound)
+}
+
+// saveProtection replaces every protection of a title, an empty level removes it
+func saveProtection(title string, levels map[string]string, expiresAt sql.NullTime, reason string, userID int) error {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM PageProtections WHERE title = ?", title); err != nil {
+		return err
+	}
+	for _, action := range protectionActions {
+		if levels[action] == "" {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO PageProtections (title, action, level, reason, user_id, expires_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`, title, action, levels[action], reason, nullUserID(userID), expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func protectForm(r *http.Request, title string, protections map[string]Protection) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf(`<h2 class="wikih2">Protect <a href="/title/%s">%s</a></h2>`, url.PathEscape(title), html.EscapeString(removeUnderscores(title))))
+	if level := namespaceProtection(title); level != "" {
+		b.WriteString(fmt.Sprintf(`<p>Everything in this namespace can only be edited by the %s group, whatever is set here.</p>`, html.EscapeString(level)))
+	}
+	for _, p := range protections {
+		if p.Username != "" {
+			b.WriteString(fmt.Sprintf(`<p class="text-muted">Last protected by <a href="/title/User:%s">%s</a>.</p>`, url.PathEscape(p.Username), html.EscapeString(p.Username)))
+			break
+		}
+	}
+
+	b.WriteString(fmt.Sprintf(`<form action="/protect/%s" method="POST">%s`, url.PathEscape(title), csrfInput(r)))
+	labels := map[string]string{"edit": "Edit", "move": "Move"}
+	reason := ""
+	for _, action := range protectionActions {
+		current := protections[action]
+		if current.Reason != "" {
+			reason = current.Reason
+		}
+		b.WriteString(fmt.Sprintf(`<div class="mb-2"><label for="%s">%s:</label> <select class="form-select form-select-sm" id="%s" name="%s"><option value="">Allow everyone who can %s</option>`,
+			action, labels[action], action, action, action))
+		for _, group := range groupNames() {
+			selected := ""
+			if group == current.Level {
+				selected = " selected"
+			}
+			b.WriteString(fmt.Sprintf(`<option value="%s"%s>Only %s</option>`, html.EscapeString(group), selected, html.EscapeString(group)))
+		}
+		b.WriteString(`</select></div>`)
+	}
+	b.WriteString(`<div class="mb-2"><label for="expiry">Expires:</label> <select class="form-select form-select-sm" id="expiry" name="expiry">`)
+	for _, e := range protectionExpiries {
+		b.WriteString(fmt.Sprintf(`<option value="%s">%s</option>`, e.value, e.label))
+	}
+	b.WriteString(fmt.Sprintf(`</select></div>
+        <div class="mb-2"><label for="reason">Reason:</label> <input class="form-control" type="text" id="reason" name="reason" value="%s"></div>
+        <button class="btn btn-sm btn-outline-secondary" type="submit">Save</button>
+        <a href="/title/%s">Cancel</a>
+    </form>`, html.EscapeString(reason), url.PathEscape(title)))
+	return b.String()
+}
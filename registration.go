@@ -0,0 +1,290 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Registration is the "registration" section of config.json. Invites work
+// whether or not Open is set
+type Registration struct {
+	// let visitors request an account from the login page, held until an admin approves it
+	Open bool `json:"open"`
+	// when set, requests need an email address at one of these domains
+	AllowedEmailDomains []string `json:"allowedEmailDomains"`
+	// how long an invite link stays valid, 7 days if unset
+	InviteDays int `json:"inviteDays"`
+}
+
+// Invite is an unused invite link, the token itself is only shown once
+type Invite struct {
+	ID        int
+	Group     string
+	Note      string
+	CreatedBy string
+	ExpiresAt time.Time
+}
+
+// errInviteInvalid is returned for an invite token that is unknown, used or expired
+var errInviteInvalid = errors.New("this invite link is invalid, has been used or has expired")
+
+func hashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createInvite stores a new invite into group and returns its token
+func createInvite(group string, note string, createdBy int) (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	days := config.Registration.InviteDays
+	if days <= 0 {
+		days = 7
+	}
+	_, err := authDB.Exec(`INSERT INTO Invites (token_hash, user_group, note, created_by, expires_at)
+		VALUES (?, ?, ?, ?, datetime('now', ?))`,
+		hashInviteToken(token), group, note, nullUserID(createdBy), fmt.Sprintf("+%d days", days))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookupInvite returns the group an unused, unexpired invite puts its user in
+func lookupInvite(token string) (string, error) {
+	var group string
+	err := authDB.QueryRow(`SELECT user_group FROM Invites
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > datetime('now')`, hashInviteToken(token)).Scan(&group)
+	if err == sql.ErrNoRows {
+		return "", errInviteInvalid
+	}
+	return group, err
+}
+
+// loadInvites lists the invites that can still be used
+func loadInvites() ([]Invite, error) {
+	rows, err := authDB.Query(`SELECT Invites.id, Invites.user_group, COALESCE(Invites.note, ''), COALESCE(Users.username, ''), Invites.expires_at
+		FROM Invites LEFT JOIN Users ON Users.id = Invites.created_by
+		WHERE Invites.used_at IS NULL AND Invites.expires_at > datetime('now')
+		ORDER BY Invites.expires_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		var i Invite
+		if err := rows.Scan(&i.ID, &i.Group, &i.Note, &i.CreatedBy, &i.ExpiresAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// checkEmailAddress accepts a bare address or nothing
+func checkEmailAddress(email string) error {
+	if email == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("that isn't a valid email address")
+	}
+	return nil
+}
+
+// checkEmail validates the address given with an account request against
+// allowedEmailDomains, the address is optional when no domains are set
+func checkEmail(email string) error {
+	domains := config.Registration.AllowedEmailDomains
+	if email == "" && len(domains) > 0 {
+		return errors.New("an email address is needed")
+	}
+	if err := checkEmailAddress(email); err != nil || len(domains) == 0 {
+		return err
+	}
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, allowed := range domains {
+		if domain == strings.ToLower(strings.TrimPrefix(allowed, "@")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("accounts can only be requested with an address at %s", strings.Join(domains, ", "))
+}
+
+// registerHandler is /register. With ?invite= it creates the account straight
+// away in the invite's group, otherwise it files a request for an admin to
+// approve, if registration is open
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("invite")
+	group := defaultUserGroup
+	if token != "" {
+		var err error
+		if group, err = lookupInvite(token); err != nil {
+			if !errors.Is(err, errInviteInvalid) {
+				log.Error("Database Error:", err)
+			}
+			renderRegister(w, r, "", "Sorry, "+errInviteInvalid.Error()+".", http.StatusNotFound)
+			return
+		}
+	} else if !config.Registration.Open {
+		renderRegister(w, r, "", "Accounts can't be requested here, ask an administrator for an invite.", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		renderRegister(w, r, token, "", http.StatusOK)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	email := strings.TrimSpace(r.FormValue("email"))
+	password := r.FormValue("password")
+	if err := validUsername(username); err != nil {
+		renderRegister(w, r, token, "Sorry, "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	if password != r.FormValue("confirm") {
+		renderRegister(w, r, token, "Sorry, the passwords don't match.", http.StatusBadRequest)
+		return
+	}
+	if err := checkPassword(password); err != nil {
+		renderRegister(w, r, token, "Sorry, "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	if token == "" {
+		// an admin chose who to invite, so only requests are held to the domains
+		if err := checkEmail(email); err != nil {
+			renderRegister(w, r, token, "Sorry, "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+	} else if err := checkEmailAddress(email); err != nil {
+		renderRegister(w, r, token, "Sorry, "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	if findUsername(username) != "" {
+		renderRegister(w, r, token, "Sorry, "+errUserExists.Error()+".", http.StatusConflict)
+		return
+	}
+
+	if token != "" {
+		// claim the invite first so it can't be used twice at once
+		res, err := authDB.Exec(`UPDATE Invites SET used_at = CURRENT_TIMESTAMP
+			WHERE token_hash = ? AND used_at IS NULL AND expires_at > datetime('now')`, hashInviteToken(token))
+		if err != nil {
+			log.Error("Database Error:", err)
+			http.Error(w, "Internal DB error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			renderRegister(w, r, "", "Sorry, "+errInviteInvalid.Error()+".", http.StatusNotFound)
+			return
+		}
+	}
+
+	userID, err := addUser(username, password, group, email, token == "")
+	if err != nil {
+		if token != "" {
+			authDB.Exec("UPDATE Invites SET used_at = NULL WHERE token_hash = ?", hashInviteToken(token))
+		}
+		if errors.Is(err, errUserExists) {
+			renderRegister(w, r, token, "Sorry, "+err.Error()+".", http.StatusConflict)
+			return
+		}
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+
+	var message string
+	if token != "" {
+		if _, err := authDB.Exec("UPDATE Invites SET used_by = ? WHERE token_hash = ?", userID, hashInviteToken(token)); err != nil {
+			log.Error("Database Error:", err)
+		}
+		writeLog(r, "user", "register", username, "", "", "invited, group="+group)
+		message = `<div class="alert alert-success">Your account has been created. <a href="/login">Log in</a></div>`
+	} else {
+		writeLog(r, "user", "request", username, "", "", "")
+		message = `<div class="alert alert-success">Thanks, your request has been sent. You can log in once an administrator has approved it.</div>`
+	}
+	renderTemplate(w, "title", newSpecialPage("Create account", message, getUserAgent(r)))
+}
+
+func renderRegister(w http.ResponseWriter, r *http.Request, token string, message string, status int) {
+	var b strings.Builder
+	if message != "" {
+		b.WriteString(fmt.Sprintf(`<div class="alert alert-danger">%s</div>`, html.EscapeString(message)))
+	}
+	if status == http.StatusNotFound {
+		w.WriteHeader(status)
+		renderTemplate(w, "title", newSpecialPage("Create account", b.String(), getUserAgent(r)))
+		return
+	}
+
+	emailNote := "optional"
+	if token == "" {
+		if domains := config.Registration.AllowedEmailDomains; len(domains) > 0 {
+			emailNote = "at " + strings.Join(domains, ", ")
+		}
+		b.WriteString(`<p>New accounts are checked by an administrator before they can be used.</p>`)
+	}
+	b.WriteString(fmt.Sprintf(`<form action="/register" method="POST">
+        %s
+        <input type="hidden" name="invite" value="%s">
+        <div class="form-group">
+          <label for="username">Username:</label>
+          <input class="form-control" type="text" id="username" name="username" value="%s" required>
+        </div>
+        <div class="form-group">
+          <label for="email">Email (%s):</label>
+          <input class="form-control" type="email" id="email" name="email" value="%s">
+        </div>
+        <div class="form-group">
+          <label for="password">Password:</label>
+          <input class="form-control" type="password" id="password" name="password" autocomplete="new-password" required>
+        </div>
+        <div class="form-group">
+          <label for="confirm">Password again:</label>
+          <input class="form-control" type="password" id="confirm" name="confirm" autocomplete="new-password" required>
+        </div>
+        <button class="btn btn-outline-secondary mt-2" type="submit">Create account</button>
+    </form>`, csrfInput(r), html.EscapeString(token), html.EscapeString(r.FormValue("username")), html.EscapeString(emailNote), html.EscapeString(r.FormValue("email"))))
+
+	w.WriteHeader(status)
+	renderTemplate(w, "title", newSpecialPage("Create account", b.String(), getUserAgent(r)))
+}
@@ -0,0 +1,140 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// withRegistration sets the registration section of the config for one test
+func withRegistration(t *testing.T, reg Registration) {
+	saved := config.Registration
+	config.Registration = reg
+	t.Cleanup(func() { config.Registration = saved })
+}
+
+// forgetUser deletes an account made through /register once the test ends
+func forgetUser(t *testing.T, username string) {
+	t.Cleanup(func() {
+		var id int
+		if authDB.QueryRow("SELECT id FROM Users WHERE username = ?", username).Scan(&id) == nil {
+			deleteAccount(id, "1")
+		}
+	})
+}
+
+func TestCheckEmail(t *testing.T) {
+	withRegistration(t, Registration{AllowedEmailDomains: []string{"@Example.org"}})
+	for email, ok := range map[string]bool{
+		"someone@example.org":     true,
+		"someone@EXAMPLE.org":     true,
+		"someone@example.com":     false,
+		"someone@sub.example.org": false,
+		"":                        false,
+		"not an address":          false,
+	} {
+		if err := checkEmail(email); (err == nil) != ok {
+			t.Errorf("checkEmail(%q) = %v", email, err)
+		}
+	}
+
+	config.Registration.AllowedEmailDomains = nil
+	if err := checkEmail(""); err != nil {
+		t.Errorf("an email address was needed without allowed domains: %v", err)
+	}
+}
+
+func TestRegistrationClosed(t *testing.T) {
+	withRegistration(t, Registration{})
+	ts, client := newTestServer(t)
+	if status, body := get(t, client, ts.URL+"/register"); status != http.StatusNotFound || strings.Contains(body, `name="username"`) {
+		t.Errorf("GET /register while closed: status %d, want 404 without the form", status)
+	}
+}
+
+func TestRegistrationNeedsApproval(t *testing.T) {
+	withRegistration(t, Registration{Open: true, AllowedEmailDomains: []string{"example.org"}})
+	testUser(t, "Admin044", "admin-pass-044", "admin", "")
+	forgetUser(t, "Asker044")
+
+	ts, client := newTestServer(t)
+	form := url.Values{"username": {"Asker044"}, "email": {"asker@example.com"}, "password": {"asker-pass-044"}, "confirm": {"asker-pass-044"}}
+	if status, _ := submit(t, client, ts.URL+"/register", ts.URL+"/register", form); status != http.StatusBadRequest || findUsername("Asker044") != "" {
+		t.Fatalf("request from a disallowed domain: status %d", status)
+	}
+	form.Set("email", "asker@example.org")
+	if _, body := submit(t, client, ts.URL+"/register", ts.URL+"/register", form); !strings.Contains(body, "your request has been sent") {
+		t.Fatal("the account request wasn't accepted")
+	}
+	if _, _, err := Authenticate("Asker044", "asker-pass-044"); !errors.Is(err, errAccountPending) {
+		t.Fatalf("logging in before approval: %v, want errAccountPending", err)
+	}
+
+	var id int
+	authDB.QueryRow("SELECT id FROM Users WHERE username = 'Asker044'").Scan(&id)
+	_, admin := newTestServer(t)
+	login(t, ts, admin, "Admin044", "admin-pass-044")
+	if status, _ := submit(t, admin, ts.URL+"/admin/users", ts.URL+"/admin/users", url.Values{"action": {"approve"}, "id": {strconv.Itoa(id)}, "group": {"reader"}}); status != http.StatusOK {
+		t.Fatalf("approving: status %d", status)
+	}
+	if userID, _, err := Authenticate("Asker044", "asker-pass-044"); err != nil || userID != id {
+		t.Fatalf("logging in after approval: %d, %v", userID, err)
+	}
+	if group := userGroup(id); group != "reader" {
+		t.Errorf("approved into %q, want reader", group)
+	}
+}
+
+func TestInviteRegistration(t *testing.T) {
+	withRegistration(t, Registration{AllowedEmailDomains: []string{"example.org"}})
+	token, err := createInvite("moderator", "for the test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { authDB.Exec("DELETE FROM Invites WHERE token_hash = ?", hashInviteToken(token)) })
+	forgetUser(t, "Invited044")
+	forgetUser(t, "Second044")
+
+	ts, client := newTestServer(t)
+	page := ts.URL + "/register?invite=" + url.QueryEscape(token)
+	// registration is closed and the address is outside the allowed domains,
+	// neither applies to an invite
+	form := url.Values{"username": {"Invited044"}, "email": {"invited@example.com"}, "password": {"invited-pass-044"}, "confirm": {"invited-pass-044"}}
+	if _, body := submit(t, client, page, page, form); !strings.Contains(body, "Your account has been created") {
+		t.Fatal("the invite didn't create the account")
+	}
+	id, _, err := Authenticate("Invited044", "invited-pass-044")
+	if err != nil || id == 0 {
+		t.Fatalf("logging in with the invited account: %d, %v", id, err)
+	}
+	if group := userGroup(id); group != "moderator" {
+		t.Errorf("invited into %q, want moderator", group)
+	}
+
+	if status, _ := get(t, client, page); status != http.StatusNotFound {
+		t.Errorf("reusing the invite: status %d, want 404", status)
+	}
+	if _, err := lookupInvite(token); !errors.Is(err, errInviteInvalid) {
+		t.Errorf("a used invite still looks up: %v", err)
+	}
+}
@@ -113,12 +113,16 @@ func QueryHandler(w http.ResponseWriter, r *http.Request) {
 		CTitle:     "Search Results",
 	}
 
+	access := readAccessFor(r)
 	for rows.Next() {
 		var result Result
 		if err := rows.Scan(&result.Title, &result.Body); err != nil {
 			log.Error("Row scan error:", err)
 			continue
 		}
+		if !access.canRead(result.Title) {
+			continue
+		}
 		words := strings.Fields(result.Body)
 		if len(words) > 7 {
 			result.Body = strings.Join(words[:7], " ") + "..."
@@ -169,6 +173,7 @@ func SearchHandler(w http.ResponseWriter, r *http.Request, title string, userAge
 				return
 			}
 
+			p.CSRF = csrfToken(r)
 			renderTemplate(w, "search", p)
 
 		}
@@ -181,6 +186,7 @@ func SearchHandler(w http.ResponseWriter, r *http.Request, title string, userAge
 			//http.Redirect(w, r, "/title/Main_Page", http.StatusFound)
 			return
 		}
+		p.CSRF = csrfToken(r)
 		renderTemplate(w, "search", p)
 	}
 
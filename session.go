@@ -0,0 +1,366 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// A logged-in session is kept in the Sessions table and its cookie only holds
+// the signed session id, so it can be listed and ended from the server.
+// Everyone else gets the whole session in the cookie as before, there is
+// nothing in it worth revoking and it saves a row for every visitor
+const (
+	sessionIDKey = "session_id"
+	// how often last_seen is written for a session that is only being read
+	sessionTouchEvery = time.Minute
+)
+
+// dbStore is a gorilla sessions.Store on top of authDB
+type dbStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newDBStore(keyPairs ...[]byte) *dbStore {
+	return &dbStore{
+		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{Path: "/", MaxAge: 86400 * 7},
+	}
+}
+
+// Get returns the session for this request, loaded once per request
+func (s *dbStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the cookie. A session that was signed out
+// elsewhere or has expired comes back new and empty
+func (s *dbStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	values := make(map[interface{}]interface{})
+	if err := securecookie.DecodeMulti(name, c.Value, &values, s.Codecs...); err != nil {
+		return session, err
+	}
+	id, ok := values[sessionIDKey].(string)
+	if !ok {
+		// a login from before sessions were kept here can't be revoked, so it doesn't count
+		if auth, _ := values["authenticated"].(bool); !auth {
+			session.Values = values
+			session.IsNew = false
+		}
+		return session, nil
+	}
+
+	var data []byte
+	var lastSeen time.Time
+	err = authDB.QueryRow("SELECT data, last_seen FROM Sessions WHERE token_hash = ? AND expires_at > datetime('now')", hashSessionID(id)).
+		Scan(&data, &lastSeen)
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.Values = values
+	session.IsNew = false
+
+	if time.Since(lastSeen) > sessionTouchEvery {
+		if _, err := authDB.Exec("UPDATE Sessions SET last_seen = CURRENT_TIMESTAMP, ip = ? WHERE token_hash = ?", clientIP(r), hashSessionID(id)); err != nil {
+			log.Error("Database Error:", err)
+		}
+	}
+	return session, nil
+}
+
+// Save writes a logged-in session to the table and its id to the cookie,
+// anything else goes in the cookie. A negative MaxAge deletes the session
+func (s *dbStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := revokeSession(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	cookieValues := session.Values
+	userID, _ := session.Values["user_id"].(int)
+	if auth, _ := session.Values["authenticated"].(bool); auth && userID != 0 {
+		if session.ID == "" {
+			session.ID = newSessionID()
+		}
+		if err := s.store(r, session, userID); err != nil {
+			return err
+		}
+		cookieValues = map[interface{}]interface{}{sessionIDKey: session.ID}
+	} else if session.ID != "" {
+		// logged out, so it goes back to living in the cookie
+		if err := revokeSession(session.ID); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), cookieValues, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *dbStore) store(r *http.Request, session *sessions.Session, userID int) error {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = s.Options.MaxAge
+	}
+	_, err := authDB.Exec(`INSERT INTO Sessions (token_hash, user_id, data, user_agent, ip, expires_at)
+		VALUES (?, ?, ?, ?, ?, datetime('now', ?))
+		ON CONFLICT(token_hash) DO UPDATE SET user_id = excluded.user_id, data = excluded.data, ip = excluded.ip,
+			last_seen = CURRENT_TIMESTAMP, expires_at = excluded.expires_at`,
+		hashSessionID(session.ID), userID, data.Bytes(), r.UserAgent(), clientIP(r), fmt.Sprintf("+%d seconds", maxAge))
+	return err
+}
+
+func newSessionID() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("auth: cannot generate session id: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// hashSessionID is what the table keeps, so a copy of the database can't be used to log in
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// renewSession gives a session a fresh id when someone logs in with it
+func renewSession(session *sessions.Session) {
+	if session.ID == "" {
+		return
+	}
+	if err := revokeSession(session.ID); err != nil {
+		log.Error("Database Error:", err)
+	}
+	session.ID = ""
+}
+
+func revokeSession(id string) error {
+	_, err := authDB.Exec("DELETE FROM Sessions WHERE token_hash = ?", hashSessionID(id))
+	return err
+}
+
+// revokeUserSessions signs a user out everywhere, except for the session
+// with id keep when it is set
+func revokeUserSessions(userID int, keep string) (int64, error) {
+	res, err := authDB.Exec("DELETE FROM Sessions WHERE user_id = ? AND token_hash != ?", userID, hashSessionID(keep))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// currentSessionID is the id of the visitor's session, "" unless logged in
+func currentSessionID(r *http.Request) string {
+	session, _ := store.Get(r, "cookie-name")
+	return session.ID
+}
+
+// purgeSessions forgets sessions that have expired
+func purgeSessions() error {
+	_, err := authDB.Exec("DELETE FROM Sessions WHERE expires_at <= datetime('now')")
+	return err
+}
+
+// UserSession is a row of /account/sessions
+type UserSession struct {
+	ID        int
+	Current   bool
+	UserAgent string
+	IP        string
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+func loadUserSessions(userID int, current string) ([]UserSession, error) {
+	rows, err := authDB.Query(`SELECT id, token_hash = ?, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_seen
+		FROM Sessions WHERE user_id = ? AND expires_at > datetime('now') ORDER BY last_seen DESC`, hashSessionID(current), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []UserSession
+	for rows.Next() {
+		var s UserSession
+		if err := rows.Scan(&s.ID, &s.Current, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeen); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// describeDevice turns a user agent into something like "Firefox on Windows"
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	pick := func(names [][2]string) string {
+		for _, n := range names {
+			if strings.Contains(userAgent, n[0]) {
+				return n[1]
+			}
+		}
+		return ""
+	}
+	// order matters, Edge and Chrome both claim to be Safari
+	browser := pick([][2]string{{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"}})
+	system := pick([][2]string{{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"}})
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	if len(userAgent) > 60 {
+		userAgent = userAgent[:60] + "…"
+	}
+	return userAgent
+}
+
+// sessionsHandler is /account/sessions, where people see where they are
+// logged in and can sign any of it out
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	current := currentSessionID(r)
+
+	var message string
+	if r.Method == http.MethodPost {
+		switch r.FormValue("action") {
+		case "revoke":
+			id, _ := strconv.Atoi(r.FormValue("id"))
+			res, err := authDB.Exec("DELETE FROM Sessions WHERE id = ? AND user_id = ? AND token_hash != ?", id, userID, hashSessionID(current))
+			if err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				message = alert("alert-danger", "That session has already ended.")
+			} else {
+				message = alert("alert-success", "That session has been signed out.")
+			}
+		case "revoke-others":
+			n, err := revokeUserSessions(userID, current)
+			if err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			message = alert("alert-success", fmt.Sprintf("Signed out of %d other session(s).", n))
+		case "revoke-all":
+			if _, err := revokeUserSessions(userID, ""); err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			writeLog(r, "auth", "logout", currentUsername(r), "", "", "everywhere")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+	}
+
+	list, err := loadUserSessions(userID, current)
+	if err != nil {
+		log.Error("Database Error:", err)
+		http.Error(w, "Internal DB error", http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(message)
+	b.WriteString(`<p>These are the browsers and devices logged in to your account. Sign out any you don't recognise, and change your password.</p>
+    <table class="table table-sm align-middle">
+        <tr><th>Device</th><th>IP address</th><th>Logged in</th><th>Last seen</th><th></th></tr>`)
+	for _, s := range list {
+		action := `<span class="text-muted">This device</span>`
+		if !s.Current {
+			action = fmt.Sprintf(`<form action="/account/sessions" method="POST">%s<input type="hidden" name="action" value="revoke"><input type="hidden" name="id" value="%d"><button class="btn btn-sm btn-outline-danger" type="submit">Sign out</button></form>`, csrfInput(r), s.ID)
+		}
+		b.WriteString(fmt.Sprintf(`<tr><td title="%s">%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+			html.EscapeString(s.UserAgent), html.EscapeString(describeDevice(s.UserAgent)), html.EscapeString(s.IP),
+			formatDateTime(s.CreatedAt), formatDateTime(s.LastSeen), action))
+	}
+	b.WriteString(fmt.Sprintf(`</table>
+    <form action="/account/sessions" method="POST" class="d-inline">
+        %[1]s
+        <input type="hidden" name="action" value="revoke-others">
+        <button class="btn btn-outline-secondary" type="submit">Sign out everywhere else</button>
+    </form>
+    <form action="/account/sessions" method="POST" class="d-inline">
+        %[1]s
+        <input type="hidden" name="action" value="revoke-all">
+        <button class="btn btn-outline-danger" type="submit">Sign out everywhere</button>
+    </form>`, csrfInput(r)))
+
+	renderTemplate(w, "title", newSpecialPage("Your sessions", b.String(), getUserAgent(r)))
+}
@@ -0,0 +1,134 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// loggedIn reports whether client's session still works
+func loggedIn(t *testing.T, ts *httptest.Server, client *http.Client) bool {
+	t.Helper()
+	_, body := get(t, client, ts.URL+"/account/sessions")
+	return strings.Contains(body, "Sign out everywhere")
+}
+
+// copyCookies is client with a jar of its own holding client's cookies, like
+// a stolen cookie
+func copyCookies(t *testing.T, ts *httptest.Server, client *http.Client) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(ts.URL)
+	jar.SetCookies(u, client.Jar.Cookies(u))
+	copied := *client
+	copied.Jar = jar
+	return &copied
+}
+
+func TestSessionListingAndRevocation(t *testing.T) {
+	testUser(t, "Ed049", "ed-pass-049", "editor", "")
+	ts, laptop := newTestServer(t)
+	login(t, ts, laptop, "Ed049", "ed-pass-049")
+	_, phone := newTestServer(t)
+	login(t, ts, phone, "Ed049", "ed-pass-049")
+	_, tablet := newTestServer(t)
+	login(t, ts, tablet, "Ed049", "ed-pass-049")
+
+	_, body := get(t, laptop, ts.URL+"/account/sessions")
+	if n := strings.Count(body, "<tr><td"); n != 3 {
+		t.Errorf("%d sessions listed, want 3", n)
+	}
+	if n := strings.Count(body, "This device"); n != 1 {
+		t.Errorf("%d sessions marked as this device, want 1", n)
+	}
+
+	var phoneSession int
+	authDB.QueryRow("SELECT id FROM Sessions WHERE user_id = (SELECT id FROM Users WHERE username = 'Ed049') ORDER BY id DESC LIMIT 1 OFFSET 1").Scan(&phoneSession)
+	submit(t, laptop, ts.URL+"/account/sessions", ts.URL+"/account/sessions", url.Values{"action": {"revoke"}, "id": {strconv.Itoa(phoneSession)}})
+	if loggedIn(t, ts, phone) || !loggedIn(t, ts, tablet) || !loggedIn(t, ts, laptop) {
+		t.Fatal("revoking one session didn't sign out just that one")
+	}
+
+	submit(t, laptop, ts.URL+"/account/sessions", ts.URL+"/account/sessions", url.Values{"action": {"revoke-others"}})
+	if loggedIn(t, ts, tablet) || !loggedIn(t, ts, laptop) {
+		t.Fatal("signing out everywhere else didn't keep only this session")
+	}
+
+	submit(t, laptop, ts.URL+"/account/sessions", ts.URL+"/account/sessions", url.Values{"action": {"revoke-all"}})
+	if loggedIn(t, ts, laptop) {
+		t.Fatal("signing out everywhere left this session")
+	}
+}
+
+func TestLogoutEndsCopiedSessions(t *testing.T) {
+	testUser(t, "Ed049b", "ed-pass-049b", "editor", "")
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Ed049b", "ed-pass-049b")
+	stolen := copyCookies(t, ts, client)
+	if !loggedIn(t, ts, stolen) {
+		t.Fatal("the copied cookie didn't work to begin with")
+	}
+
+	submit(t, client, ts.URL+"/logout", ts.URL+"/logout", url.Values{})
+	if loggedIn(t, ts, client) || loggedIn(t, ts, stolen) {
+		t.Error("a copy of the cookie outlived the logout")
+	}
+}
+
+func TestAdminSignsUserOut(t *testing.T) {
+	id := testUser(t, "Ed049c", "ed-pass-049c", "editor", "")
+	testUser(t, "Admin049", "admin-pass-049", "admin", "")
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Ed049c", "ed-pass-049c")
+	_, admin := newTestServer(t)
+	login(t, ts, admin, "Admin049", "admin-pass-049")
+
+	_, body := submit(t, admin, ts.URL+"/admin/users", ts.URL+"/admin/users", url.Values{"action": {"sign-out"}, "id": {strconv.Itoa(id)}})
+	if !strings.Contains(body, "Ed049c has been signed out of 1 session(s)") {
+		t.Error("no confirmation of the forced logout")
+	}
+	if loggedIn(t, ts, client) {
+		t.Error("the user is still logged in")
+	}
+	if !loggedIn(t, ts, admin) {
+		t.Error("the admin was signed out too")
+	}
+}
+
+func TestDescribeDevice(t *testing.T) {
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0":                   "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1": "Safari on iPhone",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                                  "Firefox on Linux",
+		"curl/8.4.0": "curl",
+		"":           "Unknown device",
+	} {
+		if got := describeDevice(ua); got != want {
+			t.Errorf("describeDevice(%q) = %q, want %q", ua, got, want)
+		}
+	}
+}
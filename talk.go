@@ -0,0 +1,328 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	"github.com/gomarkdown/markdown"
+	log "github.com/sirupsen/logrus"
+)
+
+// TalkTabs drives the Article / Discussion tabs in title.html, a tab whose
+// page doesn't exist yet is shown red
+type TalkTabs struct {
+	SubjectTitle  string
+	TalkTitle     string
+	SubjectExists bool
+	TalkExists    bool
+	IsTalk        bool
+}
+
+type TalkComment struct {
+	ID        int
+	ParentID  int
+	Subject   string
+	Body      string
+	Username  string
+	CreatedAt time.Time
+	Replies   []*TalkComment
+}
+
+// talkPair returns the article and discussion titles for any page title,
+// ok is false for titles that have no discussion such as Special pages
+func talkPair(title string) (subject string, talk string, ok bool) {
+	ns, name := splitTitle(title)
+	switch ns.ID {
+	case NamespaceSpecial, NamespaceCategory, NamespaceFile:
+		return "", "", false
+	case NamespaceTalk:
+		return name, title, name != ""
+	}
+	talkNS, _ := namespaceByID(NamespaceTalk)
+	return title, talkNS.Title(title), true
+}
+
+func loadTalkTabs(title string) *TalkTabs {
+	subject, talk, ok := talkPair(title)
+	if !ok {
+		return nil
+	}
+	return &TalkTabs{
+		SubjectTitle:  subject,
+		TalkTitle:     talk,
+		SubjectExists: checkPageExistence(subject),
+		TalkExists:    checkPageExistence(talk),
+		IsTalk:        title == talk,
+	}
+}
+
+// expandSignatures turns ~~~ into the user, ~~~~ into the user and time and
+// ~~~~~ into just the time, the same as MediaWiki
+func expandSignatures(text string, username string, now time.Time) string {
+	if username == "" || !strings.Contains(text, "~~~") {
+		return text
+	}
+	user := fmt.Sprintf("[%s](/title/User:%s)", username, url.PathEscape(username))
+	timestamp := formatDateTime(now.UTC()) + " (UTC)"
+	text = strings.ReplaceAll(text, "~~~~~", timestamp)
+	text = strings.ReplaceAll(text, "~~~~", "— "+user+" "+timestamp)
+	return strings.ReplaceAll(text, "~~~", "— "+user)
+}
+
+func loadTalkComments(pageID int) ([]*TalkComment, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	rows, err := dbConn.Query(`SELECT id, COALESCE(parent_id, 0), COALESCE(subject, ''), body, COALESCE(username, ''), created_at
+		FROM TalkComments WHERE page_id = ? ORDER BY id`, pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*TalkComment)
+	var topics []*TalkComment
+	for rows.Next() {
+		c := &TalkComment{}
+		if err := rows.Scan(&c.ID, &c.ParentID, &c.Subject, &c.Body, &c.Username, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		byID[c.ID] = c
+		if parent, ok := byID[c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			topics = append(topics, c)
+		}
+	}
+	return topics, rows.Err()
+}
+
+// csrf is the form token of a logged in visitor, "" hides the reply forms
+func renderComment(b *strings.Builder, talkTitle string, c *TalkComment, csrf string) {
+	body := convertLinksToAnchors(string(markdown.ToHTML([]byte(c.Body), nil, nil)))
+	b.WriteString(fmt.Sprintf(`<li id="comment-%d" class="talkComment">%s`, c.ID, body))
+	if csrf != "" {
+		b.WriteString(fmt.Sprintf(`<details class="mb-2"><summary class="text-muted small">Reply</summary>
+            <form action="/talk/%s" method="POST">
+                <input type="hidden" name="%s" value="%s">
+                <input type="hidden" name="parent" value="%d">
+                <textarea class="form-control form-control-sm mb-1" name="body" rows="3" required></textarea>
+                <button class="btn btn-sm btn-outline-secondary" type="submit">Reply</button>
+            </form></details>`, url.PathEscape(talkTitle), csrfField, html.EscapeString(csrf), c.ID))
+	}
+	if len(c.Replies) > 0 {
+		b.WriteString(`<ul class="talkThread">`)
+		for _, reply := range c.Replies {
+			renderComment(b, talkTitle, reply, csrf)
+		}
+		b.WriteString(`</ul>`)
+	}
+	b.WriteString(`</li>`)
+}
+
+// renderTalkThreads renders every topic on a talk page followed by the new
+// topic form, which like the replies is only there when csrf is set
+func renderTalkThreads(talkTitle string, pageID int, csrf string) (string, error) {
+	var topics []*TalkComment
+	if pageID != 0 {
+		var err error
+		if topics, err = loadTalkComments(pageID); err != nil {
+			return "", err
+		}
+	}
+
+	var b strings.Builder
+	if len(topics) == 0 {
+		b.WriteString(`<p>There is no discussion on this page yet.</p>`)
+	}
+	for _, topic := range topics {
+		subject := topic.Subject
+		if subject == "" {
+			subject = "(no subject)"
+		}
+		b.WriteString(fmt.Sprintf(`<h2 class="wikih2">%s</h2><ul class="talkThread">`, html.EscapeString(subject)))
+		renderComment(&b, talkTitle, topic, csrf)
+		b.WriteString(`</ul>`)
+	}
+
+	if csrf != "" {
+		b.WriteString(fmt.Sprintf(`<h2 class="wikih2">Start a new topic</h2>
+        <form action="/talk/%s" method="POST">
+            <input type="hidden" name="%s" value="%s">
+            <input class="form-control mb-2" type="text" name="subject" placeholder="Subject" required>
+            <textarea class="form-control mb-2" name="body" rows="5" required></textarea>
+            <p class="text-muted small">Your comment is signed automatically, or sign it yourself with ~~~~.</p>
+            <button class="btn btn-sm btn-outline-secondary" type="submit">Add topic</button>
+        </form>`, url.PathEscape(talkTitle), csrfField, html.EscapeString(csrf)))
+	} else {
+		b.WriteString(`<p><a href="/login">Log in</a> to join the discussion.</p>`)
+	}
+	return b.String(), nil
+}
+
+// handleTalkPage shows a Talk: page, its editable header followed by the threads
+func handleTalkPage(w http.ResponseWriter, r *http.Request, title string, userAgent string) {
+	title = canonicalizeTitle(title)
+	p, err := loadPage(title, userAgent)
+	if err != nil {
+		log.WithError(err).WithField("title", title).Error("Failed to load talk page")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	pageID, _ := getPageID(title)
+	csrf := ""
+	if currentUsername(r) != "" {
+		csrf = csrfToken(r)
+	}
+	threads, err := renderTalkThreads(title, pageID, csrf)
+	if err != nil {
+		log.WithError(err).WithField("title", title).Error("Failed to load discussion")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	p.Body += template.HTML(threads)
+	if pageID == 0 {
+		p.UpdatedDate = ""
+	}
+	renderTemplate(w, "title", p)
+}
+
+func getPageID(title string) (int, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return 0, err
+	}
+	defer dbConn.Close()
+
+	var id int
+	err = dbConn.QueryRow("SELECT id FROM Pages WHERE title = ?", title).Scan(&id)
+	return id, err
+}
+
+// talkPostHandler adds a topic (subject set) or a reply (parent set) to
+// /talk/<Talk:title>, creating the talk page on the first post
+func talkPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	title := canonicalizeTitle(strings.TrimPrefix(r.URL.Path, "/talk/"))
+	if ns, _ := splitTitle(title); ns.ID != NamespaceTalk {
+		http.Error(w, "Not a talk page", http.StatusBadRequest)
+		return
+	}
+	if !requireReadable(w, r, title) {
+		return
+	}
+	if ok, p := canEditTitle(r, title); !ok {
+		denyProtected(w, r, title, p)
+		return
+	}
+
+	username := currentUsername(r)
+	userID := currentUserID(r)
+	subject := strings.TrimSpace(r.FormValue("subject"))
+	body := strings.TrimSpace(r.FormValue("body"))
+	parentID, _ := strconv.Atoi(r.FormValue("parent"))
+	if body == "" || (parentID == 0 && subject == "") {
+		http.Error(w, "A comment needs some text, and a new topic needs a subject", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(body, "~~~") {
+		body += " ~~~~"
+	}
+	body = expandSignatures(body, username, time.Now())
+
+	commentID, err := addTalkComment(title, parentID, subject, body, userID, username)
+	if err != nil {
+		log.Error("Error saving comment:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeLog(r, "page", "comment", username, title, "", subject)
+	http.Redirect(w, r, fmt.Sprintf("/title/%s#comment-%d", url.PathEscape(title), commentID), http.StatusFound)
+}
+
+func addTalkComment(title string, parentID int, subject string, body string, userID int, username string) (int64, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return 0, err
+	}
+	defer dbConn.Close()
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var pageID int
+	err = tx.QueryRow("SELECT id FROM Pages WHERE title = ?", title).Scan(&pageID)
+	if err == sql.ErrNoRows {
+		res, err := tx.Exec("INSERT INTO Pages (title, namespace, body, user_id, created_at, updated_at) VALUES (?, ?, '', ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+			title, NamespaceTalk, nullUserID(userID))
+		if err != nil {
+			return 0, err
+		}
+		id, _ := res.LastInsertId()
+		pageID = int(id)
+	} else if err != nil {
+		return 0, err
+	}
+
+	var parent interface{}
+	if parentID != 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM TalkComments WHERE id = ? AND page_id = ?)", parentID, pageID).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, fmt.Errorf("comment %d is not on %s", parentID, title)
+		}
+		parent = parentID
+		subject = ""
+	}
+
+	res, err := tx.Exec(`INSERT INTO TalkComments (page_id, parent_id, subject, body, user_id, username, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+		pageID, parent, subject, body, nullUserID(userID), username)
+	if err != nil {
+		return 0, err
+	}
+	commentID, _ := res.LastInsertId()
+
+	if _, err := tx.Exec("UPDATE Pages SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", pageID); err != nil {
+		return 0, err
+	}
+	return commentID, tx.Commit()
+}
@@ -0,0 +1,112 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTalkPair(t *testing.T) {
+	tests := []struct {
+		title, subject, talk string
+		ok                   bool
+	}{
+		{"Main_Page", "Main_Page", "Talk:Main_Page", true},
+		{"Help:Intro", "Help:Intro", "Talk:Help:Intro", true},
+		{"Talk:Help:Intro", "Help:Intro", "Talk:Help:Intro", true},
+		{"Talk:", "", "Talk:", false},
+		{"Special:Log", "", "", false},
+		{"Category:Docs", "", "", false},
+		{"File:Logo.png", "", "", false},
+	}
+	for _, tt := range tests {
+		subject, talk, ok := talkPair(tt.title)
+		if subject != tt.subject || talk != tt.talk || ok != tt.ok {
+			t.Errorf("talkPair(%q) = %q, %q, %v", tt.title, subject, talk, ok)
+		}
+	}
+}
+
+func TestExpandSignatures(t *testing.T) {
+	now := time.Date(2024, 3, 5, 14, 7, 0, 0, time.UTC)
+	user := "[Ann](/title/User:Ann)"
+	stamp := "5 March 2024, at 14:07 (UTC)"
+	tests := map[string]string{
+		"hi ~~~":   "hi — " + user,
+		"hi ~~~~":  "hi — " + user + " " + stamp,
+		"hi ~~~~~": "hi " + stamp,
+		"hi ~~":    "hi ~~",
+	}
+	for in, want := range tests {
+		if got := expandSignatures(in, "Ann", now); got != want {
+			t.Errorf("expandSignatures(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := expandSignatures("hi ~~~~", "", now); got != "hi ~~~~" {
+		t.Errorf("signed without a user: %q", got)
+	}
+}
+
+var commentIDRegex = regexp.MustCompile(`id="comment-(\d+)"`)
+
+func TestTalkThreads(t *testing.T) {
+	testUser(t, "Editor037", "editor-pass-037", "editor", "")
+	savePage(t, "Subject037", "the article", 0)
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM TalkComments WHERE page_id IN (SELECT id FROM Pages WHERE title = 'Talk:Subject037')")
+		authDB.Exec("DELETE FROM Pages WHERE title = 'Talk:Subject037'")
+	})
+	if tabs := loadTalkTabs("Subject037"); tabs == nil || !tabs.SubjectExists || tabs.TalkExists || tabs.IsTalk {
+		t.Fatalf("tabs before any discussion: %+v", tabs)
+	}
+
+	ts, client := newTestServer(t)
+	_, body := get(t, client, ts.URL+"/title/Talk:Subject037")
+	if !strings.Contains(body, "There is no discussion") || strings.Contains(body, `action="/talk/`) {
+		t.Error("an anonymous visitor is offered the comment form")
+	}
+
+	login(t, ts, client, "Editor037", "editor-pass-037")
+	talkPage := ts.URL + "/title/Talk:Subject037"
+	post := ts.URL + "/talk/Talk:Subject037"
+	_, body = submit(t, client, talkPage, post, url.Values{"subject": {"Naming037"}, "body": {"Rename it?"}})
+	match := commentIDRegex.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("the new topic isn't on the talk page")
+	}
+	_, body = submit(t, client, talkPage, post, url.Values{"parent": {match[1]}, "body": {"Agreed ~~~"}})
+
+	// the reply sits inside the topic's thread, the topic is signed with the time
+	if !inOrder(body, ">Naming037</h2>", "Rename it?", "Editor037</a>", "(UTC)", `<ul class="talkThread">`, "Agreed — ", "Editor037</a>") {
+		t.Errorf("thread rendered as\n%s", body)
+	}
+	if tabs := loadTalkTabs("Subject037"); !tabs.TalkExists {
+		t.Error("the discussion tab is still red after posting")
+	}
+
+	topicID, _ := strconv.Atoi(match[1])
+	if _, err := addTalkComment("Talk:Other037", topicID, "", "stray", 0, "Editor037"); err == nil {
+		t.Error("replied to a comment on another talk page")
+	}
+	t.Cleanup(func() { authDB.Exec("DELETE FROM Pages WHERE title = 'Talk:Other037'") })
+}
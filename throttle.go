@@ -0,0 +1,161 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins are counted per IP address and per username. Past the free
+// attempts each failure doubles the wait before the next try, and enough of
+// them lock the key out for a while. Counts are kept in memory and forgotten
+// an hour after the last failure
+const (
+	throttleBase     = time.Second
+	throttleMaxWait  = 5 * time.Minute
+	lockoutDuration  = 15 * time.Minute
+	throttleForgetIn = time.Hour
+)
+
+type throttlePolicy struct {
+	free         int // failures allowed before any wait
+	lockoutAfter int
+}
+
+var (
+	accountThrottle = throttlePolicy{free: 3, lockoutAfter: 10}
+	// several people can share an address, so it gets more room
+	ipThrottle = throttlePolicy{free: 10, lockoutAfter: 30}
+)
+
+type loginFailures struct {
+	count int
+	last  time.Time
+	until time.Time // no attempts before this
+}
+
+type loginThrottle struct {
+	mu      sync.Mutex
+	entries map[string]*loginFailures
+}
+
+var logins = &loginThrottle{entries: make(map[string]*loginFailures)}
+
+func accountKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// wait is how long until any of keys may try again, zero if they all can
+func (t *loginThrottle) wait(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var longest time.Duration
+	for _, key := range keys {
+		if e, ok := t.entries[key]; ok {
+			if wait := time.Until(e.until); wait > longest {
+				longest = wait
+			}
+		}
+	}
+	return longest
+}
+
+// fail counts a failure against key and reports whether it has just been locked out
+func (t *loginThrottle) fail(key string, policy throttlePolicy) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, e := range t.entries {
+		if now.Sub(e.last) > throttleForgetIn && now.After(e.until) {
+			delete(t.entries, k)
+		}
+	}
+
+	e, ok := t.entries[key]
+	if !ok {
+		e = &loginFailures{}
+		t.entries[key] = e
+	}
+	e.count++
+	e.last = now
+	switch {
+	case e.count == policy.lockoutAfter:
+		e.until = now.Add(lockoutDuration)
+		return true
+	case e.count > policy.free:
+		wait := throttleMaxWait
+		if shift := e.count - policy.free - 1; shift < 16 {
+			wait = min(throttleBase<<shift, throttleMaxWait)
+		}
+		e.until = now.Add(wait)
+	}
+	return false
+}
+
+func (t *loginThrottle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// lockedUntil is when a lockout of key ends, zero when it isn't locked out
+func (t *loginThrottle) lockedUntil(key string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.entries[key]; ok && time.Now().Before(e.until) {
+		return e.until
+	}
+	return time.Time{}
+}
+
+// loginFailed counts a wrong password or 2FA code, logging any lockout it causes
+func loginFailed(r *http.Request, username string, detail string) {
+	writeLog(r, "auth", "login-failure", username, "", "", detail)
+	if logins.fail(accountKey(username), accountThrottle) {
+		writeLog(r, "auth", "lockout", "", username, "", fmt.Sprintf("%d failed logins, for %s", accountThrottle.lockoutAfter, lockoutDuration))
+	}
+	if logins.fail(ipKey(r), ipThrottle) {
+		writeLog(r, "auth", "lockout", "", clientIP(r), "", fmt.Sprintf("%d failed logins, for %s", ipThrottle.lockoutAfter, lockoutDuration))
+	}
+}
+
+// throttled answers with a 429 when username or the visitor's address has to
+// wait, and reports whether it did
+func throttled(w http.ResponseWriter, r *http.Request, username string) bool {
+	wait := logins.wait(accountKey(username), ipKey(r))
+	if wait <= 0 {
+		return false
+	}
+	writeLog(r, "auth", "login-failure", username, "", "", "throttled")
+	wait = wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())))
+	w.WriteHeader(http.StatusTooManyRequests)
+	renderTemplate(w, "title", newSpecialPage("Too many failed logins", alert("alert-danger", fmt.Sprintf("Too many failed logins, try again in %s.", wait)), getUserAgent(r)))
+	return true
+}
@@ -0,0 +1,118 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottleBackoffAndLockout(t *testing.T) {
+	throttle := &loginThrottle{entries: make(map[string]*loginFailures)}
+	policy := throttlePolicy{free: 2, lockoutAfter: 6}
+
+	for i := 1; i <= policy.free; i++ {
+		throttle.fail("k", policy)
+		if wait := throttle.wait("k"); wait != 0 {
+			t.Fatalf("failure %d is free but has to wait %s", i, wait)
+		}
+	}
+	var last time.Duration
+	for i := policy.free + 1; i < policy.lockoutAfter; i++ {
+		if throttle.fail("k", policy) {
+			t.Fatalf("locked out after %d failures, want %d", i, policy.lockoutAfter)
+		}
+		wait := throttle.wait("k", "other")
+		if wait <= last || wait > throttleBase<<(i-policy.free-1) {
+			t.Errorf("failure %d waits %s after %s", i, wait, last)
+		}
+		last = wait
+	}
+	if !throttle.fail("k", policy) {
+		t.Fatal("no lockout reported")
+	}
+	if until := throttle.lockedUntil("k"); time.Until(until) < lockoutDuration-time.Minute {
+		t.Errorf("locked until %s, want about %s from now", until, lockoutDuration)
+	}
+	if throttle.wait("other") != 0 {
+		t.Error("an unrelated key has to wait")
+	}
+
+	throttle.reset("k")
+	if throttle.wait("k") != 0 || !throttle.lockedUntil("k").IsZero() {
+		t.Error("reset didn't lift the lockout")
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	testUser(t, "Guessed047", "guessed-pass-047", "editor", "")
+	t.Cleanup(func() {
+		logins.reset(accountKey("Guessed047"))
+		logins.reset("ip:127.0.0.1")
+	})
+
+	ts, client := newTestServer(t)
+	try := func(password string) int {
+		status, _ := submit(t, client, ts.URL+"/login", ts.URL+"/loginPost", url.Values{"username": {"Guessed047"}, "password": {password}})
+		return status
+	}
+	for i := 0; i <= accountThrottle.free; i++ {
+		if status := try("wrong"); status == http.StatusTooManyRequests {
+			t.Fatalf("throttled after %d failures", i)
+		}
+	}
+	// the next try has to wait, even with the right password
+	if status := try("guessed-pass-047"); status != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", status)
+	}
+	var throttledLogs int
+	authDB.QueryRow("SELECT COUNT(*) FROM Logs WHERE action = 'login-failure' AND username = 'Guessed047' AND details = 'throttled'").Scan(&throttledLogs)
+	if throttledLogs == 0 {
+		t.Error("the throttled attempt wasn't logged")
+	}
+
+	logins.reset(accountKey("Guessed047"))
+	logins.reset("ip:127.0.0.1")
+	login(t, ts, client, "Guessed047", "guessed-pass-047")
+}
+
+func TestWeakPasswordMustBeChanged(t *testing.T) {
+	id := testUser(t, "Weak047", "weak-pass-047", "editor", "")
+	// a password from before the rules, like the seeded admin/admin
+	hash, err := hashPassword("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authDB.Exec("UPDATE Users SET password = ? WHERE id = ?", hash, id); err != nil {
+		t.Fatal(err)
+	}
+	ts, client := newTestServer(t)
+	status, body := submit(t, client, ts.URL+"/login", ts.URL+"/loginPost", url.Values{"username": {"Weak047"}, "password": {"admin"}})
+	if status != http.StatusOK || !accountState(id).ChangePassword {
+		t.Fatalf("status %d, the account wasn't made to change its password", status)
+	}
+	if !strings.Contains(body, `name="current"`) {
+		t.Error("the login didn't lead to the password form")
+	}
+	if status, body := get(t, client, ts.URL+"/edit/Anything047"); status != http.StatusOK || strings.Contains(body, `name="body"`) {
+		t.Error("an account that must change its password could still edit")
+	}
+}
@@ -0,0 +1,440 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// TwoFactor is the "twoFactor" section of config.json
+type TwoFactor struct {
+	// accounts in these groups have no rights until they set up 2FA
+	RequiredGroups []string `json:"requiredGroups"`
+	// the name authenticator apps show, the site title if unset
+	Issuer string `json:"issuer"`
+}
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+	// how long the code step of a login may take, and how many guesses it gets
+	twoFactorLoginWindow = 5 * time.Minute
+	twoFactorLoginTries  = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// pendingLogin is a login whose password was right, waiting for its code. It
+// is kept here under a random id from the visitor's cookie rather than in the
+// cookie itself, so an old copy of the cookie can't buy a fresh set of tries
+type pendingLogin struct {
+	userID   int
+	username string
+	since    time.Time
+	tries    int
+}
+
+var pendingLogins = struct {
+	sync.Mutex
+	entries map[string]*pendingLogin
+}{entries: make(map[string]*pendingLogin)}
+
+// twoFactorRequired reports whether accounts in group must use 2FA
+func twoFactorRequired(group string) bool {
+	for _, required := range config.TwoFactor.RequiredGroups {
+		if required == group {
+			return true
+		}
+	}
+	return false
+}
+
+func newTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(raw), nil
+}
+
+// totpCode is the RFC 4226 HOTP value of key at counter step
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// checkTOTP looks for code in the time steps either side of now, skipping
+// steps up to lastStep that have already been used, and returns its step
+func checkTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeCode drops the spaces and dashes people type or paste
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes replaces the account's recovery codes and returns them,
+// they are only ever shown this once
+func newRecoveryCodes(userID int) ([]string, error) {
+	tx, err := authDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM RecoveryCodes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:]
+		if _, err := tx.Exec("INSERT INTO RecoveryCodes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit()
+}
+
+// verifySecondFactor accepts a current authenticator code or an unused
+// recovery code for the account, and uses it up
+func verifySecondFactor(userID int, code string) (bool, error) {
+	var secret sql.NullString
+	var lastStep int64
+	if err := authDB.QueryRow("SELECT totp_secret, COALESCE(totp_last_step, 0) FROM Users WHERE id = ?", userID).Scan(&secret, &lastStep); err != nil {
+		return false, err
+	}
+	if !secret.Valid {
+		return false, nil
+	}
+
+	code = normalizeCode(code)
+	if step, ok := checkTOTP(secret.String, code, lastStep); ok {
+		_, err := authDB.Exec("UPDATE Users SET totp_last_step = ? WHERE id = ?", step, userID)
+		return err == nil, err
+	}
+	res, err := authDB.Exec("UPDATE RecoveryCodes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// disableTwoFactor removes the authenticator and recovery codes of an account
+func disableTwoFactor(userID int) error {
+	if _, err := authDB.Exec("UPDATE Users SET totp_secret = NULL, totp_last_step = NULL WHERE id = ?", userID); err != nil {
+		return err
+	}
+	_, err := authDB.Exec("DELETE FROM RecoveryCodes WHERE user_id = ?", userID)
+	return err
+}
+
+// startTwoFactorLogin parks a login whose password was right until the code is given
+func startTwoFactorLogin(w http.ResponseWriter, r *http.Request, userID int, username string) {
+	session, _ := store.Get(r, "cookie-name")
+	clearTwoFactorLogin(session.Values)
+	id := newSessionID()
+	pendingLogins.Lock()
+	for key, p := range pendingLogins.entries {
+		if time.Since(p.since) > twoFactorLoginWindow {
+			delete(pendingLogins.entries, key)
+		}
+	}
+	pendingLogins.entries[id] = &pendingLogin{userID: userID, username: username, since: time.Now()}
+	pendingLogins.Unlock()
+
+	session.Values["authenticated"] = false
+	session.Values["pending_login"] = id
+	session.Save(r, w)
+	http.Redirect(w, r, "/login/2fa", http.StatusFound)
+}
+
+func clearTwoFactorLogin(session map[interface{}]interface{}) {
+	if id, ok := session["pending_login"].(string); ok {
+		pendingLogins.Lock()
+		delete(pendingLogins.entries, id)
+		pendingLogins.Unlock()
+	}
+	delete(session, "pending_login")
+}
+
+// pendingLoginFor returns a copy of the login waiting under id, nil once it
+// has timed out or run out of tries. attempt uses up one of its tries before
+// the code is checked, so guesses sent at the same time all count
+func pendingLoginFor(id string, attempt bool) *pendingLogin {
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+	p, ok := pendingLogins.entries[id]
+	if !ok {
+		return nil
+	}
+	if time.Since(p.since) > twoFactorLoginWindow || p.tries >= twoFactorLoginTries {
+		delete(pendingLogins.entries, id)
+		return nil
+	}
+	if attempt {
+		p.tries++
+	}
+	found := *p
+	return &found
+}
+
+// twoFactorLoginHandler is /login/2fa, the second step of logging in
+func twoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "cookie-name")
+	id, _ := session.Values["pending_login"].(string)
+	pending := pendingLoginFor(id, false)
+	if pending != nil && r.Method == http.MethodPost {
+		if throttled(w, r, pending.username) {
+			return
+		}
+		pending = pendingLoginFor(id, true)
+	}
+	if pending == nil {
+		clearTwoFactorLogin(session.Values)
+		session.Save(r, w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	userID, username := pending.userID, pending.username
+
+	message := ""
+	if r.Method == http.MethodPost {
+		ok, err := verifySecondFactor(userID, r.FormValue("code"))
+		if err != nil {
+			log.Error("Database Error:", err)
+			http.Error(w, "Internal DB error", http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			clearTwoFactorLogin(session.Values)
+			completeLogin(w, r, session, userID, username)
+			return
+		}
+		loginFailed(r, username, "wrong 2FA code")
+		message = alert("alert-danger", "Sorry, that code is wrong.")
+	}
+
+	body := message + `<p>Enter the 6 digit code from your authenticator app, or one of your recovery codes.</p>
+    <form action="/login/2fa" method="POST">
+        ` + csrfInput(r) + `
+        <div class="form-group">
+          <label for="code">Code:</label>
+          <input class="form-control" type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" autofocus required>
+        </div>
+        <button class="btn btn-outline-secondary mt-2" type="submit">Log in</button>
+    </form>`
+	renderTemplate(w, "title", newSpecialPage("Two-factor authentication", body, getUserAgent(r)))
+}
+
+// twoFactorHandler is /account/2fa, where a user sets up, checks or turns
+// off their authenticator
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r)
+	account := accountState(userID)
+	group, enrolled := account.Group, account.TwoFactor
+	if group == "" {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if account.ChangePassword {
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+	render := func(body string, status int) {
+		w.WriteHeader(status)
+		renderTemplate(w, "title", newSpecialPage("Two-factor authentication", body, getUserAgent(r)))
+	}
+	recoveryList := func(codes []string) string {
+		return `<div class="alert alert-warning">Keep these recovery codes somewhere safe. Each one logs you in once if you lose your authenticator, and they won't be shown again.</div><pre class="border p-3">` +
+			strings.Join(codes, "\n") + `</pre><a href="/account/2fa">Done</a>`
+	}
+
+	if !enrolled {
+		// the key being set up lives in the session, which is kept server side
+		// once logged in, so the form can't swap in one of its own
+		session, _ := store.Get(r, "cookie-name")
+		secret, _ := session.Values["totp_enrol_secret"].(string)
+		if r.Method == http.MethodPost && secret != "" {
+			step, ok := checkTOTP(secret, normalizeCode(r.FormValue("code")), 0)
+			if !ok {
+				render(alert("alert-danger", "Sorry, that code is wrong, check the clock on your device and try again.")+enrolForm(r, secret), http.StatusBadRequest)
+				return
+			}
+			delete(session.Values, "totp_enrol_secret")
+			session.Save(r, w)
+			_, err := authDB.Exec("UPDATE Users SET totp_secret = ?, totp_last_step = ? WHERE id = ?", secret, step, userID)
+			var codes []string
+			if err == nil {
+				codes, err = newRecoveryCodes(userID)
+			}
+			if err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			writeLog(r, "user", "2fa-enable", currentUsername(r), "", "", "")
+			render(alert("alert-success", "Two-factor authentication is on.")+recoveryList(codes), http.StatusOK)
+			return
+		}
+
+		secret, err := newTOTPSecret()
+		if err != nil {
+			log.Error("Error creating 2FA secret:", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		session.Values["totp_enrol_secret"] = secret
+		session.Save(r, w)
+		notice := ""
+		if twoFactorRequired(group) {
+			notice = alert("alert-warning", fmt.Sprintf("The %s group has to use two-factor authentication, set it up to carry on.", group))
+		}
+		render(notice+enrolForm(r, secret), http.StatusOK)
+		return
+	}
+
+	message := ""
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		action := r.FormValue("action")
+		ok, err := verifySecondFactor(userID, r.FormValue("code"))
+		if err != nil {
+			log.Error("Database Error:", err)
+			http.Error(w, "Internal DB error", http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case !ok:
+			message, status = alert("alert-danger", "Sorry, that code is wrong."), http.StatusBadRequest
+		case action == "codes":
+			codes, err := newRecoveryCodes(userID)
+			if err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			writeLog(r, "user", "2fa-codes", currentUsername(r), "", "", "")
+			render(recoveryList(codes), http.StatusOK)
+			return
+		case action == "disable" && twoFactorRequired(group):
+			message, status = alert("alert-danger", fmt.Sprintf("The %s group has to use two-factor authentication.", group)), http.StatusConflict
+		case action == "disable":
+			if err := disableTwoFactor(userID); err != nil {
+				log.Error("Database Error:", err)
+				http.Error(w, "Internal DB error", http.StatusInternalServerError)
+				return
+			}
+			writeLog(r, "user", "2fa-disable", currentUsername(r), "", "", "")
+			http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+			return
+		}
+	}
+
+	var left int
+	if err := authDB.QueryRow("SELECT COUNT(*) FROM RecoveryCodes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&left); err != nil {
+		log.Error("Database Error:", err)
+	}
+	form := func(action string, button string) string {
+		return fmt.Sprintf(`<form action="/account/2fa" method="POST" class="row g-2 mb-3">
+        %s
+        <input type="hidden" name="action" value="%s">
+        <div class="col-auto"><input class="form-control form-control-sm" type="text" name="code" placeholder="Current code" autocomplete="one-time-code" required></div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">%s</button></div>
+    </form>`, csrfInput(r), action, button)
+	}
+	body := message + fmt.Sprintf(`<div class="alert alert-success">Two-factor authentication is on. You have %d unused recovery codes.</div>
+    <h2 class="wikih2">New recovery codes</h2>%s`, left, form("codes", "Make new codes"))
+	if !twoFactorRequired(group) {
+		body += `<h2 class="wikih2">Turn off</h2>` + form("disable", "Turn off two-factor authentication")
+	}
+	render(body, status)
+}
+
+// enrolForm shows secret as a QR code for an authenticator app to scan
+func enrolForm(r *http.Request, secret string) string {
+	issuer := config.TwoFactor.Issuer
+	if issuer == "" {
+		issuer = config.SiteTitle
+	}
+	uri := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s&algorithm=SHA1&digits=%d&period=%d",
+		url.PathEscape(issuer), url.PathEscape(currentUsername(r)), secret, url.QueryEscape(issuer), totpDigits, totpPeriod)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	qr := ""
+	if err != nil {
+		log.Error("Error drawing 2FA QR code:", err)
+	} else {
+		qr = fmt.Sprintf(`<img src="data:image/png;base64,%s" width="256" height="256" alt="QR code">`, base64.StdEncoding.EncodeToString(png))
+	}
+
+	return fmt.Sprintf(`<p>Scan this with an authenticator app, or enter the key by hand, then type in the code it shows.</p>
+    %s
+    <p><code>%s</code></p>
+    <form action="/account/2fa" method="POST" class="row g-2">
+        %s
+        <div class="col-auto"><input class="form-control form-control-sm" type="text" name="code" placeholder="Code" inputmode="numeric" autocomplete="one-time-code" required></div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">Turn on</button></div>
+    </form>`, qr, html.EscapeString(secret), csrfInput(r))
+}
@@ -0,0 +1,248 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ArcWiki/ArcWiki/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// contributions listed on Special:Contributions, newest first
+const maxContributions = 500
+
+type Contribution struct {
+	Kind       string // "create", "edit" or "upload"
+	Title      string
+	RevisionID int
+	Delta      int
+	Deleted    bool // the page is in the trash
+	CreatedAt  time.Time
+}
+
+// userIDByName returns the Users.id of an account, 0 if there is none
+func userIDByName(username string) int {
+	if username == "" {
+		return 0
+	}
+	var id int
+	if err := authDB.QueryRow("SELECT id FROM Users WHERE username = ?", username).Scan(&id); err != nil && err != sql.ErrNoRows {
+		log.Error("Database Error:", err)
+	}
+	return id
+}
+
+// nullUserID stores writes with no known author, such as a reindex, as NULL
+func nullUserID(userID int) interface{} {
+	if userID == 0 {
+		return nil
+	}
+	return userID
+}
+
+// findUsername matches a name from a title, where the first letter has been
+// uppercased and spaces may have become underscores, to the stored username,
+// preferring an exact match. Empty if there is no such user
+func findUsername(name string) string {
+	var username string
+	err := authDB.QueryRow(`SELECT username FROM Users
+		WHERE username COLLATE NOCASE IN (?1, ?2)
+		ORDER BY username = ?1 DESC, username = ?2 DESC LIMIT 1`,
+		name, strings.ReplaceAll(name, "_", " ")).Scan(&username)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Database Error:", err)
+	}
+	return username
+}
+
+// userRoot is the account a User: title belongs to, User:Name/Notes belongs to Name
+func userRoot(title string) string {
+	_, name := splitTitle(title)
+	name, _, _ = strings.Cut(name, "/")
+	return name
+}
+
+// handleUserPage shows User:<name> with a bar linking to the user's contributions
+func handleUserPage(w http.ResponseWriter, r *http.Request, title string, userAgent string) {
+	title = canonicalizeTitle(title)
+	p, err := loadPage(title, userAgent)
+	if err != nil {
+		log.WithError(err).WithField("title", title).Error("Failed to load user page")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	username := findUsername(userRoot(title))
+	var joined sql.NullTime
+	err = authDB.QueryRow("SELECT created_at FROM Users WHERE username = ?", username).Scan(&joined)
+	var bar string
+	switch {
+	case err == sql.ErrNoRows:
+		bar = fmt.Sprintf(`<div class="alert alert-secondary">There is no user named %s.</div>`, html.EscapeString(removeUnderscores(userRoot(title))))
+	case err != nil:
+		log.Error("Database Error:", err)
+	default:
+		since := ""
+		if joined.Valid {
+			since = " · joined " + joined.Time.Format("2 January 2006")
+		}
+		bar = fmt.Sprintf(`<p class="text-muted"><a href="/title/Special:Contributions/%s">Contributions</a>%s</p>`,
+			url.PathEscape(username), since)
+		if !checkPageExistence(title) && currentUsername(r) == username {
+			bar += fmt.Sprintf(`<p>You haven't written your user page yet. <a href="/edit/%s">Create it</a> to tell others about yourself.</p>`, url.PathEscape(title))
+		}
+	}
+	p.Body = template.HTML(bar) + p.Body
+	renderTemplate(w, "title", p)
+}
+
+// Special:Contributions/<name> lists a user's edits, page creations and uploads
+func loadContributions(r *http.Request, username string, userAgent string) (*Page, error) {
+	if username == "" {
+		username = strings.TrimSpace(r.URL.Query().Get("user"))
+	}
+	if found := findUsername(username); found != "" {
+		username = found
+	}
+
+	var bodyHTML strings.Builder
+	bodyHTML.WriteString(fmt.Sprintf(`<form action="/title/Special:Contributions" method="GET" class="row g-2 mb-3">
+        <div class="col-auto"><input class="form-control form-control-sm" type="text" name="user" placeholder="User" value="%s"></div>
+        <div class="col-auto"><button class="btn btn-sm btn-outline-secondary" type="submit">Show</button></div>
+    </form>`, html.EscapeString(username)))
+
+	title := "Special:Contributions"
+	if username == "" {
+		return newSpecialPage(title, bodyHTML.String(), userAgent), nil
+	}
+	title += "/" + username
+
+	userID := userIDByName(username)
+	if userID == 0 {
+		bodyHTML.WriteString(fmt.Sprintf(`<p>There is no user named %s.</p>`, html.EscapeString(username)))
+		return newSpecialPage(title, bodyHTML.String(), userAgent), nil
+	}
+
+	contributions, err := queryContributions(userID, can(r, PermDelete))
+	if err != nil {
+		return nil, err
+	}
+
+	bodyHTML.WriteString(fmt.Sprintf(`<p>For <a href="/title/User:%s">%s</a></p>`, url.PathEscape(username), html.EscapeString(username)))
+	if len(contributions) == 0 {
+		bodyHTML.WriteString(`<p>No contributions yet.</p>`)
+		return newSpecialPage(title, bodyHTML.String(), userAgent), nil
+	}
+
+	access := readAccessFor(r)
+	bodyHTML.WriteString(`<ul>`)
+	for _, c := range contributions {
+		if c.Kind != "upload" && !access.canRead(c.Title) {
+			continue
+		}
+		var line string
+		switch c.Kind {
+		case "upload":
+			line = fmt.Sprintf(`uploaded <a href="/title/File:%s">File:%s</a>`, url.PathEscape(c.Title), html.EscapeString(c.Title))
+		default:
+			delta := fmt.Sprintf("%+d", c.Delta)
+			line = fmt.Sprintf(`(<a href="/diff/%d">diff</a>) <a href="/title/%s">%s</a> <span class="text-muted">(%s)</span>`,
+				c.RevisionID, url.PathEscape(c.Title), html.EscapeString(removeUnderscores(c.Title)), delta)
+			if c.Kind == "create" {
+				line += ` <b>N</b>`
+			}
+			if c.Deleted {
+				line += ` <span class="text-muted">(deleted)</span>`
+			}
+		}
+		bodyHTML.WriteString(fmt.Sprintf(`<li>%s %s</li>`, formatDateTime(c.CreatedAt), line))
+	}
+	bodyHTML.WriteString(`</ul>`)
+
+	return newSpecialPage(title, bodyHTML.String(), userAgent), nil
+}
+
+// queryContributions lists a user's revisions and uploads. Revisions of pages
+// in the trash are only included withDeleted
+func queryContributions(userID int, withDeleted bool) ([]Contribution, error) {
+	dbConn, err := db.LoadDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	rows, err := dbConn.Query(`SELECT r.id, r.title, LENGTH(COALESCE(r.body, '')), r.created_at,
+		(SELECT LENGTH(COALESCE(p.body, '')) FROM Revisions p WHERE p.page_id = r.page_id AND p.id < r.id ORDER BY p.id DESC LIMIT 1),
+		r.page_id IN (SELECT original_id FROM Archive WHERE kind = 'page')
+		FROM Revisions r WHERE r.user_id = ? ORDER BY r.id DESC LIMIT ?`, userID, maxContributions)
+	if err != nil {
+		return nil, err
+	}
+	var contributions []Contribution
+	for rows.Next() {
+		c := Contribution{Kind: "edit"}
+		var size int
+		var prevSize sql.NullInt64
+		if err := rows.Scan(&c.RevisionID, &c.Title, &size, &c.CreatedAt, &prevSize, &c.Deleted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c.Deleted && !withDeleted {
+			continue
+		}
+		if !prevSize.Valid {
+			c.Kind = "create"
+		}
+		c.Delta = size - int(prevSize.Int64)
+		contributions = append(contributions, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = dbConn.Query("SELECT name, created_at FROM Files WHERE user_id = ? ORDER BY id DESC LIMIT ?", userID, maxContributions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := Contribution{Kind: "upload"}
+		if err := rows.Scan(&c.Title, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		contributions = append(contributions, c)
+	}
+
+	sort.SliceStable(contributions, func(i, j int) bool {
+		return contributions[i].CreatedAt.After(contributions[j].CreatedAt)
+	})
+	if len(contributions) > maxContributions {
+		contributions = contributions[:maxContributions]
+	}
+	return contributions, rows.Err()
+}
@@ -0,0 +1,156 @@
+/*
+ *   Copyright (c) 2024 Edward Stock
+
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFindUsername(t *testing.T) {
+	testUser(t, "ann lee038", "ann-pass-038", "editor", "")
+	for _, name := range []string{"ann lee038", "Ann_lee038", "ANN LEE038"} {
+		if got := findUsername(name); got != "ann lee038" {
+			t.Errorf("findUsername(%q) = %q", name, got)
+		}
+	}
+	if got := findUsername("Nobody038"); got != "" {
+		t.Errorf("findUsername of a missing user = %q", got)
+	}
+	for title, want := range map[string]string{"User:Ann": "Ann", "User:Ann/Notes/Old": "Ann", "User:": ""} {
+		if got := userRoot(title); got != want {
+			t.Errorf("userRoot(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestContributions(t *testing.T) {
+	userID := testUser(t, "Editor038", "editor-pass-038", "editor", "")
+	savePage(t, "Written038", "12345", userID)
+	savePage(t, "Written038", "12", userID)
+	savePage(t, "Written038", "someone else", 0)
+	insertFile(t, "Upload038.png", 10, userID)
+
+	contributions, err := queryContributions(userID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range contributions {
+		got = append(got, fmt.Sprintf("%s %s %+d", c.Kind, c.Title, c.Delta))
+	}
+	want := map[string]bool{"create Written038 +5": true, "edit Written038 -3": true, "upload Upload038.png +0": true}
+	if len(got) != len(want) {
+		t.Fatalf("contributions %v", got)
+	}
+	for _, line := range got {
+		if !want[line] {
+			t.Errorf("unexpected contribution %q in %v", line, got)
+		}
+	}
+}
+
+func TestUserPages(t *testing.T) {
+	userID := testUser(t, "Editor038b", "editor-pass-038", "editor", "")
+	ts, client := newTestServer(t)
+
+	_, body := get(t, client, ts.URL+"/title/User:Nobody038")
+	if !strings.Contains(body, "There is no user named Nobody038") {
+		t.Error("a user page for a missing account doesn't say so")
+	}
+
+	login(t, ts, client, "Editor038b", "editor-pass-038")
+	_, body = get(t, client, ts.URL+"/title/User:Editor038b")
+	if !strings.Contains(body, `href="/edit/User:Editor038b"`) {
+		t.Error("the owner isn't offered to create their user page")
+	}
+	submit(t, client, ts.URL+"/edit/User:Editor038b", ts.URL+"/save/User:Editor038b", url.Values{
+		"title": {"User:Editor038b"},
+		"body":  {"About me"},
+	})
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Pages WHERE title = 'User:Editor038b'")
+		authDB.Exec("DELETE FROM Revisions WHERE title = 'User:Editor038b'")
+	})
+
+	// the page records who wrote it, not user 1
+	var author int
+	if err := authDB.QueryRow("SELECT user_id FROM Pages WHERE title = 'User:Editor038b'").Scan(&author); err != nil {
+		t.Fatal(err)
+	}
+	if author != userID {
+		t.Errorf("user page author %d, want %d", author, userID)
+	}
+
+	_, body = get(t, client, ts.URL+"/title/Special:Contributions/Editor038b")
+	if !inOrder(body, `(<a href="/diff/`, `">User:Editor038b</a>`, "<b>N</b>") {
+		t.Errorf("contributions don't list the new user page with a diff link")
+	}
+}
+
+func TestWritesRecordTheAuthor(t *testing.T) {
+	userID := testUser(t, "Editor039", "editor-pass-039", "editor", "")
+	ts, client := newTestServer(t)
+	login(t, ts, client, "Editor039", "editor-pass-039")
+	// Logs can't be cleaned up, so only count the entries from this run
+	var lastLog int
+	authDB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM Logs").Scan(&lastLog)
+
+	submit(t, client, ts.URL+"/add", ts.URL+"/addpage", url.Values{"title": {"Added039"}, "body": {"new"}})
+	submit(t, client, ts.URL+"/edit/Added039", ts.URL+"/save/Added039", url.Values{"title": {"Added039"}, "body": {"changed"}})
+	submit(t, client, ts.URL+"/title/Category:Made039", ts.URL+"/category/Made039", url.Values{})
+	t.Cleanup(func() {
+		authDB.Exec("DELETE FROM Pages WHERE title = 'Added039'")
+		authDB.Exec("DELETE FROM Revisions WHERE title = 'Added039'")
+		authDB.Exec("DELETE FROM Categories WHERE title = 'Made039'")
+	})
+
+	for query, want := range map[string]int{
+		"SELECT user_id FROM Pages WHERE title = 'Added039'":                      userID,
+		"SELECT COUNT(*) FROM Revisions WHERE title = 'Added039' AND user_id = ?": 2,
+		"SELECT user_id FROM Categories WHERE title = 'Made039'":                  userID,
+	} {
+		var got int
+		args := []interface{}{}
+		if strings.Contains(query, "?") {
+			args = append(args, userID)
+		}
+		if err := authDB.QueryRow(query, args...).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if got != want {
+			t.Errorf("%s = %d, want %d", query, got, want)
+		}
+	}
+
+	var logged int
+	authDB.QueryRow("SELECT COUNT(*) FROM Logs WHERE username = 'Editor039' AND target IN ('Added039', 'Category:Made039') AND id > ?", lastLog).Scan(&logged)
+	if logged != 3 {
+		t.Errorf("%d log entries by Editor039, want 3", logged)
+	}
+
+	// a write with no one behind it, such as a reindex, has no author rather than user 0
+	savePage(t, "Unowned039", "x", 0)
+	var nulls int
+	authDB.QueryRow("SELECT COUNT(*) FROM Pages WHERE title = 'Unowned039' AND user_id IS NULL").Scan(&nulls)
+	if nulls != 1 {
+		t.Error("a write without a user stored an author")
+	}
+}
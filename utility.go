@@ -67,97 +67,74 @@ func formatDateTime(t time.Time) string {
 	return t.Format("2 January 2006, at 15:04")
 }
 
-func updateSubCategoryLinks() error {
-	log.Info("checking for subcategory links...")
-
+// reindex rebuilds CategoryPages, SubCategoryPages, PendingCategoryLinks and FileUsage from the
+// stored page and category bodies, run with "arcwiki reindex"
+func reindex() error {
 	db, err := db.LoadDatabase()
 	if err != nil {
-		log.Error("Database Error:", err)
+		return err
 	}
 	defer db.Close()
 
-	// Fetch all pages and their content
-	rows, err := db.Query("SELECT id, body FROM Categories")
-	if err != nil {
-		log.Error("Database Error:", err)
-	}
-	defer rows.Close()
-
-	var pagesToUpdate []struct {
-		pageID     int
-		categories []string
+	type row struct {
+		id   int
+		body string
 	}
-
-	for rows.Next() {
-		var pageID int
-		var body string
-		if err := rows.Scan(&pageID, &body); err != nil {
-			return err
+	loadRows := func(query string) ([]row, error) {
+		rows, err := db.Query(query)
+		if err != nil {
+			return nil, err
 		}
-
-		// Extract categories from content
-		//re := regexp.MustCompile("\\[Category:(.*)\\]")
-		re := regexp.MustCompile(`\[Category:(.*)\]`)
-
-		matches := re.FindAllStringSubmatch(string(body), -1)
-
-		if len(matches) > 0 {
-			categories := []string{}
-			if len(matches[0]) > 1 {
-				categories = matches[0][1:] // Extract category from first match
+		defer rows.Close()
+		var result []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.body); err != nil {
+				return nil, err
 			}
-			pagesToUpdate = append(pagesToUpdate, struct {
-				pageID     int
-				categories []string
-			}{pageID, categories})
+			result = append(result, r)
 		}
+		return result, rows.Err()
+	}
 
+	pages, err := loadRows("SELECT id, COALESCE(body, '') FROM Pages")
+	if err != nil {
+		return err
+	}
+	categories, err := loadRows("SELECT id, COALESCE(body, '') FROM Categories")
+	if err != nil {
+		return err
 	}
 
-	// Perform batch operations in a single transaction
 	tx, err := db.Begin()
 	if err != nil {
-
 		return err
 	}
-	defer tx.Rollback() // Rollback if any error occurs
+	defer tx.Rollback()
 
-	for _, page := range pagesToUpdate {
-
-		// Batch delete existing links for the page
-		log.Error("Cat pageID:", page.pageID)
-
-		_, err = tx.Exec("DELETE FROM SubCategoryPages WHERE subcategory_id = ?", page.pageID)
-		if err != nil {
+	for _, table := range []string{"CategoryPages", "SubCategoryPages", "PendingCategoryLinks", "FileUsage"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
 			return err
 		}
-
-		// Batch insert new category links
-		for _, category := range page.categories {
-			categoryName := category
-
-			var categoryID int
-			err := tx.QueryRow("SELECT id FROM Categories WHERE title = ?", categoryName).Scan(&categoryID)
-			if err == nil {
-				_, err = tx.Exec("INSERT INTO SubCategoryPages (subcategory_id, category_id) VALUES (?, ?)", page.pageID, categoryID)
-				if err != nil {
-					log.Error("Database Error", err)
-
-				}
-			} else {
-				// Handle category not found (e.g., log error, create category, or skip)
-				log.Error("Category not found in Categories table:", categoryName)
-
-			}
+	}
+	for _, p := range pages {
+		if err := linkPageCategories(tx, p.id, p.body, 0); err != nil {
+			return err
+		}
+		if err := updateFileUsage(tx, p.id, p.body); err != nil {
+			return err
 		}
 	}
-
-	// Commit the transaction if no errors occurred
-	err = tx.Commit()
-	if err != nil {
-		log.Error("Database Error", err)
+	for _, c := range categories {
+		if err := linkSubCategories(tx, c.id, c.body, 0); err != nil {
+			return err
+		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof("Reindexed %d pages and %d categories", len(pages), len(categories))
 	return nil
 }
 
@@ -168,7 +145,15 @@ func canonicalizeTitle(text string) string {
 		return text
 	}
 
-	// Uppercase only the first character, leave the rest untouched
+	// A namespace prefix is written the registered way, "help:foo" becomes "Help:Foo"
+	if ns, name := splitTitle(text); ns.Name != "" {
+		return ns.Title(upperFirst(name))
+	}
+	return upperFirst(text)
+}
+
+// Uppercase only the first character, leave the rest untouched
+func upperFirst(text string) string {
 	firstRune, size := utf8.DecodeRuneInString(text)
 	if firstRune == utf8.RuneError {
 		return text // bad input
@@ -210,10 +195,12 @@ func isPreposition(word string) bool {
 	return prepositions[word]
 }
 
+// categoryTagRegex matches [Category:Name] and [Category:Name|SortKey]
+var categoryTagRegex = regexp.MustCompile(`\[Category:([^\]|]*)(?:\|([^\]]*))?\]`)
+
 // find all CategoryLinks on a page
 func findAllCategoryLinks(text string) []string {
-	regex := regexp.MustCompile(`\[Category:([^\]|]*)\]`)
-	matches := regex.FindAllStringSubmatch(text, -1) // Find all matches
+	matches := categoryTagRegex.FindAllStringSubmatch(text, -1) // Find all matches
 
 	links := make([]string, 0)
 	for _, match := range matches {
@@ -223,10 +210,21 @@ func findAllCategoryLinks(text string) []string {
 	return links
 }
 
+// findCategorySortKeys maps each category to the sort key given in its tag,
+// the first tag wins when a category is tagged twice
+func findCategorySortKeys(text string) map[string]string {
+	keys := make(map[string]string)
+	for _, match := range categoryTagRegex.FindAllStringSubmatch(text, -1) {
+		if _, ok := keys[match[1]]; !ok {
+			keys[match[1]] = strings.TrimSpace(match[2])
+		}
+	}
+	return keys
+}
+
 // removes the Links off the page
 func removeCategoryLinks(inputString string) string {
-	categoryLinkRegex := regexp.MustCompile(`\[Category:([^\]|]*)\]`)
-	return categoryLinkRegex.ReplaceAllString(inputString, "")
+	return categoryTagRegex.ReplaceAllString(inputString, "")
 }
 
 // creates a table of contents List